@@ -8,14 +8,18 @@
 package engine3
 
 import (
+	"context"
+	"crypto/ed25519"
 	"database/sql"
 	"errors"
 	"fmt"
 	_ "github.com/lib/pq"
 	"log"
+	"log/slog"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // Database Instance
@@ -26,7 +30,20 @@ import (
 type Database struct {
 	dbconnect *sql.DB // database connection (from database/sql, is pooled)
 	name      string
-	dbname    string
+	dbname    string // connection string, contains secrets: never log it
+
+	log       atomic.Pointer[slog.Logger]      // nil: package logger
+	resolver  atomic.Pointer[ConflictResolver] // nil: LastWriterWins
+	retention atomic.Int64                     // tombstones, 0: DefaultTombstoneRetention
+	strict    atomic.Bool                      // refuse versions with mismatching digests
+
+	oplogRetention atomic.Pointer[OplogRetention] // nil: no limits
+	readWait       atomic.Int64                   // reads at a token, 0: no waiting
+
+	keyFile string             // the private signing key, "": none
+	keyMu   sync.Mutex         // protects key and keyRead
+	key     ed25519.PrivateKey // nil: the node has no key (yet)
+	keyRead bool               // the key file was read
 }
 
 // the global list of database instances known in the process
@@ -37,40 +54,67 @@ var databases = map[string]*Database{}
 // a Read-write mutex to protect it`
 var databasesRWLock sync.RWMutex
 
-// database connect string,
-// to be read from configuration
+// database connect string template,
+// read once from the environment (ENGINE_DB)
 //
-// We read from the environment later (secure store needed eventually)
-var dbTemplate string = "user=rainer dbname=$database$ sslmode=disable"
-
-// helper function for tracing (some better idea needed)
-func checkString(name, value string) {
+// If it is empty, connections are described by the package Config
+var (
+	dbTemplate     string
+	dbTemplateOnce sync.Once
+)
 
-	fmt.Printf("CHECK: %v %v\n", name, value)
-
-}
+// the Config used by GetDatabase (nil: read from the environment)
+var packageConfig *Config
 
 // get the database connection string template (from environment for now)
 func getDbTemplate() string {
-	if dbTemplate == "" {
-		dbTemplate = os.Getenv("ENGINE_DB")
-	}
+	dbTemplateOnce.Do(func() { dbTemplate = os.Getenv("ENGINE_DB") })
 	return dbTemplate
 }
 
+// get the Config used by GetDatabase
+func getConfig() (Config, error) {
+
+	databasesRWLock.RLock()
+	cfg := packageConfig
+	databasesRWLock.RUnlock()
+
+	if cfg != nil {
+		return *cfg, nil
+	}
+	return ConfigFromEnv()
+}
+
 // translate database name into db connection string
 //
-// conncetion string needs to have a $database$ variable to be replaced by the database name
+// a template from ENGINE_DB needs to have a $database$ variable to be
+// replaced by the database name, otherwise the package Config is used
 //
-func dbname(name string) string {
-	dn := strings.Replace(getDbTemplate(), "$database$", name, 1)
+func dbname(name string) (string, Config, error) {
+
+	cfg, err := getConfig()
+	if err != nil {
+		return "", cfg, err
+	}
+
+	if template := getDbTemplate(); template != "" {
+		dn := strings.Replace(template, "$database$", name, 1)
+
+		pkgLogger().Debug("connection from template", "database", name, "dsn", redactDSN(dn))
+		return dn, cfg, nil
+	}
+
+	dn, err := cfg.dsn(name)
+	if err != nil {
+		return "", cfg, err
+	}
 
-	checkString("generated database name", dn)
-	return dn
+	pkgLogger().Debug("connection from config", "database", name, "dsn", redactDSN(dn))
+	return dn, cfg, nil
 }
 
 // get a database object for a given name
-func get(name string) *Database {
+func get(ctx context.Context, name string) (*Database, error) {
 
 	// lock global map for reading
 	databasesRWLock.RLock()
@@ -78,20 +122,19 @@ func get(name string) *Database {
 	databasesRWLock.RUnlock()
 
 	if ok {
-		checkString("get database ok", name)
-		return db
+		return db, nil
 	}
 
-	db = add(name)
-	return db
+	return add(ctx, name)
 }
 
 // helper function for error handling (go panic!)
+//
+// only used for errors, which cannot happen at runtime (embedded files)
 func checkErr(trace string, err error) {
 
 	if err != nil {
-		fmt.Printf("ERROR: %#v\n", err)
-		log.Panic(err)
+		log.Panicf("%s: %v", trace, err)
 	}
 
 }
@@ -104,173 +147,404 @@ func checkRow(row *sql.Row) {
 
 }
 
+// a database connection or a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// run fn in a transaction, which is committed if fn succeeds
+func inTx(ctx context.Context, dbconnect *sql.DB, op string, fn func(tx *sql.Tx) error) error {
+
+	tx, err := dbconnect.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapErr("begin "+op, err)
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return wrapErr("commit "+op, tx.Commit())
+}
+
 // Test database connections
 //
 // Initial test for live database connection`
-func ping(dbconnect *sql.DB) {
-	var err error
-
-	err = dbconnect.Ping()
+func ping(ctx context.Context, dbconnect *sql.DB) error {
 
-	checkErr("ping", err)
+	return wrapErr("ping", dbconnect.PingContext(ctx))
 }
 
-// Add a new database connection
-func add(name string) *Database {
+// open a connection pool for a database
+func open(name string, dn string, cfg Config) (*Database, error) {
 
 	db := new(Database)
 
 	db.name = name
-	db.dbname = dbname(name)
+	db.dbname = dn
 	dbconnect, err := sql.Open("postgres", db.dbname)
-	checkErr("add", err)
+	if err != nil {
+		return nil, wrapErr("open "+name, err)
+	}
+
+	c := cfg.forDatabase(name)
+	db.keyFile = c.keyFile(name)
+	if c.MaxOpenConns != 0 {
+		dbconnect.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns != 0 {
+		dbconnect.SetMaxIdleConns(c.MaxIdleConns)
+	}
 
 	db.dbconnect = dbconnect
 
+	return db, nil
+}
+
+// Add a new database connection
+//
+// The map is checked again under the write lock, so that concurrent
+// callers share one pool instead of leaking all but one.
+func add(ctx context.Context, name string) (*Database, error) {
+
+	dn, cfg, err := dbname(name)
+	if err != nil {
+		return nil, err
+	}
+
 	// lock for writing
 	databasesRWLock.Lock()
-	databases[name] = db
+	db, ok := databases[name]
+	if !ok {
+		// sql.Open does not connect, it is cheap to hold the lock
+		db, err = open(name, dn, cfg)
+		if err == nil {
+			databases[name] = db
+		}
+	}
 	databasesRWLock.Unlock()
 
+	if err != nil {
+		return nil, err
+	}
+
 	// ping
-	ping(dbconnect)
+	if err := ping(ctx, db.dbconnect); err != nil {
+		pkgLogger().Warn("database not reachable", "database", name, "err", err)
+
+		// do not keep a pool, which never worked
+		remove(name, db)
+		db.dbconnect.Close()
+		return nil, err
+	}
 
-	return db
+	return db, nil
+}
+
+// remove a database from the global list, if it is still registered
+func remove(name string, db *Database) bool {
+
+	databasesRWLock.Lock()
+	defer databasesRWLock.Unlock()
+
+	if databases[name] != db {
+		return false
+	}
+	delete(databases, name)
+	return true
 }
 
 // Calling database stored functions
 
 // Retrieve a new TSN from database as int64
-func newTSN(dbconnect *sql.DB) int64 {
+func newTSN(ctx context.Context, q querier) (int64, error) {
 
 	var tsn int64
 
-	row := dbconnect.QueryRow("select nodes.new_tsn()")
+	row := q.QueryRowContext(ctx, "select nodes.new_tsn()")
 	checkRow(row)
 
 	err := row.Scan(&tsn)
-	checkErr("newTSN", err)
 
-	return tsn
+	return tsn, wrapErr("nodes.new_tsn", err)
 }
 
 // Put a new value
-func putPowerData(dbconnect *sql.DB, in_key string, in_value string) {
+func putPowerData(ctx context.Context, q querier, in_key string, in_value string) error {
 
-	_, err := dbconnect.Exec("select power.put( $1, $2 )", in_key, in_value)
+	_, err := q.ExecContext(ctx, "select power.put( $1, $2 )", in_key, in_value)
 
-	checkErr("power.put", err)
-
-	return
+	return wrapErr("power.put", err)
 }
 
 // get a value
-func getPowerData(dbconnect *sql.DB, in_key string) string {
+func getPowerData(ctx context.Context, q querier, in_key string) (string, error) {
 
 	var out_value sql.NullString
 
-	row := dbconnect.QueryRow("select power.get( $1 )", in_key)
+	row := q.QueryRowContext(ctx, "select power.get( $1 )", in_key)
 	checkRow(row)
 
 	err := row.Scan(&out_value)
-	checkErr("getPowerData", err)
+	if err != nil {
+		return "", wrapErr("power.get", err)
+	}
 
 	if out_value.Valid == true {
-		return out_value.String
+		return out_value.String, nil
 	} else {
-		return ""
 		/* NULL value means not there */
+		return "", notFound("power data " + in_key)
 	}
 
 }
 
 // delete an entry
-func deletePowerData(dbconnect *sql.DB, in_key string) {
-
-	_, err := dbconnect.Exec("select power.delete( $1 )", in_key)
+func deletePowerData(ctx context.Context, q querier, in_key string) error {
 
-	checkErr("power.delete", err)
+	_, err := q.ExecContext(ctx, "select power.delete( $1 )", in_key)
 
-	return
+	return wrapErr("power.delete", err)
 }
 
 //
 // PACKAGE EXPORTS
 
-// Get the database for a given name
+// Options for GetDatabase
+type Option func(*options)
+
+type options struct {
+	migrate       bool // apply pending migrations
+	requireSchema bool // refuse databases with an older schema
+}
+
+// Apply pending schema migrations when getting the database
+func AutoMigrate() Option {
+	return func(o *options) { o.migrate = true }
+}
+
+// Refuse a database, whose schema is older than the library
+func RequireSchema() Option {
+	return func(o *options) { o.requireSchema = true }
+}
+
+// Set the Config used by GetDatabase for new connections
+//
+// Without it the Config is read from the environment (ConfigFromEnv).
+// A connection template in ENGINE_DB takes precedence.
 //
 // Package export
-func GetDatabase(name string) (db *Database, err error) {
+func SetConfig(cfg Config) {
 
-	defer func() {
+	databasesRWLock.Lock()
+	packageConfig = &cfg
+	databasesRWLock.Unlock()
+}
 
-		if r := recover(); r != nil {
-			// recover from panic
-			err = errors.New("cannot create database connection")
+// Open a database with a given Config
+//
+// The Database is owned by the caller, it is not shared with GetDatabase.
+//
+// Package export
+func Open(cfg Config, name string) (*Database, error) {
+	return OpenContext(context.Background(), cfg, name)
+}
 
-		}
+// Open a database with a given Config
+//
+// Package export
+func OpenContext(ctx context.Context, cfg Config, name string) (*Database, error) {
 
-	}()
+	dn, err := cfg.dsn(name)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgLogger().Debug("open database", "database", name, "dsn", redactDSN(dn))
+
+	db, err := open(name, dn, cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	db = get(name)
+	if err := ping(ctx, db.dbconnect); err != nil {
+		db.dbconnect.Close()
+		return nil, err
+	}
 
-	return db, err
+	return db, nil
 }
 
-// From a given database object retrieve the next TSN
+// Close the database connections
 //
-// Package Export
-func (db *Database) NewTSN() (tsn int64, err error) {
+// A Database from GetDatabase is removed from the shared list, the next
+// GetDatabase for its name opens a new pool.
+//
+// Package export
+func (db *Database) Close() error {
+
+	remove(db.name, db)
 
-	defer func() {
+	return wrapErr("close "+db.name, db.dbconnect.Close())
+}
+
+// Close all databases known to GetDatabase
+//
+// Package export
+func CloseAll() error {
+	var errs []error
 
-		if r := recover(); r != nil {
-			// recover from panic
-			err = errors.New("error while reading TSN")
+	databasesRWLock.Lock()
+	all := databases
+	databases = map[string]*Database{}
+	databasesRWLock.Unlock()
 
+	for name, db := range all {
+		if err := db.dbconnect.Close(); err != nil {
+			errs = append(errs, wrapErr("close "+name, err))
 		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Remove a database from the list of GetDatabase and close it
+//
+// Handles held by callers fail with sql.ErrConnDone afterwards.
+//
+// Package export
+func Evict(name string) error {
 
-	}()
+	databasesRWLock.Lock()
+	db, ok := databases[name]
+	delete(databases, name)
+	databasesRWLock.Unlock()
 
-	tsn = newTSN(db.dbconnect)
-	return
+	if !ok {
+		return nil
+	}
+
+	return wrapErr("close "+name, db.dbconnect.Close())
 }
 
-// Put power.data
+// Evict a database and open it again (e.g. after a failover)
 //
-// Package Export
-func (db *Database) PutPowerData(in_key string, in_value string) (err error) {
+// Package export
+func Reopen(name string, opts ...Option) (*Database, error) {
+	return ReopenContext(context.Background(), name, opts...)
+}
 
-	defer func() {
+// Evict a database and open it again (e.g. after a failover)
+//
+// Package export
+func ReopenContext(ctx context.Context, name string, opts ...Option) (*Database, error) {
+
+	if err := Evict(name); err != nil {
+		return nil, err
+	}
 
-		if r := recover(); r != nil {
-			// recover from panic
-			err = errors.New("error while inserting power data")
+	return GetDatabaseContext(ctx, name, opts...)
+}
 
+// Get the database for a given name
+//
+// Package export
+func GetDatabase(name string, opts ...Option) (*Database, error) {
+	return GetDatabaseContext(context.Background(), name, opts...)
+}
+
+// Get the database for a given name
+//
+// Package export
+func GetDatabaseContext(ctx context.Context, name string, opts ...Option) (*Database, error) {
+	var o options
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	db, err := get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.migrate {
+		if _, err := migrate(db.withLogger(ctx), db.dbconnect); err != nil {
+			return nil, err
 		}
+	}
 
-	}()
+	if o.requireSchema {
+		version, err := schemaVersion(ctx, db.dbconnect)
+		if err != nil {
+			return nil, err
+		}
+		if version < RequiredSchemaVersion() {
+			return nil, fmt.Errorf("%w: database %s has schema version %d, library requires %d",
+				ErrSchemaMismatch, name, version, RequiredSchemaVersion())
+		}
+	}
 
-	putPowerData(db.dbconnect, in_key, in_value)
-	return
+	return db, nil
 }
 
-// Get Power.data
+// From a given database object retrieve the next TSN
 //
 // Package Export
-func (db *Database) GetPowerData(in_key string) (out_value string, err error) {
+func (db *Database) NewTSN() (int64, error) {
+	return db.NewTSNContext(context.Background())
+}
 
-	defer func() {
+// From a given database object retrieve the next TSN
+//
+// Package Export
+func (db *Database) NewTSNContext(ctx context.Context) (int64, error) {
+	return newTSN(ctx, db.dbconnect)
+}
 
-		if r := recover(); r != nil {
-			// recover from panic
-			err = errors.New("error while getting power data")
+// Put power.data
+//
+// Package Export
+func (db *Database) PutPowerData(in_key string, in_value string) error {
+	return db.PutPowerDataContext(context.Background(), in_key, in_value)
+}
 
-		}
+// Put power.data
+//
+// Package Export
+func (db *Database) PutPowerDataContext(ctx context.Context, in_key string, in_value string) error {
+	return putPowerData(ctx, db.dbconnect, in_key, in_value)
+}
 
-	}()
+// Get Power.data
+//
+// A missing key returns an error wrapping ErrNotFound
+//
+// Package Export
+func (db *Database) GetPowerData(in_key string) (string, error) {
+	return db.GetPowerDataContext(context.Background(), in_key)
+}
 
-	out_value = getPowerData(db.dbconnect, in_key)
+// Get Power.data
+//
+// Package Export
+func (db *Database) GetPowerDataContext(ctx context.Context, in_key string) (string, error) {
+	return getPowerData(ctx, db.dbconnect, in_key)
+}
+
+// Delete Power.data
+//
+// Package Export
+func (db *Database) DeletePowerData(in_key string) error {
+	return db.DeletePowerDataContext(context.Background(), in_key)
+}
 
-	return out_value, err
+// Delete Power.data
+//
+// Package Export
+func (db *Database) DeletePowerDataContext(ctx context.Context, in_key string) error {
+	return deletePowerData(ctx, db.dbconnect, in_key)
 }
@@ -8,260 +8,401 @@
 package engine3
 
 import (
+	"context"
+	"crypto/ed25519"
 	"database/sql"
 	"errors"
-	"fmt"
 	_ "github.com/lib/pq"
-	//"log"
-	//	"os"
-	//	"strings"
-	//	"sync"
+	"strconv"
 )
 
-func checkRows(trace string, rows *sql.Rows) {
+// Calling database stored functions
 
-	cols, err := rows.Columns()
-	if err != nil {
-		panic(err.Error())
-	}
+// call nodes.register, returns the clockid of the url
+func register(ctx context.Context, q querier, in_url string, in_data []byte) (int64, error) {
 
-	length := len(cols)
+	var out_id int64
 
-	fmt.Printf("%s COLS: %v\n", trace, length)
+	row := q.QueryRowContext(ctx, "select nodes.register( $1, $2 )", in_url, string(in_data))
+	checkRow(row)
 
-	for i, colName := range cols {
-		// var raw_value = *(values[i].(*interface{}))
-		// var raw_type = reflect.TypeOf(raw_value)
+	err := row.Scan(&out_id)
 
-		// fmt.Println(colName,raw_type,raw_value)
-		fmt.Printf("%v %v\n", i, colName)
-	}
+	return out_id, wrapErr("nodes.register", err)
 }
 
-/*
-// helper function for error handling (go panic!)
-func checkErr(trace string, err error) {
+// Register node
+//
+// the registration data with the public key of the node (unchanged
+// without key)
+//
+func withRegistrationKey(in_data []byte, key ed25519.PrivateKey) ([]byte, error) {
 
-	if err != nil {
-		fmt.Printf("ERROR: %#v\n", err)
-		log.Panic(err)
+	if key == nil {
+		return in_data, nil
 	}
-
-}
-
-// helper function for tracing a SQL return row
-// some better idea needed eventually (->tracing)
-func checkRow(row *sql.Row) {
-
-	// fmt.Printf( "ROW: %#v\n", row )
-
-}
-*/
-
-// Calling database stored functions
-
-// Retrieve a new TSN from database as int64
-func newTSN2(dbconnect *sql.DB) int64 {
-
-	var tsn int64
-
-	row := dbconnect.QueryRow("select nodes.new_tsn()")
-	checkRow(row)
-
-	err := row.Scan(&tsn)
-	checkErr("nodes: newTSN", err)
-
-	return tsn
+	return withPublicKey(in_data, key.Public().(ed25519.PublicKey))
 }
 
 // Register node
 //
 // Register master node
 //
-func registerMasterNode(dbconnect *sql.DB, in_url string, in_data []byte) int64 {
+func registerMasterNode(ctx context.Context, dbconnect *sql.DB, key ed25519.PrivateKey, in_url string, in_data []byte) (int64, error) {
 
-	var out_id int64
+	data, err := withRegistrationKey(in_data, key)
+	if err != nil {
+		return 0, err
+	}
 
-	row := dbconnect.QueryRow("select nodes.register( $1, $2 )", in_url, in_data)
-	checkRow(row)
+	out_id, err := register(ctx, dbconnect, in_url, data)
+	if err != nil {
+		return 0, err
+	}
 
-	err := row.Scan(&out_id)
+	if key != nil {
+		if err := signNode(ctx, dbconnect, key, out_id); err != nil {
+			return 0, err
+		}
 
-	checkErr("nodes.register", err)
+		// the master certifies the registrations
+		if err := setRegistryKey(ctx, dbconnect, key.Public().(ed25519.PublicKey)); err != nil {
+			return 0, err
+		}
+	}
 
-	return registerLocalClockID(dbconnect, out_id)
+	return registerLocalClockID(ctx, dbconnect, out_id)
 }
 
 // Register node
 //
 // Register local node (with clockiD generation)
 //
-func registerLocalNode(master *sql.DB, dbconnect *sql.DB, in_url string, in_data []byte) int64 {
+func registerLocalNode(ctx context.Context, master *sql.DB, masterKey ed25519.PrivateKey, dbconnect *sql.DB,
+	key ed25519.PrivateKey, in_url string, in_data []byte) (int64, error) {
 
-	var out_id int64
+	// the master signs the registration, the node cannot vouch for its own key
+	if key != nil && masterKey == nil {
+		return 0, errors.New("engine3: master: no signing key to certify the registration")
+	}
 
-	row := master.QueryRow("select nodes.register( $1, $2 )", in_url, in_data)
-	checkRow(row)
+	data, err := withRegistrationKey(in_data, key)
+	if err != nil {
+		return 0, err
+	}
 
-	err := row.Scan(&out_id)
+	out_id, err := register(ctx, master, in_url, data)
+	if err != nil {
+		return 0, wrapErr("master", err)
+	}
+
+	if key != nil {
+		if err := signNode(ctx, master, masterKey, out_id); err != nil {
+			return 0, wrapErr("master", err)
+		}
 
-	checkErr("master nodes.register", err)
+		if err := setRegistryKey(ctx, dbconnect, masterKey.Public().(ed25519.PublicKey)); err != nil {
+			return 0, err
+		}
+	}
 
-	return registerLocalClockID(dbconnect, out_id)
+	return registerLocalClockID(ctx, dbconnect, out_id)
 }
 
 // Register node
 //
 // Register local node to master node (without clockiD generation)
 //
-func registerLocalNodeToMaster(master *sql.DB, in_url string, in_data []byte) int64 {
-
-	var out_id int64
+func registerLocalNodeToMaster(ctx context.Context, master *sql.DB, in_url string, in_data []byte) (int64, error) {
 
-	row := master.QueryRow("select nodes.register( $1, $2 )", in_url, in_data)
-	checkRow(row)
-
-	err := row.Scan(&out_id)
+	out_id, err := register(ctx, master, in_url, in_data)
 
-	checkErr("master nodes.register", err)
-
-	return out_id
+	return out_id, wrapErr("master", err)
 }
 
 // Register node
 //
 // Register clockiD to local node
 //
-func registerLocalClockID(dbconnect *sql.DB, out_id int64) int64 {
-	_, err := dbconnect.Exec("select nodes.setmyclockid( $1 )", out_id)
+func registerLocalClockID(ctx context.Context, dbconnect *sql.DB, out_id int64) (int64, error) {
 
-	checkErr("set clockid", err)
+	_, err := dbconnect.ExecContext(ctx, "select nodes.setmyclockid( $1 )", out_id)
+	if err != nil {
+		return 0, wrapErr("nodes.setmyclockid", err)
+	}
 
-	return out_id
+	return out_id, nil
 }
 
 // Register node
 //
-// Register clockiD to local node
+// Read clockiD of local node (ErrNotRegistered, while it is 0)
 //
-func getMyClockID(dbconnect *sql.DB) int64 {
+func getMyClockID(ctx context.Context, q querier) (int64, error) {
 
 	var out_id int64
 
-	row := dbconnect.QueryRow("select nodes.myclockid()")
+	row := q.QueryRowContext(ctx, "select nodes.myclockid()")
 	checkRow(row)
 	err := row.Scan(&out_id)
-	checkErr("get my ClockID", err)
+	if err != nil {
+		return 0, wrapErr("nodes.myclockid", err)
+	}
 
-	return out_id
+	if out_id == 0 {
+		return 0, ErrNotRegistered
+	}
+
+	return out_id, nil
 }
 
 // Nodes Rest Functions
 //
-// GET
-// PUT
-// DELETE
-//
-// ....
+// The registered nodes are the things of nodes.systems, identified by
+// their clockid
 //
 
-// PACKAGE EXPORTS
+// the managed table of the registered nodes
+const systemsTable = "systems"
 
-// From a given database object retrieve the next TSN
+// GET: the node registered with a clockid
+func getNode(ctx context.Context, q querier, in_clockid int64) (Thing, error) {
+
+	row := q.QueryRowContext(ctx, "select * from nodes.thing_list( $1 ) where clockid = $2", systemsTable, in_clockid)
+	checkRow(row)
+
+	t, ok, err := rowToThing(row)
+	if err != nil {
+		return t, wrapErr("get node", err)
+	}
+	if !ok {
+		return t, notFound("node " + strconv.FormatInt(in_clockid, 10))
+	}
+
+	return t, nil
+}
+
+// PUT: new data for a registered node (the clockid and public key are kept)
 //
-// Package Export
-func (db *Database) NewNodesTSN() (tsn int64, err error) {
+// only the node itself or the master can sign its new registration
+func updateNode(ctx context.Context, q querier, key ed25519.PrivateKey, in_clockid int64, in_data []byte) (Thing, error) {
 
-	defer func() {
+	t, err := getNode(ctx, q, in_clockid)
+	if err != nil {
+		return t, err
+	}
+
+	if pk := registeredKey(t.Data); pk != nil && registeredKey(in_data) == nil {
+		if in_data, err = withPublicKey(in_data, pk); err != nil {
+			return t, err
+		}
+	}
 
-		if r := recover(); r != nil {
-			// recover from panic
-			err = errors.New("error while reading nodes TSN")
+	if _, err := register(ctx, q, t.URL, in_data); err != nil {
+		return t, err
+	}
 
+	if key != nil {
+		registry, err := registryKey(ctx, q)
+		if err != nil {
+			return t, err
+		}
+		myclockid, err := getMyClockID(ctx, q)
+		if err == nil && (myclockid == in_clockid || key.Public().(ed25519.PublicKey).Equal(registry)) {
+			err = signNode(ctx, q, key, in_clockid)
+		}
+		if err != nil && !errors.Is(err, ErrNotRegistered) {
+			return t, err
 		}
+	}
+
+	return getNode(ctx, q, in_clockid)
+}
 
-	}()
+// DELETE: remove the registration of a node
+func deleteNode(ctx context.Context, q querier, key ed25519.PrivateKey, in_clockid int64) error {
 
-	tsn = newTSN(db.dbconnect)
-	return
+	t, err := getNode(ctx, q, in_clockid)
+	if err != nil {
+		return err
+	}
+
+	_, err = deleteThing(ctx, q, key, systemsTable, t.URL)
+	return err
 }
 
-// Intial Registration
+// PACKAGE EXPORTS
+
+// From a given database object retrieve the next TSN
 //
 // Package Export
-func (db *Database) RegisterMasterNode(in_url string, in_data []byte) (out_value int64, err error) {
+func (db *Database) NewNodesTSN() (int64, error) {
+	return db.NewNodesTSNContext(context.Background())
+}
 
-	defer func() {
+// From a given database object retrieve the next TSN
+//
+// Package Export
+func (db *Database) NewNodesTSNContext(ctx context.Context) (int64, error) {
+	return newTSN(ctx, db.dbconnect)
+}
 
-		if r := recover(); r != nil {
-			// recover from panic
-			err = errors.New("error while register node")
+// Intial Registration
+//
+// The node gets a signing key; its public key is added to the
+// registration data (Systems.PublicKey), which has to be a JSON object.
+//
+// Package Export
+func (db *Database) RegisterMasterNode(in_url string, in_data []byte) (int64, error) {
+	return db.RegisterMasterNodeContext(context.Background(), in_url, in_data)
+}
 
-		}
+// Intial Registration
+//
+// Package Export
+func (db *Database) RegisterMasterNodeContext(ctx context.Context, in_url string, in_data []byte) (int64, error) {
 
-	}()
+	ctx = db.withLogger(ctx)
 
-	out_value = registerMasterNode(db.dbconnect, in_url, in_data)
+	key, err := db.createSigningKey(ctx)
+	if err != nil {
+		return 0, err
+	}
 
-	return out_value, err
+	return registerMasterNode(ctx, db.dbconnect, key, in_url, in_data)
 }
 
 // Intial Registration
 //
+// The local node gets a signing key; its public key is added to the
+// registration data (Systems.PublicKey), which has to be a JSON object.
+// The master signs the registration with its own key, which the local
+// node pins to check the registrations of other nodes with.
+//
 // Package Export
-func (db *Database) RegisterLocalNode(local *Database, in_url string, in_data []byte) (out_value int64, err error) {
+func (db *Database) RegisterLocalNode(local *Database, in_url string, in_data []byte) (int64, error) {
+	return db.RegisterLocalNodeContext(context.Background(), local, in_url, in_data)
+}
 
-	defer func() {
+// Intial Registration
+//
+// Package Export
+func (db *Database) RegisterLocalNodeContext(ctx context.Context, local *Database, in_url string, in_data []byte) (int64, error) {
 
-		if r := recover(); r != nil {
-			// recover from panic
-			err = errors.New("error while register node")
+	ctx = local.withLogger(ctx)
 
-		}
+	masterKey, err := db.signingKey(ctx)
+	if err != nil {
+		return 0, wrapErr("master", err)
+	}
 
-	}()
+	key, err := local.createSigningKey(ctx)
+	if err != nil {
+		return 0, err
+	}
 
-	out_value = registerLocalNode(db.dbconnect, local.dbconnect, in_url, in_data)
+	return registerLocalNode(ctx, db.dbconnect, masterKey, local.dbconnect, key, in_url, in_data)
+}
 
-	return out_value, err
+// Intial Registration
+//
+// Package Export
+func (db *Database) RegisterLocalNodeToMaster(in_url string, in_data []byte) (int64, error) {
+	return db.RegisterLocalNodeToMasterContext(context.Background(), in_url, in_data)
 }
 
 // Intial Registration
 //
 // Package Export
-func (db *Database) RegisterLocalNodeToMaster(in_url string, in_data []byte) (out_value int64, err error) {
+func (db *Database) RegisterLocalNodeToMasterContext(ctx context.Context, in_url string, in_data []byte) (int64, error) {
+	return registerLocalNodeToMaster(ctx, db.dbconnect, in_url, in_data)
+}
 
-	defer func() {
+// Read the clockid of the database
+//
+// Package Export
+func (db *Database) GetMyClockID() (int64, error) {
+	return db.GetMyClockIDContext(context.Background())
+}
 
-		if r := recover(); r != nil {
-			// recover from panic
-			err = errors.New("error while register node")
+// Read the clockid of the database
+//
+// Package Export
+func (db *Database) GetMyClockIDContext(ctx context.Context) (int64, error) {
+	return getMyClockID(ctx, db.dbconnect)
+}
 
-		}
+// List the registered nodes
+//
+// Package Export
+func (db *Database) ListNodes() (Things, error) {
+	return db.ListNodesContext(context.Background())
+}
 
-	}()
+// List the registered nodes
+//
+// Package Export
+func (db *Database) ListNodesContext(ctx context.Context) (Things, error) {
+	return listThings(db.withLogger(ctx), db.dbconnect, systemsTable)
+}
 
-	out_value = registerLocalNodeToMaster(db.dbconnect, in_url, in_data)
+// Get the node registered with a clockid
+//
+// Package Export
+func (db *Database) GetNode(in_clockid int64) (Thing, error) {
+	return db.GetNodeContext(context.Background(), in_clockid)
+}
 
-	return out_value, err
+// Get the node registered with a clockid
+//
+// Package Export
+func (db *Database) GetNodeContext(ctx context.Context, in_clockid int64) (Thing, error) {
+	return getNode(db.withLogger(ctx), db.dbconnect, in_clockid)
 }
 
-// Intial Registration
+// Update the data of a registered node
 //
 // Package Export
-func (db *Database) GetMyClockID() (out_value int64, err error) {
+func (db *Database) UpdateNode(in_clockid int64, in_data []byte) (Thing, error) {
+	return db.UpdateNodeContext(context.Background(), in_clockid, in_data)
+}
 
-	defer func() {
+// Update the data of a registered node
+//
+// Package Export
+func (db *Database) UpdateNodeContext(ctx context.Context, in_clockid int64, in_data []byte) (Thing, error) {
+	var t Thing
 
-		if r := recover(); r != nil {
-			// recover from panic
-			err = errors.New("error while register node")
+	key, err := db.signingKey(db.withLogger(ctx))
+	if err != nil {
+		return t, err
+	}
 
-		}
+	err = inTx(ctx, db.dbconnect, "update node", func(tx *sql.Tx) (err error) {
+		t, err = updateNode(db.withLogger(ctx), tx, key, in_clockid, in_data)
+		return err
+	})
+	return t, err
+}
 
-	}()
+// Remove the registration of a node
+//
+// Package Export
+func (db *Database) DeleteNode(in_clockid int64) error {
+	return db.DeleteNodeContext(context.Background(), in_clockid)
+}
 
-	out_value = getMyClockID(db.dbconnect)
+// Remove the registration of a node
+//
+// Package Export
+func (db *Database) DeleteNodeContext(ctx context.Context, in_clockid int64) error {
+
+	key, err := db.signingKey(db.withLogger(ctx))
+	if err != nil {
+		return err
+	}
 
-	return out_value, err
+	return inTx(ctx, db.dbconnect, "delete node", func(tx *sql.Tx) error {
+		return deleteNode(db.withLogger(ctx), tx, key, in_clockid)
+	})
 }
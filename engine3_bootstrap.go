@@ -0,0 +1,245 @@
+// ENGINE BOOTSTRAP
+//
+// Package for manage power engine data
+// Snapshot bootstrap
+//
+// A new node is filled from a consistent snapshot of the managed tables
+// of the master instead of replaying its oplog from the start; the
+// incremental sync takes over from the high water marks of the snapshot.
+package engine3
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+)
+
+/*
+ * copy every tombstone and version of a table in the snapshot into tx
+ *
+ * what the master had seen is read from the snapshot as well, not from
+ * the live database, which may have moved on since. A local version,
+ * which the master had seen, but which is in the snapshot neither as a
+ * version nor as a tombstone, was deleted on the master and its tombstone
+ * collected: it is deleted here as well. Local versions the master has
+ * not seen yet are kept.
+ */
+func bootstrapTable(ctx context.Context, snapshot *sql.Tx, tx *sql.Tx, policy syncPolicy,
+	table string, stats *SyncStats) error {
+
+	// the tombstones first: a url deleted and written again on the master
+	// is in the snapshot with its tombstone, which is older
+	tombstones, err := listTombstones(ctx, snapshot, table)
+	if err != nil {
+		return err
+	}
+	for _, ts := range tombstones {
+		if err := applyTombstone(ctx, tx, policy, ts, stats); err != nil {
+			return err
+		}
+	}
+
+	things, err := listThings(ctx, snapshot, table)
+	if err != nil {
+		return err
+	}
+	inSnapshot := map[string]bool{}
+	for _, t := range things {
+		if err := applyThing(ctx, snapshot, tx, policy, table, t, stats); err != nil {
+			return err
+		}
+		inSnapshot[t.URL] = true
+	}
+
+	local, err := listThings(ctx, tx, table)
+	if err != nil {
+		return err
+	}
+	stale := 0
+	for _, t := range local {
+		if inSnapshot[t.URL] {
+			continue
+		}
+		seen, err := checkHigh(ctx, snapshot, t.ClockID)
+		if err != nil {
+			return err
+		}
+		if seen < t.TSN {
+			continue
+		}
+		found, err := deleteThingIf(ctx, tx, policy.key, table, t.URL, t.ClockID, t.TSN)
+		if err != nil {
+			return err
+		}
+		if found {
+			stats.Deleted++
+			stale++
+		}
+	}
+
+	logger(ctx).Debug("bootstrapped table", "table", table, "rows", len(things), "tombstones", len(tombstones),
+		"stale", stale)
+	return nil
+}
+
+/*
+ * load a snapshot of dbconnect1 into dbconnect2
+ *
+ * the snapshot is read in one repeatable read transaction: the managed
+ * tables (nodes.systems first, it holds the keys to check the signatures
+ * with), the high water marks and the chain heads. It is written in one
+ * transaction as well, so that the high water marks never run ahead of
+ * the data.
+ */
+func bootstrapSnapshot(ctx context.Context, dbconnect1 *sql.DB, dbconnect2 *sql.DB, policy syncPolicy) (SyncStats, error) {
+	var stats SyncStats
+
+	snapshot, err := dbconnect1.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return stats, wrapErr("begin snapshot", err)
+	}
+	defer snapshot.Rollback()
+
+	tables, err := getManagedTables(ctx, snapshot)
+	if err != nil {
+		return stats, err
+	}
+	sort.SliceStable(tables, func(i, j int) bool { return tables[i] == systemsTable && tables[j] != systemsTable })
+
+	hwms, err := getRemoteHighs(ctx, snapshot)
+	if err != nil {
+		return stats, err
+	}
+	// the clocks are locked in this order
+	sort.Slice(hwms, func(i, j int) bool { return hwms[i].ClockID < hwms[j].ClockID })
+
+	peer, err := getMyClockID(ctx, snapshot)
+	registered := err == nil
+	if err != nil && !errors.Is(err, ErrNotRegistered) {
+		return stats, err
+	}
+	var heads []chainHead
+	if registered {
+		if heads, err = getChainHeads(ctx, snapshot); err != nil {
+			return stats, err
+		}
+	}
+
+	err = inTx(ctx, dbconnect2, "bootstrap", func(tx *sql.Tx) error {
+
+		// no sync replays the clocks until the snapshot is in
+		for _, hwm := range hwms {
+			if err := lockClock(ctx, tx, hwm.ClockID); err != nil {
+				return err
+			}
+		}
+
+		managed, err := getManagedTables(ctx, tx)
+		if err != nil {
+			return err
+		}
+		exists := map[string]bool{}
+		for _, name := range managed {
+			exists[name] = true
+		}
+
+		for _, table := range tables {
+			if !exists[table] {
+				if err := createManagedTable(ctx, tx, table); err != nil {
+					return err
+				}
+			}
+			if err := bootstrapTable(ctx, snapshot, tx, policy, table, &stats); err != nil {
+				return err
+			}
+		}
+
+		// the high water marks after the tables are in: the deletes of
+		// stale versions moved the one of the local clock beyond the
+		// snapshot
+		for _, hwm := range hwms {
+			high, err := checkHigh(ctx, tx, hwm.ClockID)
+			if err != nil {
+				return err
+			}
+			if hwm.TSN > high {
+				high = hwm.TSN
+			}
+			if err := putRemoteHigh(ctx, tx, hwm.ClockID, high); err != nil {
+				return err
+			}
+		}
+
+		// what the master has seen and its chain heads, like after a sync
+		if registered {
+			for _, hwm := range hwms {
+				if err := putPeerHigh(ctx, tx, peer, hwm.ClockID, hwm.TSN); err != nil {
+					return err
+				}
+			}
+			for _, h := range heads {
+				if err := putPeerChainHead(ctx, tx, peer, h); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	logger(ctx).Info("bootstrapped", "tables", len(tables), "applied", stats.Applied, "conflicts", stats.Conflicts,
+		"rejected", stats.Rejected)
+	return stats, nil
+}
+
+//
+// PACKAGE EXPORTS
+
+// Fill this database from a snapshot of the master
+//
+// For a newly registered node: the managed tables of the master are
+// copied from one consistent snapshot, with the matching high water
+// marks, then the changes since the snapshot are pulled with SyncFrom.
+// A node, which got ErrResyncRequired, catches up the same way: the
+// versions deleted on the master while it was behind are deleted as
+// well, local versions the master has not seen yet are kept.
+//
+// Package Export
+func (db *Database) BootstrapFrom(master *Database) (SyncStats, error) {
+	return db.BootstrapFromContext(context.Background(), master)
+}
+
+// Fill this database from a snapshot of the master
+//
+// Package Export
+func (db *Database) BootstrapFromContext(ctx context.Context, master *Database) (SyncStats, error) {
+
+	ctx = db.withLogger(ctx)
+
+	// local writes during the bootstrap are logged with the local clockid
+	if _, err := getMyClockID(ctx, db.dbconnect); err != nil {
+		return SyncStats{}, err
+	}
+
+	policy, err := db.syncPolicy(ctx)
+	if err != nil {
+		return SyncStats{}, err
+	}
+
+	stats, err := bootstrapSnapshot(ctx, master.dbconnect, db.dbconnect, policy)
+	if err != nil {
+		return stats, err
+	}
+
+	more, err := databaseSync(ctx, master.dbconnect, db.dbconnect, policy)
+	stats.Applied += more.Applied
+	stats.Deleted += more.Deleted
+	stats.Skipped += more.Skipped
+	stats.Conflicts += more.Conflicts
+	stats.Rejected += more.Rejected
+
+	return stats, err
+}
@@ -0,0 +1,305 @@
+// ENGINE OPLOG CHAIN
+//
+// Package for manage power engine data
+// Tamper evidence of the oplog
+//
+// The oplog entries of every clock are chained by their hashes (see
+// migrations/010_oplog_chain.sql). VerifyOplogChain walks the chain of a
+// clock from its first entry; sync remembers the chain heads of a peer
+// and refuses the peer, once it no longer has them.
+package engine3
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// The first break in the oplog chain of a clock
+type ChainBreak struct {
+	ClockID int64  `json:"clockid"`
+	TSN     int64  `json:"tsn"`    // the entry where the chain breaks
+	Reason  string `json:"reason"` // "hash", "fork", "link" or "head"
+}
+
+func (b *ChainBreak) String() string {
+	return fmt.Sprintf("oplog chain of clock %d breaks at tsn %d (%s)", b.ClockID, b.TSN, b.Reason)
+}
+
+// an entry of the oplog chain
+type chainEntry struct {
+	tsn   int64
+	table string
+	op    string
+	prev  []byte
+	hash  []byte
+	valid bool // hash matches the entry
+}
+
+// the last entry of a chain
+type chainHead struct {
+	clockid int64
+	tsn     int64
+	hash    []byte
+}
+
+/*
+ * find the first break in a chain
+ *
+ * the entries are walked from the one without predecessor along the
+ * links. An entry with a wrong hash breaks the chain ("hash"), so do two
+ * entries with the same predecessor ("fork"), an entry not reached
+ * ("link") and a last entry, which is not the recorded head ("head").
+ *
+ * the chain of a compacted clock is walked from the link of its
+ * checkpoint; the entries not reached are left from the compaction and
+ * only checked one by one.
+ */
+func chainBreak(clockid int64, entries []chainEntry, checkpoint *oplogCheckpoint, head *chainHead) *ChainBreak {
+
+	next := map[string][]chainEntry{}
+	for _, e := range entries {
+		next[string(e.prev)] = append(next[string(e.prev)], e)
+	}
+
+	reached := map[int64]bool{}
+	var last *chainEntry
+
+	link := ""
+	if checkpoint != nil {
+		link = string(checkpoint.link)
+	}
+	for {
+		candidates := next[link]
+		if len(candidates) == 0 {
+			break
+		}
+		if len(candidates) > 1 {
+			return &ChainBreak{ClockID: clockid, TSN: candidates[1].tsn, Reason: "fork"}
+		}
+
+		e := candidates[0]
+		if !e.valid {
+			return &ChainBreak{ClockID: clockid, TSN: e.tsn, Reason: "hash"}
+		}
+		if reached[e.tsn] {
+			// a loop of links
+			return &ChainBreak{ClockID: clockid, TSN: e.tsn, Reason: "link"}
+		}
+
+		reached[e.tsn] = true
+		last = &e
+		link = string(e.hash)
+	}
+
+	// entries are in tsn order: the first one not reached
+	for _, e := range entries {
+		switch {
+		case reached[e.tsn]:
+		case checkpoint == nil:
+			return &ChainBreak{ClockID: clockid, TSN: e.tsn, Reason: "link"}
+		case !e.valid:
+			return &ChainBreak{ClockID: clockid, TSN: e.tsn, Reason: "hash"}
+		}
+	}
+
+	if head != nil && (last == nil || last.tsn != head.tsn || !bytes.Equal(last.hash, head.hash)) {
+		return &ChainBreak{ClockID: clockid, TSN: head.tsn, Reason: "head"}
+	}
+
+	return nil
+}
+
+// Calling database stored functions
+
+// read the chain of a clock in tsn order
+func getOplogChain(ctx context.Context, q querier, in_clockid int64) ([]chainEntry, error) {
+	var result []chainEntry
+
+	rows, err := q.QueryContext(ctx, "select * from nodes.getOplogChain( $1 )", in_clockid)
+	if err != nil {
+		return nil, wrapErr("nodes.getOplogChain", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e chainEntry
+
+		if err := rows.Scan(&e.tsn, &e.table, &e.op, &e.prev, &e.hash, &e.valid); err != nil {
+			return nil, wrapErr("scan oplog chain", err)
+		}
+		result = append(result, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("end reading oplog chain loop", err)
+	}
+
+	return result, nil
+}
+
+// read chain heads from a query returning clockid, tsn and hash
+func queryChainHeads(ctx context.Context, q querier, op string, query string, args ...interface{}) ([]chainHead, error) {
+	var result []chainHead
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapErr(op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h chainHead
+
+		if err := rows.Scan(&h.clockid, &h.tsn, &h.hash); err != nil {
+			return nil, wrapErr("scan chain head", err)
+		}
+		result = append(result, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("end reading chain heads loop", err)
+	}
+
+	return result, nil
+}
+
+// the chain heads of all clocks
+func getChainHeads(ctx context.Context, q querier) ([]chainHead, error) {
+	return queryChainHeads(ctx, q, "nodes.getChainHeads", "select * from nodes.getChainHeads()")
+}
+
+// the chain heads of a peer, as seen at the last sync
+func getPeerChainHeads(ctx context.Context, q querier, in_peer int64) ([]chainHead, error) {
+	return queryChainHeads(ctx, q, "nodes.getPeerChainHeads", "select * from nodes.getPeerChainHeads( $1 )", in_peer)
+}
+
+// the hash of an oplog entry, nil if there is none
+func getChainHash(ctx context.Context, q querier, in_clockid int64, in_tsn int64) ([]byte, error) {
+
+	var hash []byte
+
+	row := q.QueryRowContext(ctx, "select nodes.getChainHash( $1, $2 )", in_clockid, in_tsn)
+	checkRow(row)
+
+	err := row.Scan(&hash)
+
+	return hash, wrapErr("nodes.getChainHash", err)
+}
+
+// remember a chain head of a peer
+func putPeerChainHead(ctx context.Context, q querier, in_peer int64, h chainHead) error {
+
+	_, err := q.ExecContext(ctx, "select nodes.putPeerChainHead( $1, $2, $3, $4 )", in_peer, h.clockid, h.tsn, h.hash)
+
+	return wrapErr("nodes.putPeerChainHead", err)
+}
+
+// find the first break in the oplog chain of a clock (nil if intact)
+func verifyOplogChain(ctx context.Context, q querier, in_clockid int64) (*ChainBreak, error) {
+	var head *chainHead
+
+	entries, err := getOplogChain(ctx, q, in_clockid)
+	if err != nil {
+		return nil, err
+	}
+
+	heads, err := getChainHeads(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	for i := range heads {
+		if heads[i].clockid == in_clockid {
+			head = &heads[i]
+		}
+	}
+
+	checkpoints, err := getOplogCheckpoints(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	var checkpoint *oplogCheckpoint
+	if cp, ok := checkpoints[in_clockid]; ok {
+		checkpoint = &cp
+	}
+
+	b := chainBreak(in_clockid, entries, checkpoint, head)
+	if b != nil {
+		logger(ctx).Warn("oplog chain broken", "clockid", in_clockid, "tsn", b.TSN, "reason", b.Reason)
+	} else {
+		logger(ctx).Debug("oplog chain verified", "clockid", in_clockid, "entries", len(entries))
+	}
+
+	return b, nil
+}
+
+/*
+ * check, that the oplog of the peer dbconnect1 still has the chain heads
+ * dbconnect2 saw at the last sync
+ *
+ * a rewritten history changes the hashes from the first rewritten entry
+ * on, a removed one loses the entries. Entries removed by compaction
+ * cannot be checked anymore: a head is taken as compacted only under a
+ * checkpoint signed by the peer with the key registered in dbconnect2,
+ * an unsigned checkpoint of a peer without key only if not strict.
+ */
+func checkPeerChains(ctx context.Context, dbconnect1 *sql.DB, dbconnect2 *sql.DB, in_peer int64, strict bool) error {
+
+	heads, err := getPeerChainHeads(ctx, dbconnect2, in_peer)
+	if err != nil {
+		return err
+	}
+
+	checkpoints, err := getOplogCheckpoints(ctx, dbconnect1)
+	if err != nil {
+		return err
+	}
+
+	key, err := publicKey(ctx, dbconnect2, in_peer)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range heads {
+		hash, err := getChainHash(ctx, dbconnect1, h.clockid, h.tsn)
+		if err != nil {
+			return err
+		}
+		if cp, ok := checkpoints[h.clockid]; ok && hash == nil && h.tsn <= cp.tsn {
+			s := checkCheckpoint(key, in_peer, h.clockid, cp)
+			if s == sigValid || s == sigNone && !strict {
+				logger(ctx).Debug("chain head compacted", "peer", in_peer, "clockid", h.clockid, "tsn", h.tsn)
+				continue
+			}
+			logger(ctx).Error("oplog checkpoint not trusted", "peer", in_peer, "clockid", h.clockid, "tsn", h.tsn,
+				"signature", s)
+			return fmt.Errorf("%w: peer %d, clock %d at tsn %d, checkpoint signature %s", ErrHistoryRewritten,
+				in_peer, h.clockid, h.tsn, s)
+		}
+		if !bytes.Equal(hash, h.hash) {
+			logger(ctx).Error("oplog history rewritten", "peer", in_peer, "clockid", h.clockid, "tsn", h.tsn)
+			return fmt.Errorf("%w: peer %d, clock %d at tsn %d", ErrHistoryRewritten, in_peer, h.clockid, h.tsn)
+		}
+	}
+
+	return nil
+}
+
+//
+// PACKAGE EXPORTS
+
+// Find the first break in the oplog chain of a clock
+//
+// Returns nil, if every entry of the clock is linked to the one before
+// and the last one is the recorded head.
+//
+// Package Export
+func (db *Database) VerifyOplogChain(in_clockid int64) (*ChainBreak, error) {
+	return db.VerifyOplogChainContext(context.Background(), in_clockid)
+}
+
+// Find the first break in the oplog chain of a clock
+//
+// Package Export
+func (db *Database) VerifyOplogChainContext(ctx context.Context, in_clockid int64) (*ChainBreak, error) {
+	return verifyOplogChain(db.withLogger(ctx), db.dbconnect, in_clockid)
+}
@@ -0,0 +1,271 @@
+// ENGINE OPLOG COMPACTION
+//
+// Package for manage power engine data
+// Oplog compaction and retention
+//
+// Compaction removes the oplog entries, which are not the latest
+// operation on their url, once every peer has passed them. The retention
+// limits age and size of the oplog regardless of the peers; a peer left
+// behind by it has to resync (see migrations/013_oplog_compaction.sql).
+package engine3
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Limits of the oplog, zero: no limit
+type OplogRetention struct {
+	MaxAge  time.Duration `json:"max_age"`  // entries older are removed
+	MaxRows int64         `json:"max_rows"` // the oldest entries above are removed
+}
+
+// The entries removed by CompactOplog
+type CompactionReport struct {
+	Superseded int64 `json:"superseded"` // not the latest operation, passed by every peer
+	Expired    int64 `json:"expired"`    // older than MaxAge
+	Trimmed    int64 `json:"trimmed"`    // above MaxRows
+}
+
+// The number of entries removed
+func (r CompactionReport) Removed() int64 {
+	return r.Superseded + r.Expired + r.Trimmed
+}
+
+// the compacted part of the chain of a clock
+type oplogCheckpoint struct {
+	tsn    int64  // the last tsn removed
+	link   []byte // prev of the intact tail of the chain
+	resync int64  // the last tsn removed by the retention
+	sig    []byte // of the node, which compacted its oplog
+}
+
+/* the signed message of a checkpoint
+ *
+ * a tag, which no version message starts with, then the clockid of the
+ * node, the clock, tsn, resync tsn and the length-prefixed link
+ */
+func checkpointMessage(signer int64, clockid int64, cp oplogCheckpoint) []byte {
+
+	msg := make([]byte, 0, 24+32+4+len(cp.link))
+	msg = append(msg, "engine3 oplog checkpoint"...)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(signer))
+	msg = binary.BigEndian.AppendUint64(msg, uint64(clockid))
+	msg = binary.BigEndian.AppendUint64(msg, uint64(cp.tsn))
+	msg = binary.BigEndian.AppendUint64(msg, uint64(cp.resync))
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(cp.link)))
+	msg = append(msg, cp.link...)
+
+	return msg
+}
+
+// check the signature of a checkpoint against the key of the node, which
+// compacted (nil for none)
+func checkCheckpoint(key ed25519.PublicKey, signer int64, clockid int64, cp oplogCheckpoint) signature {
+
+	switch {
+	case key == nil && len(cp.sig) == 0:
+		return sigNone
+	case key == nil:
+		return sigUnknown
+	case len(cp.sig) == 0:
+		return sigMissing
+	case !ed25519.Verify(key, checkpointMessage(signer, clockid, cp), cp.sig):
+		return sigInvalid
+	}
+	return sigValid
+}
+
+// Calling database stored functions
+
+// compact the oplog and apply the retention
+func compactOplog(ctx context.Context, q querier, r OplogRetention) (CompactionReport, error) {
+	var (
+		report  CompactionReport
+		maxAge  interface{}
+		maxRows interface{}
+	)
+
+	if r.MaxAge > 0 {
+		maxAge = r.MaxAge.Seconds()
+	}
+	if r.MaxRows > 0 {
+		maxRows = r.MaxRows
+	}
+
+	row := q.QueryRowContext(ctx, "select * from nodes.compact_oplog( make_interval( secs => $1 ), $2 )", maxAge, maxRows)
+	checkRow(row)
+
+	err := row.Scan(&report.Superseded, &report.Expired, &report.Trimmed)
+	if err == nil {
+		logger(ctx).Info("compacted oplog", "superseded", report.Superseded, "expired", report.Expired,
+			"trimmed", report.Trimmed, "max_age", r.MaxAge, "max_rows", r.MaxRows)
+	}
+
+	return report, wrapErr("nodes.compact_oplog", err)
+}
+
+// the compacted part of the chain of every compacted clock
+func getOplogCheckpoints(ctx context.Context, q querier) (map[int64]oplogCheckpoint, error) {
+
+	result := map[int64]oplogCheckpoint{}
+
+	rows, err := q.QueryContext(ctx, "select * from nodes.getOplogCheckpoints()")
+	if err != nil {
+		return nil, wrapErr("nodes.getOplogCheckpoints", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			clockid int64
+			cp      oplogCheckpoint
+		)
+
+		if err := rows.Scan(&clockid, &cp.tsn, &cp.link, &cp.resync, &cp.sig); err != nil {
+			return nil, wrapErr("scan oplog checkpoint", err)
+		}
+		result[clockid] = cp
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("end reading oplog checkpoints loop", err)
+	}
+
+	return result, nil
+}
+
+// add the signature of the checkpoint of a clock
+func signOplogCheckpoint(ctx context.Context, q querier, in_clockid int64, in_sig []byte) error {
+
+	_, err := q.ExecContext(ctx, "select nodes.sign_oplog_checkpoint( $1, $2 )", in_clockid, in_sig)
+
+	return wrapErr("nodes.sign_oplog_checkpoint", err)
+}
+
+/*
+ * sign the checkpoints, which are not signed yet: the ones a compaction
+ * changed and the ones from before migration 20
+ *
+ * nothing is signed without a key
+ */
+func signOplogCheckpoints(ctx context.Context, q querier, key ed25519.PrivateKey) error {
+
+	if key == nil {
+		return nil
+	}
+
+	myclockid, err := getMyClockID(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	checkpoints, err := getOplogCheckpoints(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	for clockid, cp := range checkpoints {
+		if len(cp.sig) > 0 {
+			continue
+		}
+		sig := ed25519.Sign(key, checkpointMessage(myclockid, clockid, cp))
+		if err := signOplogCheckpoint(ctx, q, clockid, sig); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * check, that dbconnect2 can catch up with the oplog of dbconnect1: it has
+ * to have seen every entry the retention removed
+ */
+func checkRetention(ctx context.Context, dbconnect1 querier, dbconnect2 querier, hwms HighWaterMarks) error {
+
+	checkpoints, err := getOplogCheckpoints(ctx, dbconnect1)
+	if err != nil {
+		return err
+	}
+
+	for _, hwm := range hwms {
+		cp, ok := checkpoints[hwm.ClockID]
+		if !ok || cp.resync == 0 {
+			continue
+		}
+
+		high, err := checkHigh(ctx, dbconnect2, hwm.ClockID)
+		if err != nil {
+			return err
+		}
+		if high < cp.resync {
+			logger(ctx).Error("behind the oplog retention", "clockid", hwm.ClockID, "tsn", high, "retained_after", cp.resync)
+			return fmt.Errorf("%w: clock %d at tsn %d, oplog retained after tsn %d", ErrResyncRequired, hwm.ClockID, high, cp.resync)
+		}
+	}
+
+	return nil
+}
+
+//
+// PACKAGE EXPORTS
+
+// Set the limits of the oplog for CompactOplog
+//
+// The zero OplogRetention (the default) keeps every entry, which is the
+// latest operation on its url or not passed by every peer.
+//
+// Package Export
+func (db *Database) SetOplogRetention(r OplogRetention) {
+	db.oplogRetention.Store(&r)
+}
+
+// the oplog retention of the database
+func (db *Database) getOplogRetention() OplogRetention {
+
+	if r := db.oplogRetention.Load(); r != nil {
+		return *r
+	}
+	return OplogRetention{}
+}
+
+// Remove the oplog entries, which are superseded and passed by every
+// peer, and the entries beyond the retention
+//
+// A peer, which has not seen the entries removed by the retention, gets
+// ErrResyncRequired from its next sync. The checkpoints of the compacted
+// chains are signed with the key of the node; a peer trusts a checkpoint
+// only with a valid signature, if it knows the key of the node.
+//
+// Package Export
+func (db *Database) CompactOplog() (CompactionReport, error) {
+	return db.CompactOplogContext(context.Background())
+}
+
+// Remove the oplog entries, which are superseded and passed by every
+// peer, and the entries beyond the retention
+//
+// Package Export
+func (db *Database) CompactOplogContext(ctx context.Context) (CompactionReport, error) {
+	var report CompactionReport
+
+	ctx = db.withLogger(ctx)
+
+	key, err := db.signingKey(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	err = inTx(ctx, db.dbconnect, "compact oplog", func(tx *sql.Tx) (err error) {
+		if report, err = compactOplog(ctx, tx, db.getOplogRetention()); err != nil {
+			return err
+		}
+		return signOplogCheckpoints(ctx, tx, key)
+	})
+
+	return report, err
+}
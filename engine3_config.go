@@ -0,0 +1,299 @@
+// ENGINE CONFIGURATION
+//
+// Package for manage power engine data
+// Configuration of database connections
+//
+// A Config can be built in code, read from the environment or loaded
+// from a JSON or TOML file. Passwords are never part of the Config
+// itself, they are read from a password file when a connection is
+// opened, and connection strings are redacted before they are logged.
+// The private signing keys are kept in files of their own (KeyDir).
+package engine3
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Connection settings
+//
+// Zero values are left to the driver defaults (and the PG* environment
+// variables of libpq).
+type Config struct {
+	Host         string `json:"host,omitempty"`
+	Port         int    `json:"port,omitempty"`
+	User         string `json:"user,omitempty"`
+	PasswordFile string `json:"password_file,omitempty"`
+	SSLMode      string `json:"sslmode,omitempty"`
+
+	// database name, if it differs from the name used in the process
+	DBName string `json:"dbname,omitempty"`
+
+	// connection pool
+	MaxOpenConns int `json:"max_open_conns,omitempty"`
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+
+	// directory of the private signing keys, one <database>.key file per
+	// database; "": engine3 in the user config directory
+	KeyDir string `json:"key_dir,omitempty"`
+
+	// per-database overrides, zero values inherit from the Config
+	Databases map[string]Config `json:"databases,omitempty"`
+}
+
+// Read a Config from the environment
+//
+//	ENGINE_DB_HOST, ENGINE_DB_PORT, ENGINE_DB_USER, ENGINE_DB_PASSWORD_FILE,
+//	ENGINE_DB_SSLMODE, ENGINE_DB_MAX_OPEN_CONNS, ENGINE_DB_MAX_IDLE_CONNS,
+//	ENGINE_KEY_DIR
+func ConfigFromEnv() (Config, error) {
+	var (
+		cfg Config
+		err error
+	)
+
+	cfg.Host = os.Getenv("ENGINE_DB_HOST")
+	cfg.User = os.Getenv("ENGINE_DB_USER")
+	cfg.PasswordFile = os.Getenv("ENGINE_DB_PASSWORD_FILE")
+	cfg.SSLMode = os.Getenv("ENGINE_DB_SSLMODE")
+	cfg.KeyDir = os.Getenv("ENGINE_KEY_DIR")
+
+	for _, v := range []struct {
+		name  string
+		value *int
+	}{
+		{"ENGINE_DB_PORT", &cfg.Port},
+		{"ENGINE_DB_MAX_OPEN_CONNS", &cfg.MaxOpenConns},
+		{"ENGINE_DB_MAX_IDLE_CONNS", &cfg.MaxIdleConns},
+	} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		if *v.value, err = strconv.Atoi(s); err != nil {
+			return cfg, fmt.Errorf("engine3: %s: %w", v.name, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Load a Config from a file
+//
+// The format is chosen by the extension: .json or .toml. For TOML the
+// flat subset is understood: key = value pairs with strings and integers,
+// and [databases.<name>] tables for the overrides.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("engine3: load config: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".toml":
+		values, err := parseTOML(string(text))
+		if err != nil {
+			return cfg, fmt.Errorf("engine3: load config %s: %w", path, err)
+		}
+		if text, err = json.Marshal(values); err != nil {
+			return cfg, fmt.Errorf("engine3: load config %s: %w", path, err)
+		}
+	default:
+		return cfg, fmt.Errorf("engine3: load config %s: unknown format", path)
+	}
+
+	if err := json.Unmarshal(text, &cfg); err != nil {
+		return cfg, fmt.Errorf("engine3: load config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// parse the flat TOML subset into nested maps
+func parseTOML(text string) (map[string]interface{}, error) {
+
+	root := map[string]interface{}{}
+	table := root
+
+	for n, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			// [a.b] : nested tables
+			table = root
+			for _, key := range strings.Split(strings.Trim(line, "[]"), ".") {
+				key = strings.Trim(strings.TrimSpace(key), `"`)
+				next, ok := table[key].(map[string]interface{})
+				if !ok {
+					next = map[string]interface{}{}
+					table[key] = next
+				}
+				table = next
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n+1)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			table[key], _ = strconv.Unquote(quoted)
+		} else {
+			// drop a trailing comment
+			value, _, _ = strings.Cut(value, "#")
+			i, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			table[key] = i
+		}
+	}
+
+	return root, nil
+}
+
+// the Config for one database, with its overrides applied
+func (cfg Config) forDatabase(name string) Config {
+
+	result := cfg
+	result.Databases = nil
+	result.DBName = name
+
+	o, ok := cfg.Databases[name]
+	if !ok {
+		return result
+	}
+
+	if o.Host != "" {
+		result.Host = o.Host
+	}
+	if o.Port != 0 {
+		result.Port = o.Port
+	}
+	if o.User != "" {
+		result.User = o.User
+	}
+	if o.PasswordFile != "" {
+		result.PasswordFile = o.PasswordFile
+	}
+	if o.SSLMode != "" {
+		result.SSLMode = o.SSLMode
+	}
+	if o.DBName != "" {
+		result.DBName = o.DBName
+	}
+	if o.MaxOpenConns != 0 {
+		result.MaxOpenConns = o.MaxOpenConns
+	}
+	if o.MaxIdleConns != 0 {
+		result.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.KeyDir != "" {
+		result.KeyDir = o.KeyDir
+	}
+
+	return result
+}
+
+// the private key file of a database, "" if there is no place for it
+func (cfg Config) keyFile(name string) string {
+
+	dir := cfg.forDatabase(name).KeyDir
+	if dir == "" {
+		config, err := os.UserConfigDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(config, "engine3")
+	}
+
+	return filepath.Join(dir, name+".key")
+}
+
+// quote a value of a connection string
+func dsnQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// the connection string of a database (with the password)
+func (cfg Config) dsn(name string) (string, error) {
+	var parts []string
+
+	c := cfg.forDatabase(name)
+
+	add := func(key, value string) {
+		if value != "" {
+			parts = append(parts, key+"="+dsnQuote(value))
+		}
+	}
+
+	add("host", c.Host)
+	if c.Port != 0 {
+		add("port", strconv.Itoa(c.Port))
+	}
+	add("user", c.User)
+	add("dbname", c.DBName)
+	add("sslmode", c.SSLMode)
+
+	if c.PasswordFile != "" {
+		password, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			// the error names the file, never its content
+			return "", fmt.Errorf("engine3: password file of %s: %w", name, err)
+		}
+		add("password", strings.TrimRight(string(password), "\r\n"))
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// Printable form of the Config (without secrets)
+func (cfg Config) String() string {
+	var names []string
+
+	for name := range cfg.Databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return fmt.Sprintf("host=%q port=%d user=%q sslmode=%q dbname=%q pool=%d/%d key_dir=%q databases=%v",
+		cfg.Host, cfg.Port, cfg.User, cfg.SSLMode, cfg.DBName, cfg.MaxOpenConns, cfg.MaxIdleConns, cfg.KeyDir, names)
+}
+
+// password values in key=value and URL connection strings
+var dsnSecret = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)|(://[^:/@]*:)[^@]*@`)
+
+// remove secrets from a connection string before it is logged
+func redactDSN(dsn string) string {
+	return dsnSecret.ReplaceAllStringFunc(dsn, func(m string) string {
+		if strings.HasPrefix(m, "://") {
+			user := strings.Index(m[3:], ":") + 3
+			return m[:user+1] + "xxxxx@"
+		}
+		key, _, _ := strings.Cut(m, "=")
+		return key + "=xxxxx"
+	})
+}
@@ -0,0 +1,298 @@
+// ENGINE CONFLICTS
+//
+// Package for manage power engine data
+// Conflict resolution
+//
+// Two nodes can change the same url without seeing each other's version.
+// Sync hands both versions to a ConflictResolver of the local Database
+// and records the decision in nodes.conflicts.
+package engine3
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// the version, which survives a conflict
+type Outcome string
+
+const (
+	KeepLocal  Outcome = "local"  // the local version stays
+	TakeRemote Outcome = "remote" // the remote version replaces it
+	Merged     Outcome = "merged" // a merged document becomes a new local version
+)
+
+// the decision of a ConflictResolver
+type Resolution struct {
+	Outcome Outcome
+	Data    json.RawMessage // the merged document (Merged only)
+}
+
+// decides between two versions of the same url
+type ConflictResolver interface {
+	// name of the policy, recorded with every conflict
+	Name() string
+
+	Resolve(ctx context.Context, table string, local Thing, remote Thing) (Resolution, error)
+}
+
+// a recorded conflict
+type Conflict struct {
+	ID         int64           `json:"id"`
+	Table      string          `json:"table"`
+	URL        string          `json:"url"`
+	Local      Thing           `json:"local"`  // ClockID, TSN and Data
+	Remote     Thing           `json:"remote"` // ClockID, TSN and Data
+	Policy     string          `json:"policy"`
+	Outcome    Outcome         `json:"outcome"`
+	MergedData json.RawMessage `json:"merged_data,omitempty"`
+	Resolved   time.Time       `json:"resolved"`
+}
+
+// Last writer wins
+type lastWriterWins struct{}
+
+// Resolve conflicts for the version with the higher (tsn, clockid)
+//
+// Package Export
+func LastWriterWins() ConflictResolver {
+	return lastWriterWins{}
+}
+
+func (lastWriterWins) Name() string { return "last-writer-wins" }
+
+func (lastWriterWins) Resolve(ctx context.Context, table string, local Thing, remote Thing) (Resolution, error) {
+
+	if remote.TSN > local.TSN || (remote.TSN == local.TSN && remote.ClockID > local.ClockID) {
+		return Resolution{Outcome: TakeRemote}, nil
+	}
+	return Resolution{Outcome: KeepLocal}, nil
+}
+
+// Master wins
+type masterWins struct {
+	master int64
+}
+
+// Resolve conflicts for the version written by the master clock
+//
+// Conflicts between two other clocks fall back to LastWriterWins.
+//
+// Package Export
+func MasterWins(masterClockID int64) ConflictResolver {
+	return masterWins{master: masterClockID}
+}
+
+func (m masterWins) Name() string { return fmt.Sprintf("master-wins(%d)", m.master) }
+
+func (m masterWins) Resolve(ctx context.Context, table string, local Thing, remote Thing) (Resolution, error) {
+
+	switch m.master {
+	case remote.ClockID:
+		return Resolution{Outcome: TakeRemote}, nil
+	case local.ClockID:
+		return Resolution{Outcome: KeepLocal}, nil
+	}
+	return lastWriterWins{}.Resolve(ctx, table, local, remote)
+}
+
+// merges the JSON documents of two conflicting versions
+type MergeFunc func(ctx context.Context, table string, local json.RawMessage, remote json.RawMessage) (json.RawMessage, error)
+
+// Merge by callback
+type mergeWith struct {
+	name  string
+	merge MergeFunc
+}
+
+// Resolve conflicts with a merged document
+//
+// The merged document is written as a new local version, which then
+// replicates to the other nodes.
+//
+// Package Export
+func MergeWith(name string, merge MergeFunc) ConflictResolver {
+	return mergeWith{name: name, merge: merge}
+}
+
+func (m mergeWith) Name() string { return m.name }
+
+func (m mergeWith) Resolve(ctx context.Context, table string, local Thing, remote Thing) (Resolution, error) {
+
+	data, err := m.merge(ctx, table, local.Data, remote.Data)
+	if err != nil {
+		return Resolution{}, err
+	}
+	if !json.Valid(data) {
+		return Resolution{}, fmt.Errorf("engine3: merge %s: invalid JSON document", m.name)
+	}
+	return Resolution{Outcome: Merged, Data: data}, nil
+}
+
+// Calling database stored functions
+
+// overwrite the current version of a url with a version of another node
+func ae_replace(ctx context.Context, q querier, in_name string, t Thing) error {
+
+	_, err := q.ExecContext(ctx, "select nodes.ae_replace( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10 )",
+		in_name, t.CKey, t.CVal, t.URL, string(t.Data), t.ClockID, t.TSN, t.VV.param(), algParam(t.Alg), sigParam(t.Sig))
+
+	return wrapErr("nodes.ae_replace "+in_name, err)
+}
+
+// write a merged document as a new local version, derived from vv
+func thingMerge(ctx context.Context, q querier, key ed25519.PrivateKey, in_table string, in_url string, in_data []byte, vv VersionVector) (Thing, error) {
+
+	row := q.QueryRowContext(ctx, "select * from nodes.thing_merge( $1, $2, $3, $4 )",
+		in_table, in_url, string(in_data), vv.param())
+	checkRow(row)
+
+	t, _, err := rowToThing(row)
+	if err != nil {
+		return t, wrapErr("nodes.thing_merge "+in_table, err)
+	}
+
+	return t, signThing(ctx, q, key, in_table, &t)
+}
+
+// record a resolved conflict
+func putConflict(ctx context.Context, q querier, c Conflict) error {
+	var merged interface{}
+
+	if c.MergedData != nil {
+		merged = string(c.MergedData)
+	}
+
+	_, err := q.ExecContext(ctx, "select nodes.putConflict( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11 )",
+		c.Table, c.URL,
+		c.Local.ClockID, c.Local.TSN, string(c.Local.Data),
+		c.Remote.ClockID, c.Remote.TSN, string(c.Remote.Data),
+		c.Policy, string(c.Outcome), merged)
+
+	return wrapErr("nodes.putConflict", err)
+}
+
+// read the recorded conflicts after an id
+func getConflicts(ctx context.Context, q querier, in_after int64) ([]Conflict, error) {
+	var result []Conflict
+
+	rows, err := q.QueryContext(ctx, "select * from nodes.getConflicts( $1 )", in_after)
+	if err != nil {
+		return nil, wrapErr("nodes.getConflicts", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			c                     Conflict
+			local, remote, merged []byte
+			outcome               string
+		)
+
+		err := rows.Scan(&c.ID, &c.Table, &c.URL,
+			&c.Local.ClockID, &c.Local.TSN, &local,
+			&c.Remote.ClockID, &c.Remote.TSN, &remote,
+			&c.Policy, &outcome, &merged, &c.Resolved)
+		if err != nil {
+			return nil, wrapErr("scan conflict", err)
+		}
+
+		c.Local.URL, c.Remote.URL = c.URL, c.URL
+		c.Local.Data, c.Remote.Data = local, remote
+		c.Outcome = Outcome(outcome)
+		if merged != nil {
+			c.MergedData = merged
+		}
+
+		result = append(result, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("end reading conflicts loop", err)
+	}
+
+	return result, nil
+}
+
+/*
+ * resolve a conflict between the local version and a remote version
+ *
+ * the decision is applied and recorded in the same transaction
+ */
+func resolveConflict(ctx context.Context, tx *sql.Tx, policy syncPolicy, table string,
+	local Thing, remote Thing) error {
+
+	resolver := policy.resolver
+
+	res, err := resolver.Resolve(ctx, table, local, remote)
+	if err != nil {
+		return fmt.Errorf("engine3: resolve conflict %s/%s with %s: %w", table, remote.URL, resolver.Name(), err)
+	}
+
+	switch res.Outcome {
+	case KeepLocal:
+	case TakeRemote:
+		err = ae_replace(ctx, tx, table, remote)
+	case Merged:
+		// the merged version has seen both versions
+		_, err = thingMerge(ctx, tx, policy.key, table, remote.URL, res.Data, local.Version().Merge(remote.Version()))
+	default:
+		err = fmt.Errorf("engine3: resolver %s: unknown outcome %q", resolver.Name(), res.Outcome)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger(ctx).Info("conflict", "table", table, "url", remote.URL,
+		"clockid", remote.ClockID, "tsn", remote.TSN,
+		"local_clockid", local.ClockID, "local_tsn", local.TSN,
+		"policy", resolver.Name(), "outcome", res.Outcome)
+
+	return putConflict(ctx, tx, Conflict{
+		Table:      table,
+		URL:        remote.URL,
+		Local:      local,
+		Remote:     remote,
+		Policy:     resolver.Name(),
+		Outcome:    res.Outcome,
+		MergedData: res.Data,
+	})
+}
+
+//
+// PACKAGE EXPORTS
+
+// Set the ConflictResolver used when syncing into this database
+//
+// The default is LastWriterWins.
+//
+// Package Export
+func (db *Database) SetConflictResolver(r ConflictResolver) {
+	db.resolver.Store(&r)
+}
+
+// the ConflictResolver of the database
+func (db *Database) conflictResolver() ConflictResolver {
+
+	if r := db.resolver.Load(); r != nil && *r != nil {
+		return *r
+	}
+	return LastWriterWins()
+}
+
+// Read the recorded conflicts with an id greater than afterID
+//
+// Package Export
+func (db *Database) Conflicts(afterID int64) ([]Conflict, error) {
+	return db.ConflictsContext(context.Background(), afterID)
+}
+
+// Read the recorded conflicts with an id greater than afterID
+//
+// Package Export
+func (db *Database) ConflictsContext(ctx context.Context, afterID int64) ([]Conflict, error) {
+	return getConflicts(ctx, db.dbconnect, afterID)
+}
@@ -0,0 +1,129 @@
+// ENGINE OPLOG CURSOR
+//
+// Package for manage power engine data
+// Streaming the oplog
+//
+// An OplogCursor reads the oplog tail in pages, oldest first (see
+// migrations/012_oplog_cursor.sql). Its position can be saved as a token
+// and resumed later, by another process as well.
+package engine3
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// the entries of a page, if no batch size is given
+const DefaultOplogBatch = 1000
+
+// A position in the oplog tail, which reads it page by page
+type OplogCursor struct {
+	db      *Database
+	clockid int64 // 0: all clocks
+	tsn     int64 // position of the last entry read
+	after   int64 // its clockid
+	batch   int
+}
+
+// a cursor after tsn, on the tail of all clocks with clockid 0
+func newOplogCursor(db *Database, in_clockid int64, in_tsn int64, in_batch int) *OplogCursor {
+
+	c := &OplogCursor{db: db, clockid: in_clockid, tsn: in_tsn, after: in_clockid, batch: in_batch}
+	if in_clockid == 0 {
+		// every clock at tsn is read already
+		c.after = math.MaxInt64
+	}
+	if c.batch <= 0 {
+		c.batch = DefaultOplogBatch
+	}
+
+	return c
+}
+
+// Calling database stored functions
+
+// read the next page and move behind it
+func (c *OplogCursor) next(ctx context.Context, q querier) (Oplogs, error) {
+
+	rows, err := q.QueryContext(ctx, "select * from nodes.getOplogTail( $1, $2, $3, $4 )", c.clockid, c.tsn, c.after, c.batch)
+	if err != nil {
+		return nil, wrapErr("nodes.getOplogTail", err)
+	}
+	defer rows.Close()
+
+	oplogs, err := rowsToOplogs(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if n := len(oplogs); n > 0 {
+		c.tsn, c.after = oplogs[n-1].TSN, oplogs[n-1].ClockID
+	}
+
+	return oplogs, nil
+}
+
+//
+// PACKAGE EXPORTS
+
+// Open a cursor on the oplog tail after tsn (for all clocks with clockid 0)
+//
+// Next returns the tail in pages of batchSize entries (DefaultOplogBatch
+// for 0), oldest first. Token saves the position for ResumeOplogCursor.
+//
+// Package Export
+func (db *Database) OplogCursor(in_clockid int64, in_afterTSN int64, in_batchSize int) *OplogCursor {
+	return newOplogCursor(db, in_clockid, in_afterTSN, in_batchSize)
+}
+
+// Open a cursor at the position saved with Token
+//
+// Package Export
+func (db *Database) ResumeOplogCursor(in_token string, in_batchSize int) (*OplogCursor, error) {
+
+	c := newOplogCursor(db, 0, 0, in_batchSize)
+
+	parts := strings.Split(in_token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidCursor, in_token)
+	}
+	for i, v := range []*int64{&c.clockid, &c.tsn, &c.after} {
+		n, err := strconv.ParseInt(parts[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidCursor, in_token)
+		}
+		*v = n
+	}
+	if c.clockid != 0 && c.after != c.clockid {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidCursor, in_token)
+	}
+
+	return c, nil
+}
+
+// Read the next page of the oplog tail
+//
+// An empty page means the cursor reached the end of the tail for now;
+// later calls return the entries written since.
+//
+// Package Export
+func (c *OplogCursor) Next() (Oplogs, error) {
+	return c.NextContext(context.Background())
+}
+
+// Read the next page of the oplog tail
+//
+// Package Export
+func (c *OplogCursor) NextContext(ctx context.Context) (Oplogs, error) {
+	return c.next(c.db.withLogger(ctx), c.db.dbconnect)
+}
+
+// The position of the cursor, to be resumed with ResumeOplogCursor
+//
+// Package Export
+func (c *OplogCursor) Token() string {
+	return fmt.Sprintf("%d.%d.%d", c.clockid, c.tsn, c.after)
+}
@@ -0,0 +1,392 @@
+// ENGINE DIGESTS
+//
+// Package for manage power engine data
+// Merkle tree digests of managed tables
+//
+// The rows of a table are bucketed by the leading hex digits of their
+// ckey. The leaves of the tree are the bucket digests computed by the
+// database, every inner node hashes its (up to 16) children. Two tables
+// with the same documents have the same root, independent of their
+// oplogs, and diverging buckets are found by walking down from the root.
+//
+// The tree is always built over md5: rows with digests of another
+// algorithm are bucketed and hashed with the md5 of their url and
+// document, so that nodes with different algorithms, or one rehashing,
+// compare equal for the same documents (migrations/025_digest_md5.sql).
+package engine3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// the deepest supported tree: 16^6 leaves
+const maxDigestDepth = 6
+
+const hexDigits = "0123456789abcdef"
+
+// Merkle tree over a managed table
+type Digest struct {
+	Table string
+	Depth int // hex digits of ckey per leaf bucket
+
+	// prefix -> hash for every non-empty node, "" is the root
+	Nodes map[string][]byte
+
+	// leaf prefix -> number of rows
+	Counts map[string]int64
+}
+
+// The root hash (nil for an empty table)
+func (d *Digest) Root() []byte {
+	return d.Nodes[""]
+}
+
+// compute the inner nodes from the leaves
+func (d *Digest) build() {
+
+	for level := d.Depth; level > 0; level-- {
+		var prefixes []string
+
+		for prefix := range d.Nodes {
+			if len(prefix) == level {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		sort.Strings(prefixes)
+
+		parents := map[string][]byte{}
+		for _, prefix := range prefixes {
+			parent := prefix[:level-1]
+			// child digit and hash, in digit order
+			parents[parent] = append(append(parents[parent], prefix[level-1]), d.Nodes[prefix]...)
+		}
+		for parent, children := range parents {
+			sum := md5.Sum(children)
+			d.Nodes[parent] = sum[:]
+		}
+	}
+}
+
+// The leaf buckets, in which two digests of the same depth differ
+//
+// Only subtrees with different hashes are visited.
+func (d *Digest) Diff(other *Digest) ([]string, error) {
+	var result []string
+
+	if d.Depth != other.Depth {
+		return nil, fmt.Errorf("engine3: digest depth %d and %d differ", d.Depth, other.Depth)
+	}
+
+	level := []string{""}
+	for len(level) > 0 {
+		var next []string
+
+		for _, prefix := range level {
+			if bytes.Equal(d.Nodes[prefix], other.Nodes[prefix]) {
+				continue
+			}
+			if len(prefix) == d.Depth {
+				result = append(result, prefix)
+				continue
+			}
+			for i := 0; i < len(hexDigits); i++ {
+				child := prefix + hexDigits[i:i+1]
+				if d.Nodes[child] != nil || other.Nodes[child] != nil {
+					next = append(next, child)
+				}
+			}
+		}
+		level = next
+	}
+
+	return result, nil
+}
+
+// Calling database stored functions
+
+// read the bucket digests of a table and build its tree
+func tableDigest(ctx context.Context, q querier, in_table string, in_depth int) (*Digest, error) {
+
+	if in_depth < 0 || in_depth > maxDigestDepth {
+		return nil, fmt.Errorf("engine3: digest depth %d out of range 0..%d", in_depth, maxDigestDepth)
+	}
+
+	d := &Digest{Table: in_table, Depth: in_depth, Nodes: map[string][]byte{}, Counts: map[string]int64{}}
+
+	rows, err := q.QueryContext(ctx, "select * from nodes.bucket_digests( $1, $2 )", in_table, in_depth)
+	if err != nil {
+		return nil, wrapErr("nodes.bucket_digests", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			bucket string
+			count  int64
+			hash   []byte
+		)
+
+		if err := rows.Scan(&bucket, &count, &hash); err != nil {
+			return nil, wrapErr("scan bucket digest", err)
+		}
+		d.Nodes[bucket] = hash
+		d.Counts[bucket] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("end reading bucket digests loop", err)
+	}
+
+	d.build()
+
+	logger(ctx).Debug("table digest", "table", in_table, "depth", in_depth, "buckets", len(d.Counts))
+	return d, nil
+}
+
+// read the nodes of the digest tree of a table at level below prefix
+func digestLevel(ctx context.Context, q querier, in_table string, in_depth int, in_prefix string, in_level int) (map[string][]byte, error) {
+
+	rows, err := q.QueryContext(ctx, "select * from nodes.digest_level( $1, $2, $3, $4 )", in_table, in_depth, in_prefix, in_level)
+	if err != nil {
+		return nil, wrapErr("nodes.digest_level", err)
+	}
+	defer rows.Close()
+
+	nodes := map[string][]byte{}
+	for rows.Next() {
+		var (
+			node  string
+			count int64
+			hash  []byte
+		)
+
+		if err := rows.Scan(&node, &count, &hash); err != nil {
+			return nil, wrapErr("scan digest node", err)
+		}
+		nodes[node] = hash
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("end reading digest nodes loop", err)
+	}
+
+	return nodes, nil
+}
+
+/*
+ * the leaf buckets, in which a table of dbconnect1 and dbconnect2 differ
+ *
+ * the roots are compared first, then level by level only the children of
+ * the nodes, which differ: tables with the same root cost one node each
+ */
+func divergedBuckets(ctx context.Context, dbconnect1 querier, dbconnect2 querier, table string, depth int) ([]string, error) {
+
+	if depth < 0 || depth > maxDigestDepth {
+		return nil, fmt.Errorf("engine3: digest depth %d out of range 0..%d", depth, maxDigestDepth)
+	}
+
+	diverged := []string{""}
+	for level := 0; level <= depth && len(diverged) > 0; level++ {
+		var next []string
+
+		for _, prefix := range diverged {
+			remote, err := digestLevel(ctx, dbconnect1, table, depth, prefix, level)
+			if err != nil {
+				return nil, err
+			}
+			local, err := digestLevel(ctx, dbconnect2, table, depth, prefix, level)
+			if err != nil {
+				return nil, err
+			}
+
+			for node, hash := range remote {
+				if !bytes.Equal(hash, local[node]) {
+					next = append(next, node)
+				}
+			}
+			for node := range local {
+				if _, ok := remote[node]; !ok {
+					next = append(next, node)
+				}
+			}
+		}
+
+		sort.Strings(next)
+		diverged = next
+		logger(ctx).Debug("diverged digest nodes", "table", table, "level", level, "nodes", len(diverged))
+	}
+
+	return diverged, nil
+}
+
+// read the rows of a bucket
+func bucketThings(ctx context.Context, q querier, in_table string, in_bucket string) (Things, error) {
+
+	rows, err := q.QueryContext(ctx, "select * from nodes.bucket_things( $1, $2 )", in_table, in_bucket)
+	if err != nil {
+		return nil, wrapErr("nodes.bucket_things", err)
+	}
+	defer rows.Close()
+
+	return rowsToThings(ctx, rows)
+}
+
+// the algorithm of the digests of a version, rows without alg are md5
+func thingAlg(t Thing) string {
+
+	if t.Alg == "" {
+		return DigestMD5
+	}
+	return t.Alg
+}
+
+// the same document in both versions: the digests, if both have the same
+// algorithm, the documents otherwise
+func sameDocument(a Thing, b Thing) bool {
+
+	if thingAlg(a) == thingAlg(b) {
+		return bytes.Equal(a.CVal, b.CVal)
+	}
+	return bytes.Equal(a.Data, b.Data)
+}
+
+/*
+ * pull the rows of a diverged bucket from dbconnect1 into tx
+ *
+ * rows with the same content are left alone, the others are applied like
+ * replicated versions. Rows only present in tx are kept.
+ */
+func syncBucket(ctx context.Context, dbconnect1 *sql.DB, tx *sql.Tx, policy syncPolicy,
+	table string, bucket string, stats *SyncStats) error {
+
+	remote, err := bucketThings(ctx, dbconnect1, table, bucket)
+	if err != nil {
+		return err
+	}
+	local, err := bucketThings(ctx, tx, table, bucket)
+	if err != nil {
+		return err
+	}
+
+	byURL := map[string]Thing{}
+	for _, t := range local {
+		byURL[t.URL] = t
+	}
+
+	for _, t := range remote {
+		if l, ok := byURL[t.URL]; ok && sameDocument(l, t) {
+			stats.Skipped++
+			continue
+		}
+		if err := applyThing(ctx, dbconnect1, tx, policy, table, t, stats); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Digest sync from dbconnect1 to dbconnect2
+ *
+ * for every managed table the trees of both sides are compared from the
+ * root down and only the rows of diverged buckets are read, each bucket
+ * in its own transaction. The oplogs and high water marks are not used, so this
+ * works after the oplogs were truncated.
+ */
+func digestSync(ctx context.Context, dbconnect1 *sql.DB, dbconnect2 *sql.DB, policy syncPolicy, depth int) (SyncStats, error) {
+	var (
+		stats  SyncStats
+		tables []string
+	)
+
+	// merged versions are written with the local clockid
+	if _, err := getMyClockID(ctx, dbconnect2); err != nil {
+		return stats, err
+	}
+
+	managed, err := syncManagedTables(ctx, dbconnect1, dbconnect2)
+	if err != nil {
+		return stats, err
+	}
+	for name := range managed {
+		tables = append(tables, name)
+	}
+	sort.Strings(tables)
+
+	for _, table := range tables {
+		buckets, err := divergedBuckets(ctx, dbconnect1, dbconnect2, table, depth)
+		if err != nil {
+			return stats, err
+		}
+		logger(ctx).Debug("diverged buckets", "table", table, "buckets", len(buckets))
+		stats.Diverged += len(buckets)
+
+		for _, bucket := range buckets {
+			tx, err := dbconnect2.BeginTx(ctx, nil)
+			if err != nil {
+				return stats, wrapErr("begin digest sync", err)
+			}
+
+			if err := syncBucket(ctx, dbconnect1, tx, policy, table, bucket, &stats); err != nil {
+				tx.Rollback()
+				return stats, err
+			}
+
+			if err := tx.Commit(); err != nil {
+				return stats, wrapErr("commit digest sync", err)
+			}
+		}
+	}
+
+	logger(ctx).Info("digest sync", "depth", depth, "diverged", stats.Diverged, "applied", stats.Applied,
+		"skipped", stats.Skipped, "conflicts", stats.Conflicts, "rejected", stats.Rejected)
+	return stats, nil
+}
+
+//
+// PACKAGE EXPORTS
+
+// Compute the Merkle tree of a managed table
+//
+// depth is the number of hex digits of ckey per leaf bucket (0..6).
+//
+// Package Export
+func (db *Database) TableDigest(in_table string, depth int) (*Digest, error) {
+	return db.TableDigestContext(context.Background(), in_table, depth)
+}
+
+// Compute the Merkle tree of a managed table
+//
+// Package Export
+func (db *Database) TableDigestContext(ctx context.Context, in_table string, depth int) (*Digest, error) {
+	return tableDigest(db.withLogger(ctx), db.dbconnect, in_table, depth)
+}
+
+// Pull the rows, in which the managed tables of a remote database differ
+//
+// The tables are compared by their digests of the given depth, only
+// diverged buckets are read. Rows only present in this database are kept.
+//
+// Package Export
+func (db *Database) SyncDigestFrom(remote *Database, depth int) (SyncStats, error) {
+	return db.SyncDigestFromContext(context.Background(), remote, depth)
+}
+
+// Pull the rows, in which the managed tables of a remote database differ
+//
+// Package Export
+func (db *Database) SyncDigestFromContext(ctx context.Context, remote *Database, depth int) (SyncStats, error) {
+
+	ctx = db.withLogger(ctx)
+
+	policy, err := db.syncPolicy(ctx)
+	if err != nil {
+		return SyncStats{}, err
+	}
+
+	return digestSync(ctx, remote.dbconnect, db.dbconnect, policy, depth)
+}
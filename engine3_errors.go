@@ -0,0 +1,101 @@
+// ENGINE ERRORS
+//
+// Package for manage power engine data
+// Errors
+//
+// All errors returned by the package wrap the error of the database
+// (a *pq.Error carries SQLSTATE and constraint name). Errors with a
+// known meaning additionally wrap one of the sentinel errors below,
+// so that callers can test them with errors.Is.
+package engine3
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// the object, key or table does not exist
+	ErrNotFound = errors.New("engine3: not found")
+
+	// a write collides with an existing object (unique violation)
+	ErrConflict = errors.New("engine3: conflict")
+
+	// the version of an object is not the expected one
+	ErrStaleVersion = errors.New("engine3: stale version")
+
+	// the local node has no clockid yet (clockid 0)
+	ErrNotRegistered = errors.New("engine3: node not registered")
+
+	// the database schema does not match the library
+	ErrSchemaMismatch = errors.New("engine3: schema mismatch")
+
+	// the oplog of a peer no longer has the history seen at the last sync
+	ErrHistoryRewritten = errors.New("engine3: oplog history rewritten")
+
+	// a peer is behind the oplog retention and has to catch up with BootstrapFrom
+	ErrResyncRequired = errors.New("engine3: full resync required")
+
+	// the database has not caught up with a read token
+	ErrReplicaBehind = errors.New("engine3: replica behind read token")
+
+	// a cursor token, which was not returned by OplogCursor.Token
+	ErrInvalidCursor = errors.New("engine3: invalid oplog cursor")
+)
+
+// SQLSTATE codes raised by the schema (see migrations/002_errors.sql)
+const (
+	codeNotRegistered = "EN001"
+	codeStaleVersion  = "EN003"
+)
+
+// find the sentinel error for an error of the database (nil if none)
+func classifyErr(err error) error {
+	var pqErr *pq.Error
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+
+	if !errors.As(err, &pqErr) {
+		return nil
+	}
+
+	switch pqErr.Code {
+	case codeNotRegistered:
+		return ErrNotRegistered
+	case codeStaleVersion:
+		return ErrStaleVersion
+	case "23505": // unique_violation
+		return ErrConflict
+	case "42P01": // undefined_table
+		return ErrNotFound
+	case "42883": // undefined_function
+		return ErrSchemaMismatch
+	}
+	return nil
+}
+
+// helper function for error handling
+//
+// wraps err with the operation and the matching sentinel error, the
+// original error (e.g. *pq.Error) stays available to errors.As
+func wrapErr(op string, err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	if sentinel := classifyErr(err); sentinel != nil && !errors.Is(err, sentinel) {
+		return fmt.Errorf("%w: %s: %w", sentinel, op, err)
+	}
+	return fmt.Errorf("engine3: %s: %w", op, err)
+}
+
+// an error for a missing object, wrapping ErrNotFound
+func notFound(what string) error {
+	return fmt.Errorf("%w: %s", ErrNotFound, what)
+}
@@ -0,0 +1,500 @@
+// ENGINE REST
+//
+// Package for manage power engine data
+// HTTP interface
+//
+//	GET|PUT|DELETE  /power/{key}
+//	GET             /things/{table}
+//	GET|PUT|DELETE  /things/{table}/{url...}
+//	GET|PUT         /nodes
+//	GET|PUT|DELETE  /nodes/{clockid}
+//
+// Bodies are JSON. Things carry an ETag derived from their cval, PUT and
+// DELETE honor If-Match, PUT honors If-None-Match: * (create only).
+package engine3
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// largest accepted request body
+const maxBodySize = 1 << 20
+
+// the HTTP interface of a database
+type handler struct {
+	db     *Database
+	routes []route
+}
+
+// a method and a path pattern: {name} matches one segment, a final
+// {name...} the rest of the path
+type route struct {
+	method  string
+	pattern []string
+	fn      http.HandlerFunc
+}
+
+// the values of the path segments a route matched
+type pathKey struct{}
+
+// a power data entry
+type powerData struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// registration of a node
+type nodeRegistration struct {
+	URL     string          `json:"url"`
+	Data    json.RawMessage `json:"data"`
+	ClockID int64           `json:"clockid,omitempty"`
+}
+
+// Create the HTTP handler for a database
+//
+// Package Export
+func NewHandler(db *Database) http.Handler {
+
+	h := &handler{db: db}
+
+	h.handle("GET /power/{key}", h.getPower)
+	h.handle("PUT /power/{key}", h.putPower)
+	h.handle("DELETE /power/{key}", h.deletePower)
+
+	h.handle("GET /things/{table}", h.listThings)
+	h.handle("GET /things/{table}/{url...}", h.getThing)
+	h.handle("PUT /things/{table}/{url...}", h.putThing)
+	h.handle("DELETE /things/{table}/{url...}", h.deleteThing)
+
+	h.handle("GET /nodes", h.listNodes)
+	h.handle("PUT /nodes", h.registerNode)
+	h.handle("GET /nodes/{clockid}", h.getNode)
+	h.handle("PUT /nodes/{clockid}", h.updateNode)
+	h.handle("DELETE /nodes/{clockid}", h.deleteNode)
+
+	return h
+}
+
+// add a route, pattern is "METHOD /path"
+func (h *handler) handle(pattern string, fn http.HandlerFunc) {
+
+	method, path, _ := strings.Cut(pattern, " ")
+	h.routes = append(h.routes, route{method: method, pattern: strings.Split(strings.TrimPrefix(path, "/"), "/"), fn: fn})
+}
+
+// match the escaped segments of a path, returns the unescaped values
+func (rt route) match(segments []string) (map[string]string, bool) {
+
+	values := map[string]string{}
+	for i, p := range rt.pattern {
+		name, isVar := strings.CutPrefix(p, "{")
+		name, _ = strings.CutSuffix(name, "}")
+
+		if rest, ok := strings.CutSuffix(name, "..."); isVar && ok {
+			if i >= len(segments) {
+				return nil, false
+			}
+			v, err := url.PathUnescape(strings.Join(segments[i:], "/"))
+			if err != nil || v == "" {
+				return nil, false
+			}
+			values[rest] = v
+			return values, true
+		}
+
+		if i >= len(segments) {
+			return nil, false
+		}
+		v, err := url.PathUnescape(segments[i])
+		if err != nil {
+			return nil, false
+		}
+		switch {
+		case isVar && v != "":
+			values[name] = v
+		case isVar || v != p:
+			return nil, false
+		}
+	}
+
+	return values, len(segments) == len(rt.pattern)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+
+	var allowed []string
+	for _, rt := range h.routes {
+		values, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+		if rt.method != r.Method && !(rt.method == http.MethodGet && r.Method == http.MethodHead) {
+			allowed = append(allowed, rt.method)
+			continue
+		}
+
+		rt.fn(w, r.WithContext(context.WithValue(r.Context(), pathKey{}, values)))
+		return
+	}
+
+	if allowed != nil {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// the value of a path segment of the route
+func pathValue(r *http.Request, name string) string {
+
+	values, _ := r.Context().Value(pathKey{}).(map[string]string)
+	return values[name]
+}
+
+// the ETag of a thing
+func etag(t Thing) string {
+	return `"` + hex.EncodeToString(t.CVal) + `"`
+}
+
+// write a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// write a thing with its ETag
+func writeThing(w http.ResponseWriter, status int, t Thing) {
+
+	w.Header().Set("ETag", etag(t))
+	writeJSON(w, status, t)
+}
+
+// write an error, the status is derived from the sentinel errors
+func (h *handler) writeError(w http.ResponseWriter, r *http.Request, err error) {
+
+	status := http.StatusInternalServerError
+
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrStaleVersion):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, ErrConflict):
+		status = http.StatusConflict
+	case errors.Is(err, ErrNotRegistered):
+		status = http.StatusServiceUnavailable
+	}
+
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		// do not hand out database details
+		h.db.logger().Error("http", "method", r.Method, "path", r.URL.Path, "err", err)
+		message = http.StatusText(status)
+	}
+
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// read a JSON request body
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		// a client that went away or a broken chunked body is a bad request
+		var tooLarge *http.MaxBytesError
+		status := http.StatusBadRequest
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if !json.Valid(body) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "body is not valid JSON"})
+		return nil, false
+	}
+	return body, true
+}
+
+// read the clockid of the path
+func pathClockID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+
+	clockid, err := strconv.ParseInt(pathValue(r, "clockid"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid clockid"})
+		return 0, false
+	}
+	return clockid, true
+}
+
+// check If-Match against the current version of a thing
+//
+// returns the version to write against (zero for a new thing)
+func (h *handler) precondition(r *http.Request, table, url string) (Thing, bool, error) {
+
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+
+	if ifMatch == "" && ifNoneMatch != "*" {
+		return Thing{}, false, nil
+	}
+
+	current, err := h.db.GetThingContext(r.Context(), table, url)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return current, false, err
+	}
+	exists := err == nil
+
+	if ifNoneMatch == "*" && exists {
+		return current, false, ErrStaleVersion
+	}
+	if ifMatch != "" && (!exists || (ifMatch != "*" && ifMatch != etag(current))) {
+		return current, false, ErrStaleVersion
+	}
+
+	return current, true, nil
+}
+
+// Power
+
+func (h *handler) getPower(w http.ResponseWriter, r *http.Request) {
+
+	key := pathValue(r, "key")
+
+	value, err := h.db.GetPowerDataContext(r.Context(), key)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, powerData{Key: key, Value: value})
+}
+
+func (h *handler) putPower(w http.ResponseWriter, r *http.Request) {
+	var in powerData
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	if err := json.Unmarshal(body, &in); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	in.Key = pathValue(r, "key")
+
+	if err := h.db.PutPowerDataContext(r.Context(), in.Key, in.Value); err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, in)
+}
+
+func (h *handler) deletePower(w http.ResponseWriter, r *http.Request) {
+
+	if err := h.db.DeletePowerDataContext(r.Context(), pathValue(r, "key")); err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Things
+
+func (h *handler) listThings(w http.ResponseWriter, r *http.Request) {
+
+	things, err := h.db.ListThingsContext(r.Context(), pathValue(r, "table"))
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	if things == nil {
+		things = Things{}
+	}
+
+	writeJSON(w, http.StatusOK, things)
+}
+
+func (h *handler) getThing(w http.ResponseWriter, r *http.Request) {
+
+	t, err := h.db.GetThingContext(r.Context(), pathValue(r, "table"), pathValue(r, "url"))
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if r.Header.Get("If-None-Match") == etag(t) {
+		w.Header().Set("ETag", etag(t))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeThing(w, http.StatusOK, t)
+}
+
+func (h *handler) putThing(w http.ResponseWriter, r *http.Request) {
+	var (
+		t   Thing
+		err error
+	)
+
+	table, url := pathValue(r, "table"), pathValue(r, "url")
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	expected, conditional, err := h.precondition(r, table, url)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if conditional {
+		// the database checks the version again while writing
+		t, err = h.db.PutThingIfContext(r.Context(), table, url, body, expected)
+	} else {
+		t, err = h.db.PutThingContext(r.Context(), table, url, body)
+	}
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeThing(w, http.StatusOK, t)
+}
+
+func (h *handler) deleteThing(w http.ResponseWriter, r *http.Request) {
+
+	table, url := pathValue(r, "table"), pathValue(r, "url")
+
+	expected, conditional, err := h.precondition(r, table, url)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if conditional {
+		// the database checks the version again while deleting
+		err = h.db.DeleteThingIfContext(r.Context(), table, url, expected)
+	} else {
+		err = h.db.DeleteThingContext(r.Context(), table, url)
+	}
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Nodes
+
+func (h *handler) listNodes(w http.ResponseWriter, r *http.Request) {
+
+	nodes, err := h.db.ListNodesContext(r.Context())
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	if nodes == nil {
+		nodes = Things{}
+	}
+
+	writeJSON(w, http.StatusOK, nodes)
+}
+
+func (h *handler) registerNode(w http.ResponseWriter, r *http.Request) {
+	var in nodeRegistration
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	if err := json.Unmarshal(body, &in); err != nil || in.URL == "" || !json.Valid(in.Data) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expected {\"url\": ..., \"data\": {...}}"})
+		return
+	}
+
+	clockid, err := h.db.RegisterLocalNodeToMasterContext(r.Context(), in.URL, in.Data)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	t, err := h.db.GetNodeContext(r.Context(), clockid)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeThing(w, http.StatusOK, t)
+}
+
+func (h *handler) getNode(w http.ResponseWriter, r *http.Request) {
+
+	clockid, ok := pathClockID(w, r)
+	if !ok {
+		return
+	}
+
+	t, err := h.db.GetNodeContext(r.Context(), clockid)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeThing(w, http.StatusOK, t)
+}
+
+func (h *handler) updateNode(w http.ResponseWriter, r *http.Request) {
+
+	clockid, ok := pathClockID(w, r)
+	if !ok {
+		return
+	}
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	t, err := h.db.UpdateNodeContext(r.Context(), clockid, body)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	writeThing(w, http.StatusOK, t)
+}
+
+func (h *handler) deleteNode(w http.ResponseWriter, r *http.Request) {
+
+	clockid, ok := pathClockID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.DeleteNodeContext(r.Context(), clockid); err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
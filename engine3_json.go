@@ -13,16 +13,16 @@ func toJson(v interface{}) []byte {
 
 	b, err := json.Marshal(v)
 	if err != nil {
-		log.Panic(err.Error)
+		log.Panic(err)
 	}
 	return b
 }
 
 func fromJson(b []byte, v interface{}) {
 
-	err := json.Unmarshal(b, &v)
+	err := json.Unmarshal(b, v)
 	if err != nil {
-		log.Panic(err.Error)
+		log.Panic(err)
 	}
 
 }
@@ -0,0 +1,77 @@
+// ENGINE LOGGING
+//
+// Package for manage power engine data
+// Logging
+//
+// The package logs through log/slog. Nothing is logged unless a logger
+// is set for the package (SetLogger) or for a Database. Records carry
+// structured fields: database, clockid, tsn, table and op.
+package engine3
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+// a slog.Handler, which drops every record
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var silentLogger = slog.New(discardHandler{})
+
+// the logger of the package (silent by default)
+var packageLogger atomic.Pointer[slog.Logger]
+
+// logger stored in a context by a Database
+type loggerKey struct{}
+
+// Set the logger of the package, nil makes the package silent
+//
+// Package export
+func SetLogger(l *slog.Logger) {
+	packageLogger.Store(l)
+}
+
+// Set the logger of a database, nil falls back to the package logger
+//
+// Package export
+func (db *Database) SetLogger(l *slog.Logger) {
+	db.log.Store(l)
+}
+
+// the package logger
+func pkgLogger() *slog.Logger {
+
+	if l := packageLogger.Load(); l != nil {
+		return l
+	}
+	return silentLogger
+}
+
+// the logger of a database, with the database name as field
+func (db *Database) logger() *slog.Logger {
+
+	if l := db.log.Load(); l != nil {
+		return l.With("database", db.name)
+	}
+	return pkgLogger().With("database", db.name)
+}
+
+// carry the logger of a database to the internal functions
+func (db *Database) withLogger(ctx context.Context) context.Context {
+	return context.WithValue(ctx, loggerKey{}, db.logger())
+}
+
+// the logger for internal functions
+func logger(ctx context.Context) *slog.Logger {
+
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return pkgLogger()
+}
@@ -0,0 +1,196 @@
+// ENGINE MIGRATIONS
+//
+// Package for manage power engine data
+// Database schema, embedded and versioned
+//
+// The schema is kept as an ordered list of SQL files in migrations/,
+// named <version>_<name>.sql. Every applied migration is recorded in
+// nodes.schema_version.
+package engine3
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// all migrations known to the library, ordered by version
+var migrations = loadMigrations()
+
+// key of the advisory lock serializing concurrent migration runs
+const migrationLock = 0x656e67696e6533 // "engine3"
+
+// read the embedded migrations
+func loadMigrations() []migration {
+	var result []migration
+
+	files, err := migrationFiles.ReadDir("migrations")
+	checkErr("read migrations", err)
+
+	for _, f := range files {
+		base := strings.TrimSuffix(f.Name(), ".sql")
+		num, name, _ := strings.Cut(base, "_")
+
+		version, err := strconv.Atoi(num)
+		checkErr("migration version "+f.Name(), err)
+
+		text, err := migrationFiles.ReadFile(path.Join("migrations", f.Name()))
+		checkErr("read migration "+f.Name(), err)
+
+		result = append(result, migration{version: version, name: name, sql: string(text)})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].version < result[j].version })
+
+	return result
+}
+
+// the schema version the library is written for
+func RequiredSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// create the version table, if missing
+func ensureSchemaVersion(ctx context.Context, tx *sql.Tx) error {
+
+	_, err := tx.ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS nodes;
+		CREATE TABLE IF NOT EXISTS nodes.schema_version (
+		     version integer,
+		     name    text,
+		     applied timestamp with time zone DEFAULT now(),
+		     PRIMARY KEY( version )
+		)`)
+
+	return wrapErr("create nodes.schema_version", err)
+}
+
+// read the installed schema version (0 for an empty database)
+func schemaVersion(ctx context.Context, q querier) (int, error) {
+
+	var version int
+
+	row := q.QueryRowContext(ctx, `SELECT CASE WHEN to_regclass('nodes.schema_version') IS NULL THEN 0
+		ELSE (SELECT coalesce(max(version), 0) FROM nodes.schema_version) END`)
+	checkRow(row)
+
+	err := row.Scan(&version)
+
+	return version, wrapErr("read schema version", err)
+}
+
+// apply one migration, if not yet applied (in its own transaction)
+func applyMigration(ctx context.Context, dbconnect *sql.DB, m migration) (bool, error) {
+
+	var version int
+
+	tx, err := dbconnect.BeginTx(ctx, nil)
+	if err != nil {
+		return false, wrapErr("begin migration", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock( $1 )", migrationLock)
+	if err != nil {
+		return false, wrapErr("lock migration", err)
+	}
+
+	if err := ensureSchemaVersion(ctx, tx); err != nil {
+		return false, err
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT coalesce(max(version), 0) FROM nodes.schema_version").Scan(&version)
+	if err != nil {
+		return false, wrapErr("read schema version", err)
+	}
+
+	if version >= m.version {
+		// applied by a concurrent run
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, m.sql)
+	if err != nil {
+		return false, wrapErr(fmt.Sprintf("migration %d %s", m.version, m.name), err)
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO nodes.schema_version( version, name ) VALUES ( $1, $2 )", m.version, m.name)
+	if err != nil {
+		return false, wrapErr("record migration", err)
+	}
+
+	return true, wrapErr("commit migration", tx.Commit())
+}
+
+// apply all pending migrations in order, returns the number applied
+func migrate(ctx context.Context, dbconnect *sql.DB) (int, error) {
+	var applied int
+
+	installed, err := schemaVersion(ctx, dbconnect)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range migrations {
+		if m.version <= installed {
+			continue
+		}
+		ok, err := applyMigration(ctx, dbconnect, m)
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			logger(ctx).Info("applied migration", "version", m.version, "name", m.name)
+			applied++
+		}
+	}
+
+	return applied, nil
+}
+
+//
+// PACKAGE EXPORTS
+
+// Apply all pending schema migrations
+//
+// Package Export
+func (db *Database) Migrate() (int, error) {
+	return db.MigrateContext(context.Background())
+}
+
+// Apply all pending schema migrations
+//
+// Package Export
+func (db *Database) MigrateContext(ctx context.Context) (int, error) {
+	return migrate(db.withLogger(ctx), db.dbconnect)
+}
+
+// Read the installed schema version
+//
+// Package Export
+func (db *Database) SchemaVersion() (int, error) {
+	return db.SchemaVersionContext(context.Background())
+}
+
+// Read the installed schema version
+//
+// Package Export
+func (db *Database) SchemaVersionContext(ctx context.Context) (int, error) {
+	return schemaVersion(ctx, db.dbconnect)
+}
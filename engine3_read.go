@@ -0,0 +1,283 @@
+// ENGINE CONSISTENT READS
+//
+// Package for manage power engine data
+// Point-in-time reads
+//
+// A ReadToken is a vector of high water marks. A read at a token waits
+// until the database has caught up with it and reads from a snapshot,
+// whose own high water marks cover every version returned: a sync round
+// is never seen half applied. Tokens of writes give read-your-writes,
+// tokens of earlier reads monotonic reads.
+package engine3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how often a read waiting for the database checks its high water marks
+const readPoll = 50 * time.Millisecond
+
+// A vector of high water marks to read at
+type ReadToken HighWaterMarks
+
+// The token of a version: reads at it see this version or a later one
+func (t Thing) ReadToken() ReadToken {
+	return ReadToken{{ClockID: t.ClockID, TSN: t.TSN}}
+}
+
+// The higher tsn of both tokens for every clock
+func (r ReadToken) Merge(o ReadToken) ReadToken {
+
+	highs := map[int64]int64{}
+	for _, hwm := range append(append(ReadToken{}, r...), o...) {
+		if hwm.TSN > highs[hwm.ClockID] {
+			highs[hwm.ClockID] = hwm.TSN
+		}
+	}
+
+	return tokenOf(highs)
+}
+
+// The token as text, for ParseReadToken
+func (r ReadToken) String() string {
+
+	parts := make([]string, len(r))
+	for i, hwm := range r {
+		parts[i] = fmt.Sprintf("%d:%d", hwm.ClockID, hwm.TSN)
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// Read a token written with ReadToken.String
+func ParseReadToken(s string) (ReadToken, error) {
+
+	r := ReadToken{}
+	if s == "" {
+		return r, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		clockid, tsn, ok := strings.Cut(part, ":")
+		c, err1 := strconv.ParseInt(clockid, 10, 64)
+		t, err2 := strconv.ParseInt(tsn, 10, 64)
+		if !ok || err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("engine3: invalid read token %q", s)
+		}
+		r = append(r, HighWaterMark{ClockID: c, TSN: t})
+	}
+
+	return r, nil
+}
+
+// a token of high water marks, ordered by clockid
+func tokenOf(highs map[int64]int64) ReadToken {
+
+	r := ReadToken{}
+	for clockid, tsn := range highs {
+		r = append(r, HighWaterMark{ClockID: clockid, TSN: tsn})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].ClockID < r[j].ClockID })
+
+	return r
+}
+
+// the first high water mark of r the snapshot highs do not cover, nil if
+// they cover all
+func (r ReadToken) uncovered(highs map[int64]int64) *HighWaterMark {
+
+	for _, hwm := range r {
+		if highs[hwm.ClockID] < hwm.TSN {
+			return &HighWaterMark{ClockID: hwm.ClockID, TSN: hwm.TSN}
+		}
+	}
+	return nil
+}
+
+// the high water marks of a snapshot
+func snapshotHighs(ctx context.Context, q querier) (map[int64]int64, error) {
+
+	hwms, err := getRemoteHighs(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	highs := map[int64]int64{}
+	for _, hwm := range hwms {
+		highs[hwm.ClockID] = hwm.TSN
+	}
+
+	return highs, nil
+}
+
+/*
+ * read in a repeatable read snapshot, which covers token
+ *
+ * fn reads with the high water marks of the snapshot; it returns the high
+ * water mark a version it read needs, if the snapshot does not cover it.
+ * Returns the first high water mark not covered, nil after the read.
+ */
+func tryReadAt(ctx context.Context, dbconnect *sql.DB, token ReadToken,
+	fn func(q querier, highs map[int64]int64) (*HighWaterMark, error)) (*HighWaterMark, error) {
+
+	tx, err := dbconnect.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, wrapErr("begin read", err)
+	}
+	defer tx.Rollback()
+
+	highs, err := snapshotHighs(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if behind := token.uncovered(highs); behind != nil {
+		return behind, nil
+	}
+
+	return fn(tx, highs)
+}
+
+/*
+ * read at token, waiting up to wait for the database to catch up
+ *
+ * fails with ErrReplicaBehind, if it does not
+ */
+func readAt(ctx context.Context, dbconnect *sql.DB, token ReadToken, wait time.Duration,
+	fn func(q querier, highs map[int64]int64) (*HighWaterMark, error)) error {
+
+	deadline := time.Now().Add(wait)
+	for {
+		behind, err := tryReadAt(ctx, dbconnect, token, fn)
+		if err != nil || behind == nil {
+			return err
+		}
+
+		if !time.Now().Before(deadline) {
+			logger(ctx).Debug("read behind token", "clockid", behind.ClockID, "tsn", behind.TSN)
+			return fmt.Errorf("%w: clock %d not at tsn %d", ErrReplicaBehind, behind.ClockID, behind.TSN)
+		}
+
+		t := time.NewTimer(readPoll)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return wrapErr("wait for read token", ctx.Err())
+		case <-t.C:
+		}
+	}
+}
+
+//
+// PACKAGE EXPORTS
+
+// Set how long reads at a token wait for the database to catch up
+//
+// Zero (the default) fails at once with ErrReplicaBehind.
+//
+// Package Export
+func (db *Database) SetReadWait(d time.Duration) {
+	db.readWait.Store(int64(d))
+}
+
+// The high water marks of the database as a token
+//
+// Reads at it on another database see at least what this one has.
+//
+// Package Export
+func (db *Database) ReadToken() (ReadToken, error) {
+	return db.ReadTokenContext(context.Background())
+}
+
+// The high water marks of the database as a token
+//
+// Package Export
+func (db *Database) ReadTokenContext(ctx context.Context) (ReadToken, error) {
+
+	highs, err := snapshotHighs(db.withLogger(ctx), db.dbconnect)
+	if err != nil {
+		return nil, err
+	}
+	return tokenOf(highs), nil
+}
+
+// Get a thing at a read token
+//
+// The version returned is covered by the high water marks of the
+// database, which cover the token. A version of a sync round not
+// completed yet is waited for like a token not reached.
+//
+// Package Export
+func (db *Database) GetThingAt(in_table string, in_url string, token ReadToken) (Thing, error) {
+	return db.GetThingAtContext(context.Background(), in_table, in_url, token)
+}
+
+// Get a thing at a read token
+//
+// Package Export
+func (db *Database) GetThingAtContext(ctx context.Context, in_table string, in_url string, token ReadToken) (Thing, error) {
+	var t Thing
+
+	ctx = db.withLogger(ctx)
+	err := readAt(ctx, db.dbconnect, token, time.Duration(db.readWait.Load()),
+		func(q querier, highs map[int64]int64) (*HighWaterMark, error) {
+
+			var ok bool
+			var err error
+
+			if t, ok, err = getThing(ctx, q, in_table, in_url); err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, notFound("thing " + in_table + "/" + in_url)
+			}
+			if highs[t.ClockID] < t.TSN {
+				return &HighWaterMark{ClockID: t.ClockID, TSN: t.TSN}, nil
+			}
+			return nil, nil
+		})
+
+	return t, err
+}
+
+// List the things of a table at a read token
+//
+// Only versions covered by the high water marks of the database are
+// listed, the versions of a sync round not completed yet are left out.
+//
+// Package Export
+func (db *Database) ListThingsAt(in_table string, token ReadToken) (Things, error) {
+	return db.ListThingsAtContext(context.Background(), in_table, token)
+}
+
+// List the things of a table at a read token
+//
+// Package Export
+func (db *Database) ListThingsAtContext(ctx context.Context, in_table string, token ReadToken) (Things, error) {
+	var result Things
+
+	ctx = db.withLogger(ctx)
+	err := readAt(ctx, db.dbconnect, token, time.Duration(db.readWait.Load()),
+		func(q querier, highs map[int64]int64) (*HighWaterMark, error) {
+
+			things, err := listThings(ctx, q, in_table)
+			if err != nil {
+				return nil, err
+			}
+
+			result = things[:0]
+			for _, t := range things {
+				if t.TSN <= highs[t.ClockID] {
+					result = append(result, t)
+				}
+			}
+			return nil, nil
+		})
+
+	return result, err
+}
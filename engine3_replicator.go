@@ -0,0 +1,349 @@
+// ENGINE REPLICATOR
+//
+// Package for manage power engine data
+// Continuous replication
+//
+// A Replicator keeps a local database in sync with its peers: every peer
+// is pulled from (and optionally pushed to) on an interval with jitter.
+// A failing peer is retried with exponential backoff, independent of the
+// other peers.
+//
+// The rounds with different peers run concurrently. Only the replay of a
+// clock is serialized, by a lock of the clock in the local database: a
+// peer, which hangs while its versions of a clock are replayed, holds up
+// the other peers on that clock, not on the rest.
+package engine3
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// the defaults of a Replicator
+const (
+	DefaultReplicationInterval = 30 * time.Second
+	DefaultReplicationJitter   = 0.1 // of the interval
+	DefaultReplicationBackoff  = 10 * time.Minute
+)
+
+// A remote database of a Replicator
+type Peer struct {
+	DB   *Database
+	Push bool // push local changes to the peer as well
+}
+
+// The state of a peer of a Replicator
+type PeerStatus struct {
+	Peer        string    `json:"peer"` // database name
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"` // of the last round, empty on success
+	Errors      int       `json:"errors"`               // failed rounds in total
+	Failures    int       `json:"failures"`             // failed rounds in a row
+	NextRound   time.Time `json:"next_round"`
+
+	Pulled SyncStats `json:"pulled"` // of the last round
+	Pushed SyncStats `json:"pushed"`
+
+	// clockid -> tsns the local database is behind the peer
+	Lag map[int64]int64 `json:"lag"`
+}
+
+// A status snapshot of a Replicator
+type ReplicatorStatus struct {
+	Running bool         `json:"running"`
+	Peers   []PeerStatus `json:"peers"`
+}
+
+// Options for NewReplicator
+type ReplicatorOption func(*replicatorOptions)
+
+type replicatorOptions struct {
+	interval time.Duration // between two rounds with a peer
+	jitter   float64       // random part of a delay, as a fraction
+	backoff  time.Duration // the longest delay after failures
+}
+
+// bring the options into range, true if the interval or jitter was out
+// of range and has been changed
+//
+// a round needs an interval and the jitter is a fraction of the delay, so
+// that it never becomes negative; the backoff is at least the interval,
+// which a long interval without a backoff of its own gives as well
+func (o *replicatorOptions) clamp() bool {
+
+	given := *o
+
+	if o.interval <= 0 {
+		o.interval = DefaultReplicationInterval
+	}
+	switch {
+	case !(o.jitter >= 0): // NaN as well
+		o.jitter = 0
+	case o.jitter > 1:
+		o.jitter = 1
+	}
+	if o.backoff < o.interval {
+		o.backoff = o.interval
+	}
+
+	return o.interval != given.interval || o.jitter != given.jitter
+}
+
+// Run a round with every peer each interval (DefaultReplicationInterval)
+func ReplicateEvery(d time.Duration) ReplicatorOption {
+	return func(o *replicatorOptions) { o.interval = d }
+}
+
+// Vary every delay randomly by up to a fraction of it (DefaultReplicationJitter)
+func ReplicateJitter(fraction float64) ReplicatorOption {
+	return func(o *replicatorOptions) { o.jitter = fraction }
+}
+
+// Limit the backoff after failed rounds (DefaultReplicationBackoff)
+func ReplicateBackoff(max time.Duration) ReplicatorOption {
+	return func(o *replicatorOptions) { o.backoff = max }
+}
+
+// Continuous replication of a local database with its peers
+type Replicator struct {
+	local *Database
+	peers []Peer
+	opts  replicatorOptions
+
+	mu      sync.Mutex // status, cancel and stopped
+	status  []PeerStatus
+	cancel  context.CancelFunc
+	stopped chan struct{} // closed, once the rounds of the run ended
+}
+
+// the delay before the next round after a number of failures in a row
+//
+// the interval doubles with every failure up to backoff, rnd in [0, 1)
+// spreads it by up to jitter in both directions
+func replicationDelay(o replicatorOptions, failures int, rnd float64) time.Duration {
+
+	d := o.interval
+	for i := 0; i < failures && d < o.backoff; i++ {
+		d *= 2
+	}
+	if d > o.backoff {
+		d = o.backoff
+	}
+
+	return d + time.Duration(float64(d)*o.jitter*(2*rnd-1))
+}
+
+// the lag of local behind a peer for every clock of the peer
+func replicationLag(ctx context.Context, local *Database, peer *Database) (map[int64]int64, error) {
+
+	lag := map[int64]int64{}
+
+	hwms, err := getRemoteHighs(ctx, peer.dbconnect)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hwm := range hwms {
+		high, err := checkHigh(ctx, local.dbconnect, hwm.ClockID)
+		if err != nil {
+			return nil, err
+		}
+		if hwm.TSN > high {
+			lag[hwm.ClockID] = hwm.TSN - high
+		} else {
+			lag[hwm.ClockID] = 0
+		}
+	}
+
+	return lag, nil
+}
+
+// a round with peer i: pull, push and the lag afterwards
+func (r *Replicator) round(ctx context.Context, i int) (pulled SyncStats, pushed SyncStats, lag map[int64]int64, err error) {
+
+	p := r.peers[i]
+
+	if pulled, err = r.local.SyncFromContext(ctx, p.DB); err != nil {
+		return
+	}
+	if p.Push {
+		if pushed, err = p.DB.SyncFromContext(ctx, r.local); err != nil {
+			return
+		}
+	}
+	lag, err = replicationLag(ctx, r.local, p.DB)
+	return
+}
+
+// replicate with peer i until ctx is done
+func (r *Replicator) run(ctx context.Context, i int, done *sync.WaitGroup) {
+	defer done.Done()
+
+	log := logger(r.local.withLogger(ctx)).With("peer", r.peers[i].DB.name)
+
+	for {
+		started := time.Now()
+		pulled, pushed, lag, err := r.round(ctx, i)
+		if ctx.Err() != nil {
+			return
+		}
+
+		r.mu.Lock()
+		s := &r.status[i]
+		s.LastAttempt = started
+		s.Pulled, s.Pushed = pulled, pushed
+		if err != nil {
+			s.LastError = err.Error()
+			s.Errors++
+			s.Failures++
+		} else {
+			s.LastSuccess = started
+			s.LastError = ""
+			s.Failures = 0
+			s.Lag = lag
+		}
+		delay := replicationDelay(r.opts, s.Failures, rand.Float64())
+		s.NextRound = time.Now().Add(delay)
+		r.mu.Unlock()
+
+		if err != nil {
+			log.Warn("replication round failed", "error", err, "retry", delay)
+		} else {
+			log.Debug("replication round", "applied", pulled.Applied, "pushed", pushed.Applied, "next", delay)
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+//
+// PACKAGE EXPORTS
+
+// Create a Replicator for a local database and its peers
+//
+// Options out of range are corrected and logged: an interval not above
+// zero is the default, the jitter is kept between 0 and 1 and the backoff
+// is at least the interval.
+//
+// Package Export
+func NewReplicator(local *Database, peers []Peer, opts ...ReplicatorOption) *Replicator {
+
+	o := replicatorOptions{
+		interval: DefaultReplicationInterval,
+		jitter:   DefaultReplicationJitter,
+		backoff:  DefaultReplicationBackoff,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if given := o; o.clamp() {
+		local.logger().Warn("replicator options out of range", "interval", given.interval, "jitter", given.jitter,
+			"backoff", given.backoff, "using_interval", o.interval, "using_jitter", o.jitter, "using_backoff", o.backoff)
+	}
+
+	r := &Replicator{local: local, peers: peers, opts: o, status: make([]PeerStatus, len(peers))}
+	for i, p := range peers {
+		r.status[i].Peer = p.DB.name
+	}
+
+	return r
+}
+
+// Start the rounds with all peers, the first one right away
+//
+// The rounds run until Stop is called or ctx is done; either way the
+// Replicator is no longer Running afterwards and can be started again.
+// The local database has to be registered.
+//
+// Package Export
+func (r *Replicator) Start(ctx context.Context) error {
+
+	if _, err := getMyClockID(ctx, r.local.dbconnect); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel != nil {
+		return errors.New("engine3: replicator already running")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	r.cancel, r.stopped = cancel, stopped
+
+	var done sync.WaitGroup
+	for i := range r.peers {
+		done.Add(1)
+		go r.run(ctx, i, &done)
+	}
+
+	// the run ends with Stop or with the ctx of the caller
+	go func() {
+		<-ctx.Done()
+		done.Wait()
+
+		r.mu.Lock()
+		if r.stopped == stopped {
+			r.cancel, r.stopped = nil, nil
+		}
+		r.mu.Unlock()
+
+		cancel()
+		close(stopped)
+		r.local.logger().Info("replicator stopped")
+	}()
+
+	logger(r.local.withLogger(ctx)).Info("replicator started", "peers", len(r.peers), "interval", r.opts.interval)
+	return nil
+}
+
+// Stop the rounds and wait for the running ones to end
+//
+// Package Export
+func (r *Replicator) Stop() {
+
+	r.mu.Lock()
+	cancel, stopped := r.cancel, r.stopped
+	r.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-stopped
+}
+
+// A snapshot of the state of the Replicator
+//
+// Package Export
+func (r *Replicator) Status() ReplicatorStatus {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := ReplicatorStatus{Running: r.cancel != nil, Peers: make([]PeerStatus, len(r.status))}
+	for i, p := range r.status {
+		if p.Lag != nil {
+			lag := make(map[int64]int64, len(p.Lag))
+			for clockid, n := range p.Lag {
+				lag[clockid] = n
+			}
+			p.Lag = lag
+		}
+		s.Peers[i] = p
+	}
+
+	return s
+}
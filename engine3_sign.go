@@ -0,0 +1,459 @@
+// ENGINE SIGNATURES
+//
+// Package for manage power engine data
+// Signed versions and node identities
+//
+// Every node registered by this package holds an Ed25519 key. The public
+// key is registered with the node in nodes.systems, the private key is
+// kept outside the database in a key file (Config.KeyDir). The node signs url, cval, clockid and
+// tsn of every version and delete it writes, so that a peer can tell a
+// version of the node from one injected under its clockid. The master
+// signs the registrations, every node checks them against the key of its
+// master, which it pinned when it registered.
+package engine3
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// how a version is signed, seen from the receiving node
+type signature int
+
+const (
+	sigValid   signature = iota // signed with the registered key
+	sigNone                     // neither a registered key nor a signature
+	sigMissing                  // the clock has a key, the version no signature
+	sigUnknown                  // signed, but no key is registered for the clock
+	sigInvalid                  // the signature does not match the registered key
+)
+
+func (s signature) String() string {
+
+	switch s {
+	case sigValid:
+		return "valid"
+	case sigNone:
+		return "none"
+	case sigMissing:
+		return "missing"
+	case sigUnknown:
+		return "unknown key"
+	case sigInvalid:
+		return "invalid"
+	}
+	return fmt.Sprintf("signature(%d)", int(s))
+}
+
+/* the signed message of a version
+ *
+ * url and cval are length-prefixed, clockid and tsn follow in big endian.
+ * A delete is signed with an empty cval.
+ */
+func signedMessage(url string, cval []byte, clockid int64, tsn int64) []byte {
+
+	msg := make([]byte, 0, 4+len(url)+4+len(cval)+16)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(url)))
+	msg = append(msg, url...)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(cval)))
+	msg = append(msg, cval...)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(clockid))
+	msg = binary.BigEndian.AppendUint64(msg, uint64(tsn))
+
+	return msg
+}
+
+// check a signature against the key registered for the clock (nil for none)
+func checkSignature(key ed25519.PublicKey, url string, cval []byte, clockid int64, tsn int64, sig []byte) signature {
+
+	switch {
+	case key == nil && len(sig) == 0:
+		return sigNone
+	case key == nil:
+		return sigUnknown
+	case len(sig) == 0:
+		return sigMissing
+	case !ed25519.Verify(key, signedMessage(url, cval, clockid, tsn), sig):
+		return sigInvalid
+	}
+	return sigValid
+}
+
+// the public key in the registration data of a node, nil if there is none
+func registeredKey(data []byte) ed25519.PublicKey {
+	var s Systems
+
+	if json.Unmarshal(data, &s) != nil || len(s.PublicKey) != ed25519.PublicKeySize {
+		return nil
+	}
+	return s.PublicKey
+}
+
+// add the public key to the registration data of a node
+func withPublicKey(data []byte, key ed25519.PublicKey) ([]byte, error) {
+	var fields map[string]json.RawMessage
+
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("engine3: registration data: %w", err)
+	}
+	if fields == nil {
+		return nil, errors.New("engine3: registration data is no JSON object")
+	}
+
+	pk, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	fields["public_key"] = pk
+
+	return json.Marshal(fields)
+}
+
+// a signature as a bytea parameter (NULL for none)
+func sigParam(sig []byte) interface{} {
+
+	if len(sig) == 0 {
+		return nil
+	}
+	return sig
+}
+
+// Calling database stored functions
+
+// read a private key file (the hex encoded seed), nil if there is none
+func readKeyFile(path string) (ed25519.PrivateKey, error) {
+
+	text, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("engine3: signing key: %w", err)
+	}
+
+	// the error names the file, never its content
+	seed, err := hex.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("engine3: signing key %s: no Ed25519 seed", path)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// write a new private key file, readable by the owner only
+//
+// an existing file is never overwritten, it fails with fs.ErrExist
+func writeKeyFile(path string, key ed25519.PrivateKey) error {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("engine3: signing key: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("engine3: signing key: %w", err)
+	}
+
+	_, err = fmt.Fprintln(f, hex.EncodeToString(key.Seed()))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("engine3: signing key: %w", err)
+	}
+
+	return nil
+}
+
+/*
+ * move a private key kept in the database before (migration 17) to the
+ * key file
+ *
+ * the setting is removed in the transaction, which is committed only
+ * after the file was written
+ */
+func takeDatabaseKey(ctx context.Context, dbconnect *sql.DB, path string) (ed25519.PrivateKey, error) {
+
+	var key ed25519.PrivateKey
+
+	err := inTx(ctx, dbconnect, "take signing key", func(tx *sql.Tx) error {
+		var seed []byte
+
+		row := tx.QueryRowContext(ctx, "select nodes.take_signing_key()")
+		checkRow(row)
+
+		if err := row.Scan(&seed); err != nil {
+			return wrapErr("nodes.take_signing_key", err)
+		}
+		if seed == nil {
+			return nil
+		}
+		if len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("engine3: signing key of %d bytes", len(seed))
+		}
+
+		key = ed25519.NewKeyFromSeed(seed)
+		return writeKeyFile(path, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if key != nil {
+		logger(ctx).Info("moved signing key out of the database", "file", path)
+	}
+	return key, nil
+}
+
+// the private key of the node, nil if it has none
+//
+// read from the key file once; a key still kept in the database is moved
+// to the file
+func (db *Database) signingKey(ctx context.Context) (ed25519.PrivateKey, error) {
+
+	db.keyMu.Lock()
+	defer db.keyMu.Unlock()
+
+	if db.keyRead || db.keyFile == "" {
+		return db.key, nil
+	}
+
+	key, err := readKeyFile(db.keyFile)
+	if err == nil && key == nil {
+		key, err = takeDatabaseKey(ctx, db.dbconnect, db.keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	db.key, db.keyRead = key, true
+	return key, nil
+}
+
+// the private key of the node, a new one if it has none yet
+func (db *Database) createSigningKey(ctx context.Context) (ed25519.PrivateKey, error) {
+
+	key, err := db.signingKey(ctx)
+	if err != nil || key != nil {
+		return key, err
+	}
+	if db.keyFile == "" {
+		return nil, fmt.Errorf("engine3: no key file for the signing key of %s", db.name)
+	}
+
+	_, key, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("engine3: generate signing key: %w", err)
+	}
+
+	db.keyMu.Lock()
+	defer db.keyMu.Unlock()
+
+	// another process may have written a key first
+	if err := writeKeyFile(db.keyFile, key); errors.Is(err, fs.ErrExist) {
+		if key, err = readKeyFile(db.keyFile); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		logger(ctx).Info("created signing key", "file", db.keyFile)
+	}
+
+	db.key, db.keyRead = key, true
+	return key, nil
+}
+
+// the public key of the master, which signs the registrations, nil if
+// it is not known
+func registryKey(ctx context.Context, q querier) (ed25519.PublicKey, error) {
+
+	var key []byte
+
+	row := q.QueryRowContext(ctx, "select nodes.registry_key()")
+	checkRow(row)
+
+	if err := row.Scan(&key); err != nil {
+		return nil, wrapErr("nodes.registry_key", err)
+	}
+	if key == nil {
+		return nil, nil
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("engine3: registry key of %d bytes", len(key))
+	}
+
+	return key, nil
+}
+
+// pin the public key of the master
+func setRegistryKey(ctx context.Context, q querier, key ed25519.PublicKey) error {
+
+	_, err := q.ExecContext(ctx, "select nodes.set_registry_key( $1 )", []byte(key))
+
+	return wrapErr("nodes.set_registry_key", err)
+}
+
+// add the signature of a version or delete (clockid, tsn)
+func sign(ctx context.Context, q querier, in_table string, in_clockid int64, in_tsn int64, in_sig []byte) error {
+
+	_, err := q.ExecContext(ctx, "select nodes.sign( $1, $2, $3, $4 )", in_table, in_clockid, in_tsn, in_sig)
+
+	return wrapErr("nodes.sign "+in_table, err)
+}
+
+/*
+ * sign a version written by this node
+ *
+ * nothing is signed without a key, and neither versions of other nodes nor
+ * versions which are signed already (an unchanged document)
+ */
+func signThing(ctx context.Context, q querier, key ed25519.PrivateKey, in_table string, t *Thing) error {
+
+	if len(t.Sig) > 0 || key == nil {
+		return nil
+	}
+
+	myclockid, err := getMyClockID(ctx, q)
+	if err != nil {
+		return err
+	}
+	if t.ClockID != myclockid {
+		return nil
+	}
+
+	sig := ed25519.Sign(key, signedMessage(t.URL, t.CVal, t.ClockID, t.TSN))
+	if err := sign(ctx, q, in_table, t.ClockID, t.TSN, sig); err != nil {
+		return err
+	}
+
+	t.Sig = sig
+	return nil
+}
+
+// sign the registration of a node (in the database of the registry): with
+// the key of the master for a new node, with its own key for an update
+func signNode(ctx context.Context, q querier, key ed25519.PrivateKey, in_clockid int64) error {
+
+	t, err := getNode(ctx, q, in_clockid)
+	if err != nil {
+		return err
+	}
+
+	return sign(ctx, q, systemsTable, t.ClockID, t.TSN, ed25519.Sign(key, signedMessage(t.URL, t.CVal, t.ClockID, t.TSN)))
+}
+
+// the public key registered for a clock, nil if there is none
+func publicKey(ctx context.Context, q querier, in_clockid int64) (ed25519.PublicKey, error) {
+
+	t, err := getNode(ctx, q, in_clockid)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return registeredKey(t.Data), nil
+}
+
+/*
+ * check the signature of an incoming version or delete against the key
+ * registered for its clock in q
+ *
+ * a wrong signature and a missing one of a clock with a key are always
+ * refused; an unsigned version of a clock without key, or a version signed
+ * with an unknown key, only in strict mode. A registration, which brings
+ * the key of a clock without one, has to be signed by the master; the
+ * master may sign an update of a registration as well.
+ */
+func acceptSigned(ctx context.Context, q querier, policy syncPolicy, table string, url string, cval []byte,
+	clockid int64, tsn int64, sig []byte, data []byte, stats *SyncStats) (bool, error) {
+
+	key, err := publicKey(ctx, q, clockid)
+	if err != nil {
+		return false, err
+	}
+
+	var registry ed25519.PublicKey
+	if table == systemsTable {
+		if registry, err = registryKey(ctx, q); err != nil {
+			return false, err
+		}
+	}
+
+	log := logger(ctx).With("table", table, "url", url, "clockid", clockid, "tsn", tsn)
+
+	// a new key is taken in only, if the master certified it
+	if key == nil && table == systemsTable && registeredKey(data) != nil {
+		if s := checkSignature(registry, url, cval, clockid, tsn, sig); s != sigValid {
+			log.Error("refused registration not signed by the master", "signature", s)
+			stats.Rejected++
+			return false, nil
+		}
+		return true, nil
+	}
+
+	s := checkSignature(key, url, cval, clockid, tsn, sig)
+	if s != sigValid && registry != nil && checkSignature(registry, url, cval, clockid, tsn, sig) == sigValid {
+		s = sigValid
+	}
+
+	switch {
+	case s == sigValid:
+		return true, nil
+	case s == sigNone && !policy.strict:
+		return true, nil
+	}
+
+	log = log.With("signature", s)
+	if s == sigInvalid || s == sigMissing || policy.strict {
+		log.Error("refused version without valid signature")
+		stats.Rejected++
+		return false, nil
+	}
+
+	log.Warn("version without valid signature")
+	return true, nil
+}
+
+//
+// PACKAGE EXPORTS
+
+// Read the public key of the node
+//
+// The key is created, when the node is registered. A node without key
+// returns an error wrapping ErrNotFound.
+//
+// Package Export
+func (db *Database) PublicKey() (ed25519.PublicKey, error) {
+	return db.PublicKeyContext(context.Background())
+}
+
+// Read the public key of the node
+//
+// Package Export
+func (db *Database) PublicKeyContext(ctx context.Context) (ed25519.PublicKey, error) {
+
+	key, err := db.signingKey(db.withLogger(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, notFound("signing key")
+	}
+
+	return key.Public().(ed25519.PublicKey), nil
+}
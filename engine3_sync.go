@@ -7,26 +7,23 @@
 package engine3
 
 import (
+	"context"
+	"crypto/ed25519"
 	"database/sql"
 	"errors"
-	"fmt"
 	_ "github.com/lib/pq"
-	//"log"
-	//	"os"
-	//	"strings"
-	//	"sync"
 )
 
 type HighWaterMark struct {
-	clockid int64
-	tsn     int64
+	ClockID int64 `json:"clockid"`
+	TSN     int64 `json:"tsn"`
 }
 
 type Oplog struct {
-	table_name string
-	clockid    int64
-	tsn        int64
-	op         string
+	Table   string `json:"table"`
+	ClockID int64  `json:"clockid"`
+	TSN     int64  `json:"tsn"`
+	Op      string `json:"op"` // I, U or D
 }
 
 type HighWaterMarks []HighWaterMark
@@ -38,24 +35,25 @@ type Oplogs []Oplog
  * $1  clockid
  * $2  tsn
  */
-func rowsToHighWaterMarks(rows *sql.Rows) HighWaterMarks {
+func rowsToHighWaterMarks(ctx context.Context, rows *sql.Rows) (HighWaterMarks, error) {
 	var (
 		hwm    HighWaterMark
 		result []HighWaterMark
-		err    error
 	)
 
-	checkRows("HighWaterMarks", rows)
 	for i := 0; rows.Next(); i++ {
-		err := rows.Scan(&hwm.clockid, &hwm.tsn)
-		checkErr("scan high water mark", err)
+		err := rows.Scan(&hwm.ClockID, &hwm.TSN)
+		if err != nil {
+			return nil, wrapErr("scan high water mark", err)
+		}
 		result = append(result, hwm)
 	}
-	err = rows.Err()
-	checkErr("end loop", err)
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("read high water marks", err)
+	}
 
-	fmt.Printf("returning HWM: %d rows\n", len(result))
-	return result
+	logger(ctx).Debug("read high water marks", "rows", len(result))
+	return result, nil
 }
 
 /* read sql Rows into oplog structure
@@ -66,155 +64,500 @@ func rowsToHighWaterMarks(rows *sql.Rows) HighWaterMarks {
  * $3  tsn
  * $4  op(code) (I, U, D)
  */
-func rowsToOplogs(rows *sql.Rows) Oplogs {
+func rowsToOplogs(ctx context.Context, rows *sql.Rows) (Oplogs, error) {
 	var (
 		ol     Oplog
 		result Oplogs
-		err    error
 	)
 
-	checkRows("Oplogs", rows)
 	for i := 0; rows.Next(); i++ {
-		err := rows.Scan(&ol.table_name, &ol.clockid, &ol.tsn, &ol.op)
-		checkErr("scan operation log", err)
+		err := rows.Scan(&ol.Table, &ol.ClockID, &ol.TSN, &ol.Op)
+		if err != nil {
+			return nil, wrapErr("scan operation log", err)
+		}
 
 		result = append(result, ol)
 	}
-	err = rows.Err()
-	checkErr("end loop", err)
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("read operation log", err)
+	}
 
-	fmt.Printf("returning OPS: %d rows\n", len(result))
-	return result
+	logger(ctx).Debug("read oplog", "rows", len(result))
+	return result, nil
 }
 
 // Calling database stored functions
 
-func getRemoteHighs(dbconnect *sql.DB) HighWaterMarks {
+func getRemoteHighs(ctx context.Context, q querier) (HighWaterMarks, error) {
 
 	/* select * from stored functions returns 'structure' */
-	rows, err := dbconnect.Query("select * from nodes.getRemoteHighs()")
+	rows, err := q.QueryContext(ctx, "select * from nodes.getRemoteHighs()")
+	if err != nil {
+		return nil, wrapErr("nodes.getRemoteHighs", err)
+	}
 	defer rows.Close()
 
-	checkErr("getRemoteHighs", err)
-
-	return rowsToHighWaterMarks(rows)
+	return rowsToHighWaterMarks(ctx, rows)
 }
 
 // Check high water mark for clock
-func checkHigh(dbconnect *sql.DB, in_clockid int64) int64 {
+func checkHigh(ctx context.Context, q querier, in_clockid int64) (int64, error) {
 
 	var out_tsn int64
 
-	row := dbconnect.QueryRow("select nodes.checkHigh( $1 )", in_clockid)
+	row := q.QueryRowContext(ctx, "select nodes.checkHigh( $1 )", in_clockid)
 	checkRow(row)
 
 	err := row.Scan(&out_tsn)
 
-	checkErr("nodes.checkHigh", err)
-
-	return out_tsn
+	return out_tsn, wrapErr("nodes.checkHigh", err)
 }
 
-func getOpLogs(dbconnect *sql.DB, in_clockid int64, in_tsn int64) Oplogs {
+func getOpLogs(ctx context.Context, q querier, in_clockid int64, in_tsn int64) (Oplogs, error) {
 
 	/* select * from stored functions returns 'structure' */
-	rows, err := dbconnect.Query("select * from nodes.getOplogTail( $1, $2)", in_clockid, in_tsn)
+	rows, err := q.QueryContext(ctx, "select * from nodes.getOplogTail( $1, $2)", in_clockid, in_tsn)
+	if err != nil {
+		return nil, wrapErr("nodes.getOplogTail", err)
+	}
 	defer rows.Close()
 
-	checkErr("get op logs", err)
+	return rowsToOplogs(ctx, rows)
+}
+
+// lock a clock for a replay until the end of the transaction of q
+func lockClock(ctx context.Context, q querier, in_clockid int64) error {
+
+	_, err := q.ExecContext(ctx, "select nodes.lock_clock( $1 )", in_clockid)
+
+	return wrapErr("nodes.lock_clock", err)
+}
+
+// raise the high water mark for a (remote) clock, it never moves back
+func putRemoteHigh(ctx context.Context, q querier, in_clockid int64, in_tsn int64) error {
+
+	_, err := q.ExecContext(ctx, "select nodes.putRemoteHigh( $1, $2 )", in_clockid, in_tsn)
+
+	return wrapErr("nodes.putRemoteHigh", err)
+}
+
+// Counters of one synchronization round
+type SyncStats struct {
+	Applied   int // rows written with ae_put or ae_replace
+	Deleted   int // tombstones applied with ae_tombstone
+	Skipped   int // oplog entries already applied, without a (current) row or managed table
+	Conflicts int // concurrent versions handed to the ConflictResolver
+	Diverged  int // buckets with different digests (SyncDigestFrom)
+	Rejected  int // versions refused for their digests or signatures
+}
 
-	return rowsToOplogs(rows)
+// how incoming versions are handled
+type syncPolicy struct {
+	resolver ConflictResolver
+	strict   bool               // refuse versions with mismatching digests or without valid signature
+	key      ed25519.PrivateKey // signs merged versions, nil: none
+}
+
+// the sync policy of the database
+func (db *Database) syncPolicy(ctx context.Context) (syncPolicy, error) {
+
+	key, err := db.signingKey(ctx)
+
+	return syncPolicy{resolver: db.conflictResolver(), strict: db.strict.Load(), key: key}, err
+}
+
+// make every table managed on dbconnect1 managed on dbconnect2 as well
+func syncManagedTables(ctx context.Context, dbconnect1 *sql.DB, dbconnect2 *sql.DB) (map[string]bool, error) {
+
+	managed := map[string]bool{}
+
+	local, err := getManagedTables(ctx, dbconnect2)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range local {
+		managed[name] = true
+	}
+
+	remote, err := getManagedTables(ctx, dbconnect1)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range remote {
+		if !managed[name] {
+			if err := createManagedTable(ctx, dbconnect2, name); err != nil {
+				return nil, err
+			}
+			managed[name] = true
+		}
+	}
+
+	return managed, nil
 }
 
 /*
- * Enti-entropy sync from dbconnect1 to dbconnect2
- * (test)
+ * apply a remote version t of a url in tx
+ *
+ * ae_put writes t, unless the url is held by another clock. Then the
+ * version vectors decide: a local version t is derived from is replaced,
+ * a local version derived from t is kept, concurrent versions go to the
+ * resolver. Without vectors, the local version is replaced, if dbconnect1
+ * had seen it when t was written.
+ *
+ * in strict mode a version with mismatching digests is refused, a version
+ * with a wrong signature is refused always (see acceptSigned)
  */
-func databaseSync(dbconnect1 *sql.DB, dbconnect2 *sql.DB) {
-	var hwms1 HighWaterMarks
-	var hwms2 HighWaterMarks
-	var oplogs1 Oplogs
-	var oplogs2 Oplogs
-
-	hwms1 = getRemoteHighs(dbconnect1)
+func applyThing(ctx context.Context, dbconnect1 querier, tx *sql.Tx, policy syncPolicy,
+	table string, t Thing, stats *SyncStats) error {
+
+	if bad := checkDigests(t); len(bad) > 0 {
+		log := logger(ctx).With("table", table, "url", t.URL, "clockid", t.ClockID, "tsn", t.TSN, "mismatch", bad)
+		if policy.strict {
+			log.Error("refused version with mismatching digests")
+			stats.Rejected++
+			return nil
+		}
+		log.Warn("version with mismatching digests")
+	}
 
-	fmt.Printf("HWM 2 received: %d rows\n", len(hwms2))
-	for i, hwm := range hwms1 {
-		fmt.Printf("HWM %d %v\n", i, hwm)
+	if ok, err := acceptSigned(ctx, tx, policy, table, t.URL, t.CVal, t.ClockID, t.TSN, t.Sig, t.Data, stats); err != nil || !ok {
+		return err
 	}
 
-	hwms2 = getRemoteHighs(dbconnect2)
+	status, err := ae_put(ctx, tx, table, t)
+	if err != nil {
+		return err
+	}
 
-	fmt.Printf("HWM 1 received: %d rows\n", len(hwms2))
-	for i, hwm := range hwms2 {
-		fmt.Printf("HWM %d %v\n", i, hwm)
+	switch status {
+	case aeApplied:
+		stats.Applied++
+		return nil
+	case aeSkipped:
+		stats.Skipped++
+		return nil
 	}
 
-	oplogs2 = getOpLogs(dbconnect2, 0, 0)
-	fmt.Printf("OPS received: %d rows\n", len(oplogs2))
-	for i, ol := range oplogs2 {
-		fmt.Printf("2: OPS %d %v\n", i, ol)
+	local, ok, err := getThing(ctx, tx, table, t.URL)
+	if err != nil {
+		return err
+	}
+	if ok {
+		order, err := causalOrder(ctx, dbconnect1, local, t)
+		if err != nil {
+			return err
+		}
+		switch order {
+		case Concurrent:
+			stats.Conflicts++
+			return resolveConflict(ctx, tx, policy, table, local, t)
+		case Equal, After:
+			// the local version is derived from t
+			stats.Skipped++
+			return nil
+		}
 	}
 
-	oplogs1 = getOpLogs(dbconnect1, 0, 0)
-	fmt.Printf("1: OPS received: %d rows\n", len(oplogs1))
-	for i, ol := range oplogs1 {
-		fmt.Printf("OPS %d %v\n", i, ol)
+	if err := ae_replace(ctx, tx, table, t); err != nil {
+		return err
 	}
 
+	stats.Applied++
+	return nil
 }
 
+// the order of the local version and the remote version t
 //
-// PACKAGE EXPORTS
+// without version vectors the local version is taken as Before t, if
+// dbconnect1 had seen it, and as Concurrent otherwise
+func causalOrder(ctx context.Context, dbconnect1 querier, local Thing, t Thing) (Ordering, error) {
 
-// Read received HighWaterMarks for remote nodes
-//
-// Package Export
-func (db *Database) GetRemoteHighs() (hwms HighWaterMarks, err error) {
+	if hasVersionVectors(local, t) {
+		return Compare(local, t), nil
+	}
+
+	seen, err := checkHigh(ctx, dbconnect1, local.ClockID)
+	if err != nil {
+		return Concurrent, err
+	}
+	if seen < local.TSN {
+		return Concurrent, nil
+	}
+	return Before, nil
+}
+
+// the oplog entries replayed from one page
+const syncBatch = DefaultOplogBatch
+
+/*
+ * replay the oplog tail of one clock from dbconnect1 into tx
+ *
+ * returns the last replayed tsn
+ */
+func syncClock(ctx context.Context, dbconnect1 *sql.DB, tx *sql.Tx, managed map[string]bool,
+	policy syncPolicy, in_clockid int64, high int64, stats *SyncStats) (int64, error) {
+
+	// page by page, oldest first
+	c := newOplogCursor(nil, in_clockid, high, syncBatch)
+	for {
+		oplogs, err := c.next(ctx, dbconnect1)
+		if err != nil {
+			return high, err
+		}
+		if len(oplogs) == 0 {
+			return high, nil
+		}
+
+		if high, err = replayOplogs(ctx, dbconnect1, tx, managed, policy, oplogs, high, stats); err != nil {
+			return high, err
+		}
+	}
+}
+
+// replay a page of oplog entries, returns the last replayed tsn
+func replayOplogs(ctx context.Context, dbconnect1 *sql.DB, tx *sql.Tx, managed map[string]bool,
+	policy syncPolicy, oplogs Oplogs, high int64, stats *SyncStats) (int64, error) {
 
-	defer func() {
+	for _, ol := range oplogs {
 
-		if r := recover(); r != nil {
-			// recover from panic
-			err = errors.New("error while getting remote high water marks")
+		log := logger(ctx).With("clockid", ol.ClockID, "tsn", ol.TSN, "table", ol.Table, "op", ol.Op)
 
+		if !managed[ol.Table] {
+			log.Debug("skip unmanaged table")
+			stats.Skipped++
+			continue
 		}
 
-	}()
+		switch ol.Op {
+		case "I", "U":
+			t, ok, err := ae_get(ctx, dbconnect1, ol.Table, ol.ClockID, ol.TSN)
+			if err != nil {
+				return high, err
+			}
+			if !ok {
+				// overwritten by a later version, which is replayed later
+				log.Debug("skip overwritten version")
+				stats.Skipped++
+				break
+			}
+			if err := applyThing(ctx, dbconnect1, tx, policy, ol.Table, t, stats); err != nil {
+				return high, err
+			}
+			log.Debug("applied", "url", t.URL)
+		case "D":
+			ts, ok, err := getTombstone(ctx, dbconnect1, ol.Table, ol.ClockID, ol.TSN)
+			if err != nil {
+				return high, err
+			}
+			if !ok {
+				// collected already
+				log.Debug("skip collected tombstone")
+				stats.Skipped++
+				break
+			}
+			if err := applyTombstone(ctx, tx, policy, ts, stats); err != nil {
+				return high, err
+			}
+			log.Debug("deleted", "url", ts.url)
+		}
 
-	hwms = getRemoteHighs(db.dbconnect)
-	return hwms, err
+		if ol.TSN > high {
+			high = ol.TSN
+		}
+	}
+
+	return high, nil
+}
+
+/*
+ * Anti-entropy sync from dbconnect1 to dbconnect2
+ *
+ * Managed tables missing on dbconnect2 are created first. Then for every
+ * clock known to dbconnect1 the oplog tail after the high water
+ * mark of dbconnect2 is replayed in tsn order: inserts and updates are
+ * read with ae_get_<table> and written with ae_put_<table>, deletes are
+ * replayed from their tombstones with ae_tombstone. Concurrent versions of a url are
+ * decided by the resolver and recorded in nodes.conflicts. Afterwards the
+ * high water mark of dbconnect2 is advanced to the last replayed tsn.
+ *
+ * Every clock is replayed in its own transaction on dbconnect2, so that
+ * the high water mark never runs ahead of the data.
+ *
+ * A remote, whose oplog no longer has the chain heads seen at the last
+ * sync, rewrote its history: the sync fails with ErrHistoryRewritten.
+ * If dbconnect2 has not seen the entries the retention of the remote
+ * removed, it fails with ErrResyncRequired.
+ */
+func databaseSync(ctx context.Context, dbconnect1 *sql.DB, dbconnect2 *sql.DB, policy syncPolicy) (SyncStats, error) {
+	var stats SyncStats
+
+	// local deletes are logged with the local clockid
+	if _, err := getMyClockID(ctx, dbconnect2); err != nil {
+		return stats, err
+	}
+
+	// the history of the remote must extend the one seen at the last sync
+	peer, err := getMyClockID(ctx, dbconnect1)
+	registered := err == nil
+	if err != nil && !errors.Is(err, ErrNotRegistered) {
+		return stats, err
+	}
+
+	var heads1 []chainHead
+	if registered {
+		if err := checkPeerChains(ctx, dbconnect1, dbconnect2, peer, policy.strict); err != nil {
+			return stats, err
+		}
+		if heads1, err = getChainHeads(ctx, dbconnect1); err != nil {
+			return stats, err
+		}
+	}
+
+	managed, err := syncManagedTables(ctx, dbconnect1, dbconnect2)
+	if err != nil {
+		return stats, err
+	}
+
+	hwms1, err := getRemoteHighs(ctx, dbconnect1)
+	if err != nil {
+		return stats, err
+	}
+
+	if err := checkRetention(ctx, dbconnect1, dbconnect2, hwms1); err != nil {
+		return stats, err
+	}
+
+	for _, hwm := range hwms1 {
+
+		high, err := checkHigh(ctx, dbconnect2, hwm.ClockID)
+		if err != nil {
+			return stats, err
+		}
+		logger(ctx).Debug("high water mark", "clockid", hwm.ClockID, "tsn", hwm.TSN, "local_tsn", high)
+
+		if hwm.TSN <= high {
+			continue
+		}
+
+		tx, err := dbconnect2.BeginTx(ctx, nil)
+		if err != nil {
+			return stats, wrapErr("begin sync", err)
+		}
+
+		// a sync with another peer may have replayed the clock meanwhile
+		err = lockClock(ctx, tx, hwm.ClockID)
+		if err == nil {
+			high, err = checkHigh(ctx, tx, hwm.ClockID)
+		}
+		if err == nil && hwm.TSN <= high {
+			tx.Rollback()
+			continue
+		}
+
+		if err == nil {
+			high, err = syncClock(ctx, dbconnect1, tx, managed, policy, hwm.ClockID, high, &stats)
+		}
+		if err == nil {
+			err = putRemoteHigh(ctx, tx, hwm.ClockID, high)
+		}
+		if err != nil {
+			tx.Rollback()
+			return stats, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return stats, wrapErr("commit sync", err)
+		}
+	}
+
+	// remember what the remote has seen, for collecting tombstones, and its
+	// chain heads, for the next sync
+	if registered {
+		for _, hwm := range hwms1 {
+			if err := putPeerHigh(ctx, dbconnect2, peer, hwm.ClockID, hwm.TSN); err != nil {
+				return stats, err
+			}
+		}
+		for _, h := range heads1 {
+			if err := putPeerChainHead(ctx, dbconnect2, peer, h); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	logger(ctx).Info("sync round", "applied", stats.Applied, "deleted", stats.Deleted, "skipped", stats.Skipped,
+		"conflicts", stats.Conflicts, "rejected", stats.Rejected)
+	return stats, nil
 }
 
-// Check HighWater mark on remote node (with cutoff value)
+//
+// PACKAGE EXPORTS
+
+// Read received HighWaterMarks for remote nodes
 //
 // Package Export
-func (db *Database) CheckHigh(in_clockid int64) (out_tsn int64, err error) {
+func (db *Database) GetRemoteHighs() (HighWaterMarks, error) {
+	return db.GetRemoteHighsContext(context.Background())
+}
 
-	defer func() {
+// Read received HighWaterMarks for remote nodes
+//
+// Package Export
+func (db *Database) GetRemoteHighsContext(ctx context.Context) (HighWaterMarks, error) {
+	return getRemoteHighs(db.withLogger(ctx), db.dbconnect)
+}
 
-		if r := recover(); r != nil {
-			// recover from panic
-			err = errors.New("error while getting remote high water marks")
+// Check HighWater mark on remote node (with cutoff value)
+//
+// Package Export
+func (db *Database) CheckHigh(in_clockid int64) (int64, error) {
+	return db.CheckHighContext(context.Background(), in_clockid)
+}
 
-		}
+// Check HighWater mark on remote node (with cutoff value)
+//
+// Package Export
+func (db *Database) CheckHighContext(ctx context.Context, in_clockid int64) (int64, error) {
+	return checkHigh(ctx, db.dbconnect, in_clockid)
+}
 
-	}()
-	out_tsn = checkHigh(db.dbconnect, in_clockid)
-	return
+// Read the oplog tail after tsn (for all clocks with clockid 0)
+//
+// The tail is read at once and returned newest first; OplogCursor reads
+// it in pages, oldest first.
+//
+// Package Export
+func (db *Database) GetOpLogs(in_clockid int64, in_tsn int64) (Oplogs, error) {
+	return db.GetOpLogsContext(context.Background(), in_clockid, in_tsn)
+}
+
+// Read the oplog tail after tsn (for all clocks with clockid 0)
+//
+// Package Export
+func (db *Database) GetOpLogsContext(ctx context.Context, in_clockid int64, in_tsn int64) (Oplogs, error) {
+	return getOpLogs(db.withLogger(ctx), db.dbconnect, in_clockid, in_tsn)
 }
 
-func (db *Database) GetOpLogs(in_clockid int64, in_tsn int64) (out_ols Oplogs, err error) {
+// Pull all changes from a remote database into this one
+//
+// Package Export
+func (db *Database) SyncFrom(remote *Database) (SyncStats, error) {
+	return db.SyncFromContext(context.Background(), remote)
+}
 
-	defer func() {
+// Pull all changes from a remote database into this one
+//
+// Concurrent updates are decided by the ConflictResolver of db.
+//
+// Package Export
+func (db *Database) SyncFromContext(ctx context.Context, remote *Database) (SyncStats, error) {
 
-		if r := recover(); r != nil {
-			// recover from panic
-			err = errors.New("error while oplog")
+	ctx = db.withLogger(ctx)
 
-		}
+	policy, err := db.syncPolicy(ctx)
+	if err != nil {
+		return SyncStats{}, err
+	}
 
-	}()
-	out_ols = getOpLogs(db.dbconnect, in_clockid, in_tsn)
-	return
+	return databaseSync(ctx, remote.dbconnect, db.dbconnect, policy)
 }
@@ -4,8 +4,13 @@
 //
 package engine3
 
-import ()
+import (
+	"crypto/ed25519"
+)
 
 type Systems struct {
 	Name string
+
+	// the key the node signs its versions with (set on registration)
+	PublicKey ed25519.PublicKey `json:"public_key,omitempty"`
 }
@@ -5,8 +5,33 @@
 package engine3
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 var dbname0 = "master"
@@ -22,7 +47,7 @@ func jsonSystems_Nodes() []byte {
 func TestInit(t *testing.T) {
 
 	fmt.Printf("INIT:\n")
-	_, err := GetDatabase(dbname0)
+	_, err := GetDatabase(dbname0, AutoMigrate(), RequireSchema())
 
 	if err != nil {
 		fmt.Printf("PANIC %#v\n", err)
@@ -31,7 +56,7 @@ func TestInit(t *testing.T) {
 
 	fmt.Printf("Connect to database %v\n", dbname0)
 
-	_, err = GetDatabase(dbname1)
+	_, err = GetDatabase(dbname1, AutoMigrate(), RequireSchema())
 
 	if err != nil {
 		fmt.Printf("PANIC %#v\n", err)
@@ -40,7 +65,7 @@ func TestInit(t *testing.T) {
 
 	fmt.Printf("Connect to database %v\n", dbname1)
 
-	_, err = GetDatabase(dbname2)
+	_, err = GetDatabase(dbname2, AutoMigrate(), RequireSchema())
 
 	if err != nil {
 		fmt.Printf("PANIC %#v\n", err)
@@ -50,6 +75,38 @@ func TestInit(t *testing.T) {
 	fmt.Printf("Connect to database %v\n", dbname2)
 }
 
+func TestMigrate(t *testing.T) {
+
+	fmt.Printf("MIGRATE:\n")
+	db, err := GetDatabase(dbname1)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// all migrations are applied by TestInit, a second run does nothing
+	applied, err := db.Migrate()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if applied != 0 {
+		fmt.Printf("MIGRATE applied %d migrations again\n", applied)
+		t.Fail()
+	}
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if version != RequiredSchemaVersion() {
+		fmt.Printf("SCHEMA version %d, required %d\n", version, RequiredSchemaVersion())
+		t.Fail()
+	}
+}
+
 func TestRegister(t *testing.T) {
 
 	var id int64
@@ -232,7 +289,47 @@ func TestSync(t *testing.T) {
 		t.FailNow()
 	}
 
-	databaseSync(db2.dbconnect, db1.dbconnect)
+	stats, err := databaseSync(context.Background(), db2.dbconnect, db1.dbconnect, syncPolicy{resolver: LastWriterWins()})
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("SYNC stats %+v\n", stats)
+}
+
+func TestSyncFrom(t *testing.T) {
+
+	fmt.Printf("SYNC FROM:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	stats, err := db2.SyncFrom(master)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("SYNC FROM %v: %+v\n", dbname0, stats)
+
+	// a second round has nothing to do
+	stats, err = db2.SyncFrom(master)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if stats.Applied != 0 || stats.Deleted != 0 {
+		fmt.Printf("SYNC FROM second round not empty: %+v\n", stats)
+		t.Fail()
+	}
 }
 
 func TestSync_ae_001(t *testing.T) {
@@ -244,5 +341,2808 @@ func TestSync_ae_001(t *testing.T) {
 		fmt.Printf("PANIC %#v\n", err1)
 		t.FailNow()
 	}
-	_ = ae_get(db1.dbconnect, "systems", 1, 1)
+	_, _, err := ae_get(context.Background(), db1.dbconnect, "systems", 1, 1)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+}
+
+func TestThings(t *testing.T) {
+
+	fmt.Printf("THINGS:\n")
+	db, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	thing, err := db.PutThing("systems", "thing.towerpower.co", jsonSystems_Nodes())
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("PUT %v %d/%d\n", thing.URL, thing.ClockID, thing.TSN)
+
+	got, err := db.GetThing("systems", "thing.towerpower.co")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if got.TSN != thing.TSN || string(got.CVal) != string(thing.CVal) {
+		fmt.Printf("GET returned %v, expected %v\n", got, thing)
+		t.Fail()
+	}
+
+	// an unchanged put does not create a new version
+	again, err := db.PutThing("systems", "thing.towerpower.co", jsonSystems_Nodes())
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if again.TSN != thing.TSN {
+		fmt.Printf("unchanged PUT got new tsn %d\n", again.TSN)
+		t.Fail()
+	}
+
+	things, err := db.ListThings("systems")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("LIST systems: %d things\n", len(things))
+
+	err = db.DeleteThing("systems", "thing.towerpower.co")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	_, err = db.GetThing("systems", "thing.towerpower.co")
+	if err == nil {
+		fmt.Printf("GET after DELETE succeeded\n")
+		t.Fail()
+	}
+}
+
+func TestManagedTable(t *testing.T) {
+
+	fmt.Printf("MANAGED TABLE:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// creating it again is harmless
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("no-identifier")
+	if err == nil {
+		fmt.Printf("invalid table name accepted\n")
+		t.Fail()
+	}
+
+	_, err = master.PutThing("measurements", "meter/1", []byte(`{"kwh": 42}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	_, err = db2.SyncFrom(master)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	names, err := db2.ManagedTables()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("MANAGED TABLES %v: %v\n", dbname2, names)
+
+	thing, err := db2.GetThing("measurements", "meter/1")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("SYNCED %v %s\n", thing.URL, thing.Data)
+}
+
+func TestAePutIdempotent(t *testing.T) {
+
+	fmt.Printf("AE PUT:\n")
+	ctx := context.Background()
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// two versions of a url written on the master
+	url := fmt.Sprintf("meter/replay/%d", time.Now().UnixNano())
+
+	v1, err := master.PutThing("measurements", url, []byte(`{"kwh": 1}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	v2, err := master.PutThing("measurements", url, []byte(`{"kwh": 2}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	tx, err := db2.dbconnect.BeginTx(ctx, nil)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer tx.Rollback()
+
+	other := v2
+	other.ClockID = v2.ClockID + 1000
+
+	for _, c := range []struct {
+		version Thing
+		want    aeStatus
+	}{
+		{v1, aeApplied},
+		{v1, aeSkipped}, // same version again
+		{v2, aeApplied}, // newer version of the clock
+		{v1, aeSkipped}, // older version of the clock
+		{v2, aeSkipped},
+		{other, aeConflict},
+	} {
+		status, err := ae_put(ctx, tx, "measurements", c.version)
+		if err != nil {
+			fmt.Printf("PANIC %#v\n", err)
+			t.FailNow()
+		}
+		if status != c.want {
+			fmt.Printf("AE PUT %v/%v: %v, expected %v\n", c.version.ClockID, c.version.TSN, status, c.want)
+			t.Fail()
+		}
+	}
+
+	// replaying the same oplog tail twice applies nothing the second time
+	managed := map[string]bool{"measurements": true}
+	high := v1.TSN - 1
+
+	for round := 1; round <= 2; round++ {
+		var stats SyncStats
+
+		_, err := syncClock(ctx, master.dbconnect, tx, managed, syncPolicy{resolver: LastWriterWins()}, v1.ClockID, high, &stats)
+		if err != nil {
+			fmt.Printf("PANIC %#v\n", err)
+			t.FailNow()
+		}
+		fmt.Printf("AE PUT replay %d: %+v\n", round, stats)
+		if stats.Applied != 0 || stats.Conflicts != 0 {
+			fmt.Printf("AE PUT replay %d not idempotent: %+v\n", round, stats)
+			t.Fail()
+		}
+	}
+}
+
+func TestConflict(t *testing.T) {
+
+	fmt.Printf("CONFLICT:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	before, err := db2.Conflicts(0)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	var last int64
+	if len(before) > 0 {
+		last = before[len(before)-1].ID
+	}
+
+	// both sides write the same url without seeing each other
+	url := fmt.Sprintf("meter/conflict/%d", time.Now().UnixNano())
+
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := db2.PutThing("measurements", url, []byte(`{"local": 1}`)); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := master.PutThing("measurements", url, []byte(`{"remote": 2}`)); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	db2.SetConflictResolver(MergeWith("union", func(ctx context.Context, table string, local, remote json.RawMessage) (json.RawMessage, error) {
+		return json.RawMessage(`{"local": 1, "remote": 2}`), nil
+	}))
+	defer db2.SetConflictResolver(nil)
+
+	stats, err := db2.SyncFrom(master)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("CONFLICT stats %+v\n", stats)
+	if stats.Conflicts == 0 {
+		fmt.Printf("conflict not detected\n")
+		t.Fail()
+	}
+
+	thing, err := db2.GetThing("measurements", url)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if string(thing.Data) != `{"local": 1, "remote": 2}` {
+		fmt.Printf("CONFLICT not merged: %s\n", thing.Data)
+		t.Fail()
+	}
+
+	conflicts, err := db2.Conflicts(last)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if len(conflicts) == 0 || conflicts[len(conflicts)-1].URL != url || conflicts[len(conflicts)-1].Outcome != Merged {
+		fmt.Printf("CONFLICT not recorded: %+v\n", conflicts)
+		t.Fail()
+	}
+}
+
+func TestConflictResolvers(t *testing.T) {
+
+	ctx := context.Background()
+	older := Thing{ClockID: 1, TSN: 10}
+	newer := Thing{ClockID: 2, TSN: 20}
+
+	cases := []struct {
+		resolver      ConflictResolver
+		local, remote Thing
+		want          Outcome
+	}{
+		{LastWriterWins(), older, newer, TakeRemote},
+		{LastWriterWins(), newer, older, KeepLocal},
+		{LastWriterWins(), Thing{ClockID: 1, TSN: 20}, newer, TakeRemote},
+		{MasterWins(1), older, newer, KeepLocal},
+		{MasterWins(1), newer, older, TakeRemote},
+		{MasterWins(3), older, newer, TakeRemote},
+	}
+
+	for _, c := range cases {
+		res, err := c.resolver.Resolve(ctx, "systems", c.local, c.remote)
+		if err != nil || res.Outcome != c.want {
+			t.Errorf("%s(%+v, %+v) = %v, %v: expected %v", c.resolver.Name(), c.local, c.remote, res.Outcome, err, c.want)
+		}
+	}
+
+	bad := MergeWith("bad", func(ctx context.Context, table string, local, remote json.RawMessage) (json.RawMessage, error) {
+		return json.RawMessage(`{`), nil
+	})
+	if _, err := bad.Resolve(ctx, "systems", older, newer); err == nil {
+		t.Errorf("invalid merged document accepted")
+	}
+}
+
+func TestTombstones(t *testing.T) {
+
+	fmt.Printf("TOMBSTONES:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	url := fmt.Sprintf("meter/deleted/%d", time.Now().UnixNano())
+
+	if _, err := master.PutThing("measurements", url, []byte(`{"kwh": 7}`)); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := db2.GetThing("measurements", url); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	if err := master.DeleteThing("measurements", url); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	stats, err := db2.SyncFrom(master)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("TOMBSTONES stats %+v\n", stats)
+	if stats.Deleted == 0 {
+		fmt.Printf("delete not replicated\n")
+		t.Fail()
+	}
+	if _, err := db2.GetThing("measurements", url); !errors.Is(err, ErrNotFound) {
+		fmt.Printf("deleted thing still there: %v\n", err)
+		t.Fail()
+	}
+
+	// the tombstone is applied once
+	stats, err = db2.SyncFrom(master)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if stats.Deleted != 0 {
+		fmt.Printf("tombstone applied twice: %+v\n", stats)
+		t.Fail()
+	}
+
+	// the master has passed the tombstone: db2 can collect it
+	db2.SetTombstoneRetention(time.Nanosecond)
+	defer db2.SetTombstoneRetention(0)
+
+	n, err := db2.CollectTombstones()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("TOMBSTONES collected %v\n", n)
+	if n == 0 {
+		fmt.Printf("tombstone not collected\n")
+		t.Fail()
+	}
+}
+
+func TestVersionVectors(t *testing.T) {
+
+	fmt.Printf("VERSION VECTORS:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	url := fmt.Sprintf("meter/vv/%d", time.Now().UnixNano())
+
+	v1, err := master.PutThing("measurements", url, []byte(`{"kwh": 1}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if v1.VV[v1.ClockID] != v1.TSN {
+		fmt.Printf("VV not recorded: %+v\n", v1)
+		t.Fail()
+	}
+
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// db2 changes the version it has seen
+	v2, err := db2.PutThing("measurements", url, []byte(`{"kwh": 2}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("VV %v -> %v\n", v1.VV, v2.VV)
+
+	if o := Compare(v1, v2); o != Before {
+		fmt.Printf("VV expected before, got %v\n", o)
+		t.Fail()
+	}
+}
+
+func TestCompare(t *testing.T) {
+
+	cases := []struct {
+		a, b VersionVector
+		want Ordering
+	}{
+		{VersionVector{1: 5}, VersionVector{1: 5}, Equal},
+		{VersionVector{1: 5}, VersionVector{1: 6}, Before},
+		{VersionVector{1: 5}, VersionVector{1: 5, 2: 1}, Before},
+		{VersionVector{1: 6, 2: 1}, VersionVector{1: 5}, After},
+		{VersionVector{1: 6}, VersionVector{1: 5, 2: 1}, Concurrent},
+		{VersionVector{}, VersionVector{}, Equal},
+	}
+
+	for _, c := range cases {
+		if o := c.a.Compare(c.b); o != c.want {
+			t.Errorf("%v.Compare(%v) = %v: expected %v", c.a, c.b, o, c.want)
+		}
+	}
+
+	// without vectors, versions of different clocks cannot be ordered
+	a := Thing{ClockID: 1, TSN: 5}
+	b := Thing{ClockID: 2, TSN: 9}
+	if o := Compare(a, b); o != Concurrent {
+		t.Errorf("Compare(%+v, %+v) = %v: expected concurrent", a, b, o)
+	}
+	if o := Compare(a, Thing{ClockID: 1, TSN: 7}); o != Before {
+		t.Errorf("same clock: %v", o)
+	}
+
+	merged := VersionVector{1: 6}.Merge(VersionVector{1: 5, 2: 1})
+	if merged[1] != 6 || merged[2] != 1 {
+		t.Errorf("Merge: %v", merged)
+	}
+}
+
+func TestTableDigest(t *testing.T) {
+
+	fmt.Printf("TABLE DIGEST:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	d, err := master.TableDigest("measurements", 2)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("DIGEST root %x, %v buckets\n", d.Root(), len(d.Counts))
+
+	if _, err := master.TableDigest("measurements", maxDigestDepth+1); err == nil {
+		fmt.Printf("digest depth not checked\n")
+		t.Fail()
+	}
+
+	// the levels of the database are the nodes of the tree
+	for level := 0; level <= d.Depth; level++ {
+		nodes, err := digestLevel(context.Background(), master.dbconnect, "measurements", d.Depth, "", level)
+		if err != nil {
+			fmt.Printf("PANIC %#v\n", err)
+			t.FailNow()
+		}
+		for node, hash := range nodes {
+			if !bytes.Equal(hash, d.Nodes[node]) {
+				fmt.Printf("digest level %d node %q: %x, tree %x\n", level, node, hash, d.Nodes[node])
+				t.Fail()
+			}
+		}
+	}
+	if buckets, err := divergedBuckets(context.Background(), master.dbconnect, master.dbconnect, "measurements", 2); err != nil || len(buckets) != 0 {
+		fmt.Printf("diverged from itself: %v %v\n", buckets, err)
+		t.Fail()
+	}
+
+	// a row the oplog sync has not carried over yet
+	url := fmt.Sprintf("meter/digest/%d", time.Now().UnixNano())
+
+	if _, err := master.PutThing("measurements", url, []byte(`{"kwh": 3}`)); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	stats, err := db2.SyncDigestFrom(master, 2)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("DIGEST SYNC stats %+v\n", stats)
+	if stats.Diverged == 0 || stats.Applied == 0 {
+		fmt.Printf("diverged bucket not synced\n")
+		t.Fail()
+	}
+
+	if _, err := db2.GetThing("measurements", url); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+}
+
+func TestDigestDiff(t *testing.T) {
+
+	leaves := func(nodes map[string][]byte) *Digest {
+		d := &Digest{Depth: 2, Nodes: nodes}
+		d.build()
+		return d
+	}
+
+	a := leaves(map[string][]byte{"0a": {1}, "0b": {2}, "f1": {3}})
+	b := leaves(map[string][]byte{"0a": {1}, "0b": {9}, "f1": {3}, "f2": {4}})
+
+	if bytes.Equal(a.Root(), b.Root()) {
+		t.Errorf("different trees with the same root")
+	}
+
+	diff, err := a.Diff(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(diff, ",") != "0b,f2" {
+		t.Errorf("Diff: %v", diff)
+	}
+
+	c := leaves(map[string][]byte{"0a": {1}, "0b": {2}, "f1": {3}})
+	if diff, _ := a.Diff(c); len(diff) != 0 || !bytes.Equal(a.Root(), c.Root()) {
+		t.Errorf("equal trees differ: %v", diff)
+	}
+
+	if _, err := a.Diff(&Digest{Depth: 1}); err == nil {
+		t.Errorf("depth mismatch accepted")
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	fmt.Printf("VERIFY:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	url := fmt.Sprintf("meter/corrupt/%d", time.Now().UnixNano())
+
+	if _, err := master.PutThing("measurements", url, []byte(`{"kwh": 5}`)); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.DeleteThing("measurements", url)
+
+	// an edit bypassing nodes.thing_put leaves cval behind
+	_, err = master.dbconnect.Exec(`UPDATE nodes.measurements SET data = '{"kwh": 500}', tsn = nodes.new_tsn() WHERE url = $1`, url)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	mismatches, err := master.Verify("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("VERIFY %+v\n", mismatches)
+
+	found := false
+	for _, m := range mismatches {
+		found = found || (m.URL == url && m.Field == "cval")
+	}
+	if !found {
+		fmt.Printf("corrupt row not reported\n")
+		t.Fail()
+	}
+
+	db2.SetStrictIntegrity(true)
+	defer db2.SetStrictIntegrity(false)
+
+	stats, err := db2.SyncFrom(master)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("VERIFY strict sync %+v\n", stats)
+	if stats.Rejected == 0 {
+		fmt.Printf("corrupt row not refused\n")
+		t.Fail()
+	}
+	if _, err := db2.GetThing("measurements", url); !errors.Is(err, ErrNotFound) {
+		fmt.Printf("corrupt row replicated: %v\n", err)
+		t.Fail()
+	}
+}
+
+func TestCheckDigests(t *testing.T) {
+
+	ckey := md5.Sum([]byte("meter/1"))
+	cval := md5.Sum([]byte(`{"kwh": 1}`))
+
+	good := Thing{CKey: ckey[:], CVal: cval[:], URL: "meter/1", Data: json.RawMessage(`{"kwh": 1}`)}
+	if bad := checkDigests(good); len(bad) != 0 {
+		t.Errorf("intact thing: %v", bad)
+	}
+
+	edited := good
+	edited.Data = json.RawMessage(`{"kwh": 2}`)
+	if bad := checkDigests(edited); strings.Join(bad, ",") != "cval" {
+		t.Errorf("edited data: %v", bad)
+	}
+
+	moved := good
+	moved.URL = "meter/2"
+	if bad := checkDigests(moved); strings.Join(bad, ",") != "ckey" {
+		t.Errorf("edited url: %v", bad)
+	}
+
+	// md5 digests tagged as sha256 no longer verify
+	tagged := good
+	tagged.Alg = DigestSHA256
+	if bad := checkDigests(tagged); strings.Join(bad, ",") != "ckey,cval" {
+		t.Errorf("md5 digests tagged sha256: %v", bad)
+	}
+
+	skey := sha256.Sum256([]byte("meter/1"))
+	sval := sha256.Sum256([]byte(`{"kwh": 1}`))
+	tagged.CKey, tagged.CVal = skey[:], sval[:]
+	if bad := checkDigests(tagged); len(bad) != 0 {
+		t.Errorf("intact sha256 thing: %v", bad)
+	}
+
+	tagged.Alg = "crc32"
+	if bad := checkDigests(tagged); strings.Join(bad, ",") != "alg" {
+		t.Errorf("unknown algorithm: %v", bad)
+	}
+}
+
+func TestSameDocument(t *testing.T) {
+
+	data := json.RawMessage(`{"kwh": 21}`)
+	md5sum := md5.Sum(data)
+	shasum := sha256.Sum256(data)
+
+	old := Thing{CVal: md5sum[:], Data: data}
+	tagged := Thing{CVal: md5sum[:], Data: data, Alg: DigestMD5}
+	rehashed := Thing{CVal: shasum[:], Data: data, Alg: DigestSHA256}
+	other := json.RawMessage(`{"kwh": 22}`)
+	othersum := sha256.Sum256(other)
+	changed := Thing{CVal: othersum[:], Data: other, Alg: DigestSHA256}
+
+	cases := []struct {
+		name string
+		a, b Thing
+		want bool
+	}{
+		{"md5 without alg", old, tagged, true},
+		{"other algorithm", old, rehashed, true},
+		{"changed document", old, changed, false},
+		{"same algorithm", rehashed, changed, false},
+	}
+	for _, c := range cases {
+		if got := sameDocument(c.a, c.b); got != c.want {
+			t.Errorf("%s: sameDocument = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDigestAlgorithm(t *testing.T) {
+
+	fmt.Printf("DIGEST ALGORITHM:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	if err := master.SetDigestAlgorithm("crc32"); err == nil {
+		fmt.Printf("unknown algorithm accepted\n")
+		t.Fail()
+	}
+
+	if err := master.SetDigestAlgorithm(DigestSHA256); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.SetDigestAlgorithm(DigestMD5)
+
+	url := fmt.Sprintf("meter/sha256/%d", time.Now().UnixNano())
+
+	thing, err := master.PutThing("measurements", url, []byte(`{"kwh": 7}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.DeleteThing("measurements", url)
+
+	if thing.Alg != DigestSHA256 || len(thing.CKey) != sha256.Size {
+		fmt.Printf("expected sha256 digests, got %q with %d bytes\n", thing.Alg, len(thing.CKey))
+		t.Fail()
+	}
+
+	// the md5 peer takes the sha256 row as it is
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	copied, err := db2.GetThing("measurements", url)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if copied.Alg != DigestSHA256 || !bytes.Equal(copied.CVal, thing.CVal) {
+		fmt.Printf("replicated digests changed: %+v\n", copied)
+		t.Fail()
+	}
+
+	// back to md5, the rows are converted without new versions
+	if err := master.SetDigestAlgorithm(DigestMD5); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	n, err := master.Rehash()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("REHASHED %d\n", n)
+
+	rehashed, err := master.GetThing("measurements", url)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if rehashed.Alg != DigestMD5 || rehashed.TSN != thing.TSN || len(checkDigests(rehashed)) != 0 {
+		fmt.Printf("rehash failed: %+v\n", rehashed)
+		t.Fail()
+	}
+
+	// the row was signed, it is signed again over the new cval
+	pub, err := master.PublicKey()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if len(thing.Sig) == 0 || bytes.Equal(rehashed.Sig, thing.Sig) ||
+		checkSignature(pub, rehashed.URL, rehashed.CVal, rehashed.ClockID, rehashed.TSN, rehashed.Sig) != sigValid {
+		fmt.Printf("rehashed row not signed again: %+v\n", rehashed)
+		t.Fail()
+	}
+
+	// db2 still holds the sha256 digests: the row is in the same bucket
+	// with the same digest
+	sum := md5.Sum([]byte(url))
+	bucket := hex.EncodeToString(sum[:])[:2]
+	d0, err := master.TableDigest("measurements", 2)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	d2, err := db2.TableDigest("measurements", 2)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if !bytes.Equal(d0.Nodes[bucket], d2.Nodes[bucket]) {
+		fmt.Printf("bucket %s differs across digest algorithms: %x %x\n", bucket, d0.Nodes[bucket], d2.Nodes[bucket])
+		t.Fail()
+	}
+}
+
+func TestSignatures(t *testing.T) {
+
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cval := md5.Sum([]byte(`{"kwh": 1}`))
+	sig := ed25519.Sign(key, signedMessage("meter/1", cval[:], 7, 42))
+
+	cases := []struct {
+		key  ed25519.PublicKey
+		tsn  int64
+		sig  []byte
+		want signature
+	}{
+		{pub, 42, sig, sigValid},
+		{pub, 43, sig, sigInvalid},
+		{pub, 42, nil, sigMissing},
+		{nil, 42, sig, sigUnknown},
+		{nil, 42, nil, sigNone},
+	}
+	for _, c := range cases {
+		if got := checkSignature(c.key, "meter/1", cval[:], 7, c.tsn, c.sig); got != c.want {
+			t.Errorf("checkSignature(tsn %d) = %v, want %v", c.tsn, got, c.want)
+		}
+	}
+
+	// the fields are delimited, so that they cannot be shifted
+	if bytes.Equal(signedMessage("ab", []byte("c"), 1, 1), signedMessage("a", []byte("bc"), 1, 1)) {
+		t.Errorf("signed messages of different versions are equal")
+	}
+
+	data, err := withPublicKey(jsonSystems_Nodes(), pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(registeredKey(data), pub) {
+		t.Errorf("public key not registered: %s", data)
+	}
+	if _, err := withPublicKey([]byte(`[1, 2]`), pub); err == nil {
+		t.Errorf("public key added to a JSON array")
+	}
+}
+
+func TestSignedSync(t *testing.T) {
+
+	fmt.Printf("SIGNED SYNC:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db1, err := GetDatabase(dbname1)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	for _, db := range []*Database{db1, db2} {
+		if _, err := db.SyncFrom(master); err != nil {
+			fmt.Printf("PANIC %#v\n", err)
+			t.FailNow()
+		}
+	}
+
+	pub, err := master.PublicKey()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	masterID, err := master.GetMyClockID()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	url := fmt.Sprintf("meter/signed/%d", time.Now().UnixNano())
+
+	thing, err := master.PutThing("measurements", url, []byte(`{"kwh": 3}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.DeleteThing("measurements", url)
+
+	if checkSignature(pub, thing.URL, thing.CVal, thing.ClockID, thing.TSN, thing.Sig) != sigValid {
+		fmt.Printf("version not signed: %+v\n", thing)
+		t.Fail()
+	}
+
+	// a version injected on db1 under the clockid of master
+	tsn, err := master.NewNodesTSN()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	forged := fmt.Sprintf("meter/forged/%d", time.Now().UnixNano())
+	data := []byte(`{"kwh": 999}`)
+	ckey, cval := md5.Sum([]byte(forged)), md5.Sum(data)
+
+	_, err = ae_put(context.Background(), db1.dbconnect, "measurements", Thing{
+		CKey: ckey[:], CVal: cval[:], URL: forged, Data: data,
+		ClockID: masterID, TSN: tsn, Sig: make([]byte, ed25519.SignatureSize)})
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer db1.DeleteThing("measurements", forged)
+
+	stats, err := db2.SyncFrom(db1)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("SIGNED SYNC %+v\n", stats)
+
+	if stats.Rejected == 0 {
+		fmt.Printf("forged version not rejected\n")
+		t.Fail()
+	}
+	if _, err := db2.GetThing("measurements", forged); !errors.Is(err, ErrNotFound) {
+		fmt.Printf("forged version applied: %v\n", err)
+		t.Fail()
+	}
+
+	copied, err := db2.GetThing("measurements", url)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if !bytes.Equal(copied.Sig, thing.Sig) {
+		fmt.Printf("signature not replicated: %+v\n", copied)
+		t.Fail()
+	}
+}
+
+func TestUnsignedUnderKeyedClock(t *testing.T) {
+
+	fmt.Printf("UNSIGNED UNDER KEYED CLOCK:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db1, err := GetDatabase(dbname1)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	for _, db := range []*Database{db1, db2} {
+		if _, err := db.SyncFrom(master); err != nil {
+			fmt.Printf("PANIC %#v\n", err)
+			t.FailNow()
+		}
+	}
+
+	masterID, err := master.GetMyClockID()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// an unsigned version replayed on db1 under the clockid of master, which has a key
+	tsn, err := master.NewNodesTSN()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	url := fmt.Sprintf("meter/unsigned/%d", time.Now().UnixNano())
+	data := []byte(`{"kwh": 999}`)
+	ckey, cval := md5.Sum([]byte(url)), md5.Sum(data)
+
+	_, err = ae_put(context.Background(), db1.dbconnect, "measurements", Thing{
+		CKey: ckey[:], CVal: cval[:], URL: url, Data: data, ClockID: masterID, TSN: tsn})
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer db1.DeleteThing("measurements", url)
+
+	// not strict: an unsigned version is refused all the same
+	db2.SetStrictIntegrity(false)
+
+	stats, err := db2.SyncFrom(db1)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("UNSIGNED SYNC %+v\n", stats)
+
+	if stats.Rejected == 0 {
+		fmt.Printf("unsigned version not rejected\n")
+		t.Fail()
+	}
+	if _, err := db2.GetThing("measurements", url); !errors.Is(err, ErrNotFound) {
+		fmt.Printf("unsigned version applied: %v\n", err)
+		t.Fail()
+	}
+}
+
+func TestSelfSignedRegistration(t *testing.T) {
+
+	fmt.Printf("SELF SIGNED REGISTRATION:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db1, err := GetDatabase(dbname1)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	for _, db := range []*Database{db1, db2} {
+		if _, err := db.SyncFrom(master); err != nil {
+			fmt.Printf("PANIC %#v\n", err)
+			t.FailNow()
+		}
+	}
+
+	// a node injected on db1, which vouches for its own key
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := withPublicKey(jsonSystems_Nodes(), pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clockid, err := master.NewNodesTSN()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	url := fmt.Sprintf("rogue%d.towerpower.co", time.Now().UnixNano())
+	ckey, cval := md5.Sum([]byte(url)), md5.Sum(data)
+
+	_, err = ae_put(context.Background(), db1.dbconnect, systemsTable, Thing{
+		CKey: ckey[:], CVal: cval[:], URL: url, Data: data, ClockID: clockid, TSN: clockid,
+		Sig: ed25519.Sign(priv, signedMessage(url, cval[:], clockid, clockid))})
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer db1.DeleteThing(systemsTable, url)
+
+	stats, err := db2.SyncFrom(db1)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("SELF SIGNED SYNC %+v\n", stats)
+
+	if stats.Rejected == 0 {
+		fmt.Printf("self-signed registration not rejected\n")
+		t.Fail()
+	}
+	if _, err := db2.GetNode(clockid); !errors.Is(err, ErrNotFound) {
+		fmt.Printf("self-signed registration applied: %v\n", err)
+		t.Fail()
+	}
+}
+
+func TestChainBreak(t *testing.T) {
+
+	chain := func() []chainEntry {
+		return []chainEntry{
+			{tsn: 1, prev: nil, hash: []byte("a"), valid: true},
+			{tsn: 2, prev: []byte("a"), hash: []byte("b"), valid: true},
+			{tsn: 3, prev: []byte("b"), hash: []byte("c"), valid: true},
+		}
+	}
+	head := &chainHead{clockid: 7, tsn: 3, hash: []byte("c")}
+
+	if b := chainBreak(7, chain(), nil, head); b != nil {
+		t.Errorf("intact chain: %v", b)
+	}
+	if b := chainBreak(7, nil, nil, nil); b != nil {
+		t.Errorf("empty chain: %v", b)
+	}
+
+	rewritten := chain()
+	rewritten[1].valid = false
+	removed := append(chain()[:1], chain()[2])
+	forked := append(chain(), chainEntry{tsn: 4, prev: []byte("a"), hash: []byte("d"), valid: true})
+	truncated := chain()[:2]
+
+	cases := []struct {
+		name    string
+		entries []chainEntry
+		tsn     int64
+		reason  string
+	}{
+		{"rewritten", rewritten, 2, "hash"},
+		{"removed", removed, 3, "link"},
+		{"forked", forked, 4, "fork"},
+		{"truncated", truncated, 3, "head"},
+	}
+	for _, c := range cases {
+		b := chainBreak(7, c.entries, nil, head)
+		if b == nil || b.TSN != c.tsn || b.Reason != c.reason {
+			t.Errorf("%s: got %v, want %s at %d", c.name, b, c.reason, c.tsn)
+		}
+	}
+
+	// compacted up to tsn 2: the tail starts after "b"
+	checkpoint := &oplogCheckpoint{tsn: 2, link: []byte("b")}
+	if b := chainBreak(7, removed, checkpoint, head); b != nil {
+		t.Errorf("compacted chain: %v", b)
+	}
+	tampered := append(chain()[:1], chain()[2])
+	tampered[0].valid = false
+	if b := chainBreak(7, tampered, checkpoint, head); b == nil || b.TSN != 1 || b.Reason != "hash" {
+		t.Errorf("compacted chain with a wrong hash: %v", b)
+	}
+	if b := chainBreak(7, chain()[:1], checkpoint, head); b == nil || b.Reason != "head" {
+		t.Errorf("compacted chain without its tail: %v", b)
+	}
+}
+
+func TestCheckCheckpoint(t *testing.T) {
+
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp := oplogCheckpoint{tsn: 2, link: []byte("b")}
+	signed := cp
+	signed.sig = ed25519.Sign(key, checkpointMessage(5, 7, cp))
+	moved := signed
+	moved.tsn = 3
+	relinked := signed
+	relinked.link = []byte("c")
+
+	cases := []struct {
+		name   string
+		key    ed25519.PublicKey
+		signer int64
+		cp     oplogCheckpoint
+		want   signature
+	}{
+		{"valid", pub, 5, signed, sigValid},
+		{"no key", nil, 5, cp, sigNone},
+		{"unsigned", pub, 5, cp, sigMissing},
+		{"unknown key", nil, 5, signed, sigUnknown},
+		{"other key", other, 5, signed, sigInvalid},
+		{"other signer", pub, 6, signed, sigInvalid},
+		{"moved", pub, 5, moved, sigInvalid},
+		{"relinked", pub, 5, relinked, sigInvalid},
+	}
+	for _, c := range cases {
+		if got := checkCheckpoint(c.key, c.signer, 7, c.cp); got != c.want {
+			t.Errorf("%s: %v, want %v", c.name, got, c.want)
+		}
+	}
+	if got := checkCheckpoint(pub, 5, 8, signed); got != sigInvalid {
+		t.Errorf("other clock: %v, want %v", got, sigInvalid)
+	}
+}
+
+func TestOplogChain(t *testing.T) {
+
+	fmt.Printf("OPLOG CHAIN:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	url := fmt.Sprintf("meter/chain/%d", time.Now().UnixNano())
+
+	thing, err := master.PutThing("measurements", url, []byte(`{"kwh": 4}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.DeleteThing("measurements", url)
+
+	if b, err := master.VerifyOplogChain(thing.ClockID); err != nil || b != nil {
+		fmt.Printf("chain of clock %d: %v %v\n", thing.ClockID, b, err)
+		t.Fail()
+	}
+
+	// db2 remembers the chain heads of master
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// an entry rewritten in place
+	_, err = master.dbconnect.Exec("UPDATE nodes.oplog SET op = 'U' WHERE clockid = $1 AND tsn = $2", thing.ClockID, thing.TSN)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	b, err := master.VerifyOplogChain(thing.ClockID)
+	fmt.Printf("CHAIN BREAK %v\n", b)
+	if err != nil || b == nil || b.TSN != thing.TSN || b.Reason != "hash" {
+		fmt.Printf("rewritten entry not found: %v %v\n", b, err)
+		t.Fail()
+	}
+	_, err = master.dbconnect.Exec("UPDATE nodes.oplog SET op = 'I' WHERE clockid = $1 AND tsn = $2", thing.ClockID, thing.TSN)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// a history rewritten with new hashes
+	hash, err := getChainHash(context.Background(), master.dbconnect, thing.ClockID, thing.TSN)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	_, err = master.dbconnect.Exec("UPDATE nodes.oplog SET hash = digest( hash, 'sha256' ) WHERE clockid = $1 AND tsn = $2",
+		thing.ClockID, thing.TSN)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.dbconnect.Exec("UPDATE nodes.oplog SET hash = $3 WHERE clockid = $1 AND tsn = $2", thing.ClockID, thing.TSN, hash)
+
+	if _, err := db2.SyncFrom(master); !errors.Is(err, ErrHistoryRewritten) {
+		fmt.Printf("expected ErrHistoryRewritten, got %v\n", err)
+		t.Fail()
+	}
+}
+
+func TestReplicationDelay(t *testing.T) {
+
+	o := replicatorOptions{interval: time.Second, jitter: 0.1, backoff: 10 * time.Second}
+
+	cases := []struct {
+		failures int
+		rnd      float64
+		want     time.Duration
+	}{
+		{0, 0.5, time.Second},
+		{0, 0, 900 * time.Millisecond},
+		{0, 1, 1100 * time.Millisecond},
+		{1, 0.5, 2 * time.Second},
+		{3, 0.5, 8 * time.Second},
+		{4, 0.5, 10 * time.Second},
+		{100, 0.5, 10 * time.Second},
+	}
+	for _, c := range cases {
+		if got := replicationDelay(o, c.failures, c.rnd); got != c.want {
+			t.Errorf("replicationDelay(%d, %v) = %v, want %v", c.failures, c.rnd, got, c.want)
+		}
+	}
+}
+
+func TestNewReplicatorOptions(t *testing.T) {
+
+	cases := []struct {
+		opts    []ReplicatorOption
+		want    replicatorOptions
+		clamped bool
+	}{
+		{nil, replicatorOptions{DefaultReplicationInterval, DefaultReplicationJitter, DefaultReplicationBackoff}, false},
+		{[]ReplicatorOption{ReplicateEvery(time.Second), ReplicateJitter(0.5), ReplicateBackoff(time.Minute)},
+			replicatorOptions{time.Second, 0.5, time.Minute}, false},
+		{[]ReplicatorOption{ReplicateEvery(time.Hour)},
+			replicatorOptions{time.Hour, DefaultReplicationJitter, time.Hour}, false},
+		{[]ReplicatorOption{ReplicateEvery(0)},
+			replicatorOptions{DefaultReplicationInterval, DefaultReplicationJitter, DefaultReplicationBackoff}, true},
+		{[]ReplicatorOption{ReplicateEvery(-time.Second), ReplicateBackoff(0)},
+			replicatorOptions{DefaultReplicationInterval, DefaultReplicationJitter, DefaultReplicationInterval}, true},
+		{[]ReplicatorOption{ReplicateJitter(2)},
+			replicatorOptions{DefaultReplicationInterval, 1, DefaultReplicationBackoff}, true},
+		{[]ReplicatorOption{ReplicateJitter(-0.5)},
+			replicatorOptions{DefaultReplicationInterval, 0, DefaultReplicationBackoff}, true},
+		{[]ReplicatorOption{ReplicateJitter(math.NaN())},
+			replicatorOptions{DefaultReplicationInterval, 0, DefaultReplicationBackoff}, true},
+	}
+	for i, c := range cases {
+		o := replicatorOptions{DefaultReplicationInterval, DefaultReplicationJitter, DefaultReplicationBackoff}
+		for _, opt := range c.opts {
+			opt(&o)
+		}
+		if clamped := o.clamp(); clamped != c.clamped || o != c.want {
+			t.Errorf("case %d: clamp() = %v, %+v, want %v, %+v", i, clamped, o, c.clamped, c.want)
+		}
+
+		r := NewReplicator(&Database{}, nil, c.opts...)
+		if r.opts != c.want {
+			t.Errorf("case %d: NewReplicator options %+v, want %+v", i, r.opts, c.want)
+		}
+		for _, rnd := range []float64{0, 0.5, 1} {
+			for _, failures := range []int{0, 1, 100} {
+				if d := replicationDelay(r.opts, failures, rnd); d < 0 {
+					t.Errorf("case %d: replicationDelay(%d, %v) = %v, want >= 0", i, failures, rnd, d)
+				}
+			}
+		}
+	}
+}
+
+func TestReplicator(t *testing.T) {
+
+	fmt.Printf("REPLICATOR:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	url := fmt.Sprintf("meter/replicated/%d", time.Now().UnixNano())
+
+	if _, err := master.PutThing("measurements", url, []byte(`{"kwh": 6}`)); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.DeleteThing("measurements", url)
+
+	r := NewReplicator(db2, []Peer{{DB: master, Push: true}}, ReplicateEvery(50*time.Millisecond))
+	if err := r.Start(context.Background()); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if err := r.Start(context.Background()); err == nil {
+		fmt.Printf("replicator started twice\n")
+		t.Fail()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Status().Peers[0].LastSuccess.IsZero() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.Stop()
+
+	status := r.Status()
+	fmt.Printf("REPLICATOR %+v\n", status)
+
+	if status.Running || status.Peers[0].LastSuccess.IsZero() || status.Peers[0].LastError != "" {
+		fmt.Printf("no successful round\n")
+		t.Fail()
+	}
+	if _, err := db2.GetThing("measurements", url); err != nil {
+		fmt.Printf("not replicated: %v\n", err)
+		t.Fail()
+	}
+
+	// the end of the ctx stops the replicator as well
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := r.Start(ctx); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	cancel()
+
+	deadline = time.Now().Add(5 * time.Second)
+	for r.Status().Running && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.Status().Running {
+		fmt.Printf("replicator running after its ctx ended\n")
+		t.Fail()
+	}
+	if err := r.Start(context.Background()); err != nil {
+		fmt.Printf("restart after the ctx ended: %v\n", err)
+		t.Fail()
+	}
+	r.Stop()
+}
+
+func TestChangeFilter(t *testing.T) {
+
+	e, err := parseChange(`{"table": "measurements", "clockid": 7, "tsn": 42, "op": "U"}`)
+	if err != nil {
+		t.Fatalf("parseChange: %v", err)
+	}
+	if e != (ChangeEvent{Table: "measurements", ClockID: 7, TSN: 42, Op: "U"}) {
+		t.Errorf("parseChange = %+v", e)
+	}
+	if _, err := parseChange(`not json`); err == nil {
+		t.Errorf("parseChange accepted an invalid payload")
+	}
+
+	cases := []struct {
+		filter WatchFilter
+		want   bool
+	}{
+		{WatchFilter{}, true},
+		{WatchFilter{Table: "measurements"}, true},
+		{WatchFilter{Table: "systems"}, false},
+		{WatchFilter{ClockID: 7}, true},
+		{WatchFilter{Table: "measurements", ClockID: 8}, false},
+	}
+	for _, c := range cases {
+		if got := c.filter.matches(e); got != c.want {
+			t.Errorf("%+v matches = %v, want %v", c.filter, got, c.want)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+
+	fmt.Printf("WATCH:\n")
+	db, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = db.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	changes := db.Watch(ctx, WatchFilter{Table: "measurements"})
+
+	url := fmt.Sprintf("meter/watched/%d", time.Now().UnixNano())
+	thing, err := db.PutThing("measurements", url, []byte(`{"kwh": 7}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if err := db.DeleteThing("measurements", url); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	inserted, deleted := false, false
+	for e := range changes {
+		fmt.Printf("CHANGE %+v\n", e)
+		if e.Table != "measurements" {
+			fmt.Printf("filter not applied\n")
+			t.Fail()
+		}
+		if e.ClockID == thing.ClockID && e.TSN == thing.TSN {
+			inserted = e.Op == "I"
+		}
+		if inserted && e.Op == "D" && e.ClockID == thing.ClockID && e.TSN > thing.TSN {
+			deleted = true
+			break
+		}
+	}
+	if !inserted || !deleted {
+		fmt.Printf("changes not delivered: insert %v, delete %v\n", inserted, deleted)
+		t.Fail()
+	}
+}
+
+func TestOplogCursorToken(t *testing.T) {
+
+	db := &Database{}
+
+	for _, c := range []*OplogCursor{db.OplogCursor(7, 42, 10), db.OplogCursor(0, 42, 0)} {
+		r, err := db.ResumeOplogCursor(c.Token(), c.batch)
+		if err != nil {
+			t.Errorf("ResumeOplogCursor(%q): %v", c.Token(), err)
+			continue
+		}
+		if *r != *c {
+			t.Errorf("ResumeOplogCursor(%q) = %+v, want %+v", c.Token(), *r, *c)
+		}
+	}
+
+	if c := db.OplogCursor(0, 0, 0); c.batch != DefaultOplogBatch {
+		t.Errorf("batch = %d, want %d", c.batch, DefaultOplogBatch)
+	}
+
+	for _, token := range []string{"", "1.2", "1.2.3.4", "a.2.3", "7.42.8"} {
+		if _, err := db.ResumeOplogCursor(token, 0); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("ResumeOplogCursor(%q) = %v, want ErrInvalidCursor", token, err)
+		}
+	}
+}
+
+func TestOplogCursor(t *testing.T) {
+
+	fmt.Printf("OPLOG CURSOR:\n")
+	db, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = db.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	var things Things
+	for i := 0; i < 5; i++ {
+		url := fmt.Sprintf("meter/cursor/%d/%d", time.Now().UnixNano(), i)
+		thing, err := db.PutThing("measurements", url, []byte(`{"kwh": 8}`))
+		if err != nil {
+			fmt.Printf("PANIC %#v\n", err)
+			t.FailNow()
+		}
+		defer db.DeleteThing("measurements", url)
+		things = append(things, thing)
+	}
+
+	clockid := things[0].ClockID
+	c := db.OplogCursor(clockid, things[0].TSN-1, 2)
+
+	var tsns []int64
+	for len(tsns) < len(things) {
+		page, err := c.Next()
+		if err != nil {
+			fmt.Printf("PANIC %#v\n", err)
+			t.FailNow()
+		}
+		if len(page) == 0 || len(page) > 2 {
+			fmt.Printf("page of %d entries\n", len(page))
+			t.FailNow()
+		}
+		for _, ol := range page {
+			tsns = append(tsns, ol.TSN)
+		}
+
+		// continue from the token
+		if c, err = db.ResumeOplogCursor(c.Token(), 2); err != nil {
+			fmt.Printf("PANIC %#v\n", err)
+			t.FailNow()
+		}
+	}
+
+	for i, thing := range things {
+		if tsns[i] != thing.TSN {
+			fmt.Printf("oplog order %v\n", tsns)
+			t.Fail()
+			break
+		}
+	}
+}
+
+func TestCompactOplog(t *testing.T) {
+
+	fmt.Printf("COMPACT OPLOG:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	url := fmt.Sprintf("meter/compacted/%d", time.Now().UnixNano())
+	first, err := master.PutThing("measurements", url, []byte(`{"kwh": 9}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.DeleteThing("measurements", url)
+
+	latest, err := master.PutThing("measurements", url, []byte(`{"kwh": 10}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// every peer passes the versions
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := master.SyncFrom(db2); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	report, err := master.CompactOplog()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("COMPACTED %+v\n", report)
+
+	oplogs, err := master.GetOpLogs(first.ClockID, first.TSN-1)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	kept := map[int64]bool{}
+	for _, ol := range oplogs {
+		kept[ol.TSN] = true
+	}
+	fmt.Printf("SUPERSEDED KEPT %v\n", kept[first.TSN])
+	if !kept[latest.TSN] {
+		fmt.Printf("latest entry removed\n")
+		t.Fail()
+	}
+
+	if b, err := master.VerifyOplogChain(first.ClockID); err != nil || b != nil {
+		fmt.Printf("compacted chain: %v %v\n", b, err)
+		t.Fail()
+	}
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("sync after compaction: %v\n", err)
+		t.Fail()
+	}
+
+	// the checkpoints are signed by the master
+	key, err := master.signingKey(context.Background())
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	myclockid, err := getMyClockID(context.Background(), master.dbconnect)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	checkpoints, err := getOplogCheckpoints(context.Background(), master.dbconnect)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	for clockid, cp := range checkpoints {
+		if key != nil && checkCheckpoint(key.Public().(ed25519.PublicKey), myclockid, clockid, cp) != sigValid {
+			fmt.Printf("checkpoint of clock %d not signed\n", clockid)
+			t.Fail()
+		}
+	}
+}
+
+func TestBootstrapFrom(t *testing.T) {
+
+	fmt.Printf("BOOTSTRAP:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	url := fmt.Sprintf("meter/bootstrapped/%d", time.Now().UnixNano())
+	thing, err := master.PutThing("measurements", url, []byte(`{"kwh": 11}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.DeleteThing("measurements", url)
+
+	// deleted and written again: the snapshot holds the version and the
+	// older tombstone
+	again := url + "/again"
+	if _, err := master.PutThing("measurements", again, []byte(`{"kwh": 17}`)); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if err := master.DeleteThing("measurements", again); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := master.PutThing("measurements", again, []byte(`{"kwh": 18}`)); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.DeleteThing("measurements", again)
+
+	stats, err := db2.BootstrapFrom(master)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("BOOTSTRAP %+v\n", stats)
+
+	if _, err := db2.GetThing("measurements", again); err != nil {
+		fmt.Printf("version written after a delete not bootstrapped: %v\n", err)
+		t.Fail()
+	}
+
+	copied, err := db2.GetThing("measurements", url)
+	if err != nil {
+		fmt.Printf("not bootstrapped: %v\n", err)
+		t.FailNow()
+	}
+	if copied.ClockID != thing.ClockID || copied.TSN != thing.TSN {
+		fmt.Printf("version changed: %+v\n", copied)
+		t.Fail()
+	}
+
+	high, err := db2.CheckHigh(thing.ClockID)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if high < thing.TSN {
+		fmt.Printf("high water mark %d behind %d\n", high, thing.TSN)
+		t.Fail()
+	}
+}
+
+func TestBootstrapAfterResync(t *testing.T) {
+
+	fmt.Printf("BOOTSTRAP AFTER RESYNC:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	url := fmt.Sprintf("meter/resynced/%d", time.Now().UnixNano())
+	if _, err := master.PutThing("measurements", url, []byte(`{"kwh": 13}`)); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// db2 falls behind a write and the delete, the retention removes the write
+	other, err := master.PutThing("measurements", url+"/other", []byte(`{"kwh": 14}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.DeleteThing("measurements", other.URL)
+
+	if err := master.DeleteThing("measurements", url); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// a version of db2, which the master deleted and whose tombstone it
+	// collected
+	stale := url + "/stale"
+	if _, err := db2.PutThing("measurements", stale, []byte(`{"kwh": 19}`)); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := master.SyncFrom(db2); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if err := master.DeleteThing("measurements", stale); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := master.dbconnect.Exec("delete from nodes.tombstones where url = $1", stale); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	master.SetOplogRetention(OplogRetention{MaxAge: time.Nanosecond})
+	_, err = master.CompactOplog()
+	master.SetOplogRetention(OplogRetention{})
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	if _, err := db2.SyncFrom(master); !errors.Is(err, ErrResyncRequired) {
+		fmt.Printf("sync behind the retention: %v\n", err)
+		t.FailNow()
+	}
+
+	stats, err := db2.BootstrapFrom(master)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("BOOTSTRAP %+v\n", stats)
+
+	if _, err := db2.GetThing("measurements", url); !errors.Is(err, ErrNotFound) {
+		fmt.Printf("deleted thing resurrected: %v\n", err)
+		t.Fail()
+	}
+	if _, err := db2.GetThing("measurements", other.URL); err != nil {
+		fmt.Printf("not bootstrapped: %v\n", err)
+		t.Fail()
+	}
+	if _, err := db2.GetThing("measurements", stale); !errors.Is(err, ErrNotFound) {
+		fmt.Printf("stale version kept: %v\n", err)
+		t.Fail()
+	}
+
+	// the high water mark of db2 covers its delete of the stale version
+	myclockid, err := db2.GetMyClockID()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	var deleted int64
+	row := db2.dbconnect.QueryRow("select tsn from nodes.tombstones where clockid = $1 and url = $2", myclockid, stale)
+	if err := row.Scan(&deleted); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if high, err := db2.CheckHigh(myclockid); err != nil || high < deleted {
+		fmt.Printf("high water mark %d behind the delete at %d: %v\n", high, deleted, err)
+		t.Fail()
+	}
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("sync after bootstrap: %v\n", err)
+		t.Fail()
+	}
+
+	// the other node is behind the retention as well
+	db1, err := GetDatabase(dbname1)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := db1.BootstrapFrom(master); err != nil {
+		fmt.Printf("bootstrap %s: %v\n", dbname1, err)
+		t.Fail()
+	}
+}
+
+func TestReadToken(t *testing.T) {
+
+	a := Thing{ClockID: 7, TSN: 42}.ReadToken()
+	b := ReadToken{{ClockID: 3, TSN: 5}, {ClockID: 7, TSN: 40}}
+
+	merged := a.Merge(b)
+	if got := merged.String(); got != "3:5,7:42" {
+		t.Errorf("Merge = %s, want 3:5,7:42", got)
+	}
+
+	parsed, err := ParseReadToken(merged.String())
+	if err != nil || parsed.String() != merged.String() {
+		t.Errorf("ParseReadToken(%s) = %v, %v", merged, parsed, err)
+	}
+	if r, err := ParseReadToken(""); err != nil || len(r) != 0 {
+		t.Errorf("ParseReadToken(\"\") = %v, %v", r, err)
+	}
+	for _, s := range []string{"3", "3:x", "3:5,", "3:5;7:42"} {
+		if _, err := ParseReadToken(s); err == nil {
+			t.Errorf("ParseReadToken(%q) accepted", s)
+		}
+	}
+
+	if behind := merged.uncovered(map[int64]int64{3: 5, 7: 42}); behind != nil {
+		t.Errorf("covered token: %+v", behind)
+	}
+	if behind := merged.uncovered(map[int64]int64{3: 9, 7: 41}); behind == nil || behind.ClockID != 7 {
+		t.Errorf("uncovered token: %+v", behind)
+	}
+}
+
+func TestReadAt(t *testing.T) {
+
+	fmt.Printf("READ AT:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	url := fmt.Sprintf("meter/read/%d", time.Now().UnixNano())
+	thing, err := master.PutThing("measurements", url, []byte(`{"kwh": 12}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.DeleteThing("measurements", url)
+
+	// read your writes
+	if _, err := master.GetThingAt("measurements", url, thing.ReadToken()); err != nil {
+		fmt.Printf("own write not read: %v\n", err)
+		t.Fail()
+	}
+
+	// the replica has not seen the write yet
+	if _, err := db2.GetThingAt("measurements", url, thing.ReadToken()); !errors.Is(err, ErrReplicaBehind) {
+		fmt.Printf("replica behind: %v\n", err)
+		t.Fail()
+	}
+
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	token, err := master.ReadToken()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	// monotonic reads: at least what the master had
+	things, err := db2.ListThingsAt("measurements", token)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	found := false
+	for _, th := range things {
+		found = found || th.URL == url
+	}
+	if !found {
+		fmt.Printf("replicated write not listed at %s\n", token)
+		t.Fail()
+	}
+}
+
+func TestReadYourWritesConcurrent(t *testing.T) {
+
+	fmt.Printf("READ YOUR WRITES CONCURRENT:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// writers commit in any order, the high water mark never moves back
+	base := fmt.Sprintf("meter/concurrent/%d", time.Now().UnixNano())
+	things := make([]Thing, 16)
+	errs := make([]error, len(things))
+
+	var wg sync.WaitGroup
+	for i := range things {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			things[i], errs[i] = master.PutThing("measurements", fmt.Sprintf("%s/%d", base, i), []byte(`{"kwh": 20}`))
+		}(i)
+	}
+	wg.Wait()
+
+	var token ReadToken
+	for i, thing := range things {
+		if errs[i] != nil {
+			fmt.Printf("PANIC %#v\n", errs[i])
+			t.FailNow()
+		}
+		defer master.DeleteThing("measurements", thing.URL)
+
+		if _, err := master.GetThingAt("measurements", thing.URL, thing.ReadToken()); err != nil {
+			fmt.Printf("read own write %s: %v\n", thing.URL, err)
+			t.Fail()
+		}
+		token = token.Merge(thing.ReadToken())
+	}
+
+	listed, err := master.ListThingsAt("measurements", token)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	n := 0
+	for _, thing := range listed {
+		if strings.HasPrefix(thing.URL, base+"/") {
+			n++
+		}
+	}
+	if n != len(things) {
+		fmt.Printf("listed %d of %d writes\n", n, len(things))
+		t.Fail()
+	}
+}
+
+func TestTombstoneWithoutRow(t *testing.T) {
+
+	fmt.Printf("TOMBSTONE WITHOUT ROW:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// db2 never sees the version, only its delete
+	url := fmt.Sprintf("meter/never/%d", time.Now().UnixNano())
+	if _, err := master.PutThing("measurements", url, []byte(`{"kwh": 13}`)); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if err := master.DeleteThing("measurements", url); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	stats, err := db2.SyncFrom(master)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("TOMBSTONE WITHOUT ROW stats %+v\n", stats)
+	if stats.Deleted != 0 {
+		fmt.Printf("delete of a missing row counted\n")
+		t.Fail()
+	}
+}
+
+func TestTombstoneAfterRewrite(t *testing.T) {
+
+	fmt.Printf("TOMBSTONE AFTER REWRITE:\n")
+	master, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	db2, err := GetDatabase(dbname2)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = master.CreateManagedTable("measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// the url is deleted and written again, db2 gets the new version
+	url := fmt.Sprintf("meter/rewritten/%d", time.Now().UnixNano())
+	if _, err := master.PutThing("measurements", url, []byte(`{"kwh": 15}`)); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if err := master.DeleteThing("measurements", url); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	rewritten, err := master.PutThing("measurements", url, []byte(`{"kwh": 16}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	defer master.DeleteThing("measurements", url)
+
+	if _, err := db2.SyncFrom(master); err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// the delete arrives after the new version, as from a peer replaying
+	// the clocks in another order: db2 forgets it had the tombstone
+	ctx := context.Background()
+	tombstones, err := listTombstones(ctx, master.dbconnect, "measurements")
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	policy, err := db2.syncPolicy(ctx)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	var stats SyncStats
+	for _, ts := range tombstones {
+		if ts.url != url {
+			continue
+		}
+		err := inTx(ctx, db2.dbconnect, "tombstone", func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, "delete from nodes.tombstones where clockid = $1 and tsn = $2", ts.clockid, ts.tsn); err != nil {
+				return err
+			}
+			return applyTombstone(ctx, tx, policy, ts, &stats)
+		})
+		if err != nil {
+			fmt.Printf("PANIC %#v\n", err)
+			t.FailNow()
+		}
+	}
+	if stats.Deleted != 0 || stats.Skipped != 1 {
+		fmt.Printf("tombstone after rewrite stats %+v\n", stats)
+		t.Fail()
+	}
+
+	thing, err := db2.GetThing("measurements", url)
+	if err != nil || thing.ClockID != rewritten.ClockID || thing.TSN != rewritten.TSN {
+		fmt.Printf("version after the delete removed: %+v %v\n", thing, err)
+		t.Fail()
+	}
+}
+
+func TestDbTemplateConcurrent(t *testing.T) {
+
+	var wg sync.WaitGroup
+	templates := make([]string, 8)
+
+	for i := range templates {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			templates[i] = getDbTemplate()
+		}(i)
+	}
+	wg.Wait()
+
+	for _, template := range templates {
+		if template != os.Getenv("ENGINE_DB") {
+			t.Errorf("getDbTemplate() = %q, want ENGINE_DB", template)
+		}
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+
+	h := &handler{}
+	h.handle("GET /things/{table}", nil)
+	h.handle("GET /things/{table}/{url...}", nil)
+
+	cases := []struct {
+		path   string
+		route  int
+		values map[string]string
+		ok     bool
+	}{
+		{"/things/systems", 0, map[string]string{"table": "systems"}, true},
+		{"/things/systems/", 0, nil, false},
+		{"/things/systems", 1, nil, false},
+		{"/things/systems/a.towerpower.co/b", 1, map[string]string{"table": "systems", "url": "a.towerpower.co/b"}, true},
+		{"/things/systems/a%2Fb", 1, map[string]string{"table": "systems", "url": "a/b"}, true},
+		{"/things//a", 1, nil, false},
+		{"/things/systems/", 1, nil, false},
+		{"/power/systems", 0, nil, false},
+	}
+
+	for _, c := range cases {
+		u, _ := url.Parse(c.path)
+		segments := strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+
+		values, ok := h.routes[c.route].match(segments)
+		if ok != c.ok || (ok && !reflect.DeepEqual(values, c.values)) {
+			t.Errorf("%s on route %d: %v %v, want %v %v", c.path, c.route, values, ok, c.values, c.ok)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/things/systems", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET" {
+		t.Errorf("PUT /things/systems: %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/nowhere", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET /nowhere: %d", w.Code)
+	}
+}
+
+func TestReadBody(t *testing.T) {
+
+	cases := []struct {
+		body   io.Reader
+		status int
+	}{
+		{strings.NewReader(`{"url": "a"}`), http.StatusOK},
+		{strings.NewReader(`{"url"`), http.StatusBadRequest},
+		{bytes.NewReader(bytes.Repeat([]byte(" "), maxBodySize+1)), http.StatusRequestEntityTooLarge},
+		{iotest.ErrReader(io.ErrUnexpectedEOF), http.StatusBadRequest},
+	}
+
+	for i, c := range cases {
+		w := httptest.NewRecorder()
+		_, ok := readBody(w, httptest.NewRequest("PUT", "/things/systems/a", c.body))
+		if ok != (c.status == http.StatusOK) || w.Code != c.status {
+			t.Errorf("case %d: %v %d, want %d", i, ok, w.Code, c.status)
+		}
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys", "engine3.key")
+
+	if key, err := readKeyFile(path); key != nil || err != nil {
+		t.Errorf("missing key file: %v %v", key, err)
+	}
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKeyFile(path, key); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("key file mode: %v %v", info, err)
+	}
+
+	read, err := readKeyFile(path)
+	if err != nil || !read.Equal(key) {
+		t.Errorf("key file read back: %v", err)
+	}
+
+	// a key is never overwritten
+	_, other, _ := ed25519.GenerateKey(nil)
+	if err := writeKeyFile(path, other); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("key file overwritten: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("s3cret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readKeyFile(path); err == nil || strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("corrupt key file: %v", err)
+	}
+
+	cfg := Config{KeyDir: "/etc/engine3", Databases: map[string]Config{"engine4": {KeyDir: "/srv/keys"}}}
+	if got := cfg.keyFile("engine3"); got != filepath.Join("/etc/engine3", "engine3.key") {
+		t.Errorf("key file of engine3: %s", got)
+	}
+	if got := cfg.keyFile("engine4"); got != filepath.Join("/srv/keys", "engine4.key") {
+		t.Errorf("key file of engine4: %s", got)
+	}
+}
+
+func TestContextErrors(t *testing.T) {
+
+	fmt.Printf("CONTEXT ERRORS:\n")
+	db, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// a cancelled context is reported, not swallowed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = db.NewTSNContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		fmt.Printf("expected context.Canceled, got %#v\n", err)
+		t.Fail()
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// the *pq.Error of the database stays available
+	_, err = db.GetThingContext(ctx, "no_such_table", "thing.towerpower.co")
+
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		fmt.Printf("expected *pq.Error, got %#v\n", err)
+		t.FailNow()
+	}
+	fmt.Printf("SQLSTATE %v %v\n", pqErr.Code, pqErr.Message)
+}
+
+func TestSentinelErrors(t *testing.T) {
+
+	fmt.Printf("SENTINEL ERRORS:\n")
+	db, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	_, err = db.GetThing("systems", "missing.towerpower.co")
+	if !errors.Is(err, ErrNotFound) {
+		fmt.Printf("expected ErrNotFound, got %v\n", err)
+		t.Fail()
+	}
+
+	err = db.DeleteThing("systems", "missing.towerpower.co")
+	if !errors.Is(err, ErrNotFound) {
+		fmt.Printf("expected ErrNotFound, got %v\n", err)
+		t.Fail()
+	}
+
+	_, err = db.ListThings("no_such_table")
+	if !errors.Is(err, ErrNotFound) {
+		fmt.Printf("expected ErrNotFound, got %v\n", err)
+		t.Fail()
+	}
+
+	first, err := db.PutThing("systems", "stale.towerpower.co", []byte(`{"v": 1}`))
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	second, err := db.PutThingIf("systems", "stale.towerpower.co", []byte(`{"v": 2}`), first)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// first is not the current version anymore
+	_, err = db.PutThingIf("systems", "stale.towerpower.co", []byte(`{"v": 3}`), first)
+	if !errors.Is(err, ErrStaleVersion) {
+		fmt.Printf("expected ErrStaleVersion, got %v\n", err)
+		t.Fail()
+	}
+
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		fmt.Printf("expected *pq.Error in %v\n", err)
+		t.Fail()
+	}
+
+	err = db.DeleteThingIf("systems", "stale.towerpower.co", first)
+	if !errors.Is(err, ErrStaleVersion) {
+		fmt.Printf("expected ErrStaleVersion, got %v\n", err)
+		t.Fail()
+	}
+
+	err = db.DeleteThingIf("systems", "stale.towerpower.co", second)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+}
+
+func TestClassifyErr(t *testing.T) {
+
+	cases := []struct {
+		err  error
+		want error
+	}{
+		{&pq.Error{Code: "EN001"}, ErrNotRegistered},
+		{&pq.Error{Code: "EN003"}, ErrStaleVersion},
+		{&pq.Error{Code: "23505", Constraint: "systems_pkey"}, ErrConflict},
+		{&pq.Error{Code: "42P01"}, ErrNotFound},
+		{&pq.Error{Code: "42883"}, ErrSchemaMismatch},
+	}
+
+	for _, c := range cases {
+		err := wrapErr("test", c.err)
+
+		if !errors.Is(err, c.want) {
+			t.Errorf("%v: expected %v", err, c.want)
+		}
+
+		var pqErr *pq.Error
+		if !errors.As(err, &pqErr) || pqErr != c.err {
+			t.Errorf("%v: *pq.Error lost", err)
+		}
+	}
+
+	if err := wrapErr("test", errors.New("connection refused")); errors.Is(err, ErrNotFound) {
+		t.Errorf("%v: unexpected sentinel", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+
+	dir := t.TempDir()
+
+	password := filepath.Join(dir, "password")
+	if err := os.WriteFile(password, []byte("s3cret'\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	toml := filepath.Join(dir, "engine.toml")
+	text := `# engine configuration
+host = "db.towerpower.co"
+port = 5433
+user = "engine"
+password_file = "` + password + `"
+sslmode = "require" # always
+max_open_conns = 10
+
+[databases.engine4]
+host = "replica.towerpower.co"
+dbname = "engine4_test"
+`
+	if err := os.WriteFile(toml, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(toml)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Port != 5433 || cfg.SSLMode != "require" || cfg.MaxOpenConns != 10 {
+		t.Errorf("unexpected config %v", cfg)
+	}
+
+	c := cfg.forDatabase("engine4")
+	if c.Host != "replica.towerpower.co" || c.DBName != "engine4_test" || c.User != "engine" {
+		t.Errorf("unexpected override %v", c)
+	}
+
+	dn, err := cfg.dsn("engine3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dn, `password='s3cret\''`) || !strings.Contains(dn, "dbname='engine3'") {
+		t.Errorf("unexpected connection string %s", redactDSN(dn))
+	}
+
+	for _, dn := range []string{dn, "postgres://engine:s3cret@db/engine3", "user=x password=s3cret"} {
+		if strings.Contains(redactDSN(dn), "s3cret") {
+			t.Errorf("secret not redacted: %s", redactDSN(dn))
+		}
+	}
+
+	if strings.Contains(cfg.String(), "s3cret") {
+		t.Errorf("secret in %v", cfg)
+	}
+}
+
+func TestReopen(t *testing.T) {
+
+	fmt.Printf("REOPEN:\n")
+
+	// concurrent callers share one pool
+	dbs := make(chan *Database, 8)
+	for i := 0; i < cap(dbs); i++ {
+		go func() {
+			db, err := GetDatabase(dbname1)
+			if err != nil {
+				fmt.Printf("PANIC %#v\n", err)
+			}
+			dbs <- db
+		}()
+	}
+	first := <-dbs
+	for i := 1; i < cap(dbs); i++ {
+		if db := <-dbs; db != first {
+			fmt.Printf("GetDatabase returned two pools for %v\n", dbname1)
+			t.Fail()
+		}
+	}
+
+	db, err := Reopen(dbname1)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	if db == first {
+		fmt.Printf("Reopen returned the evicted pool\n")
+		t.Fail()
+	}
+
+	// the evicted handle is closed
+	_, err = first.NewTSN()
+	if err == nil {
+		fmt.Printf("evicted handle still works\n")
+		t.Fail()
+	}
+
+	_, err = db.NewTSN()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	err = db.Close()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	// a closed database is opened again on demand
+	db, err = GetDatabase(dbname1)
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+	_, err = db.NewTSN()
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+}
+
+func TestLogger(t *testing.T) {
+
+	fmt.Printf("LOGGER:\n")
+
+	// silent by default
+	if logger(context.Background()).Enabled(context.Background(), slog.LevelError) {
+		fmt.Printf("package logger is not silent\n")
+		t.Fail()
+	}
+
+	db, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	var buf bytes.Buffer
+
+	db.SetLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer db.SetLogger(nil)
+
+	_, err = db.PutThing("systems", "logger.towerpower.co", jsonSystems_Nodes())
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	for _, field := range []string{`"database":"master"`, `"table":"systems"`, `"clockid":`, `"tsn":`} {
+		if !strings.Contains(buf.String(), field) {
+			fmt.Printf("field %s missing in %s\n", field, buf.String())
+			t.Fail()
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+
+	fmt.Printf("HTTP:\n")
+	db, err := GetDatabase(dbname0)
+
+	if err != nil {
+		fmt.Printf("PANIC %#v\n", err)
+		t.FailNow()
+	}
+
+	server := httptest.NewServer(NewHandler(db))
+	defer server.Close()
+
+	do := func(method, path, body string, header ...string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do("PUT", "/things/systems/http.towerpower.co/a", `{"v": 1}`)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == "" {
+		t.Fatalf("PUT: %v", resp.Status)
+	}
+	tag := resp.Header.Get("ETag")
+
+	if resp = do("GET", "/things/systems/http.towerpower.co/a", "", "If-None-Match", tag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET If-None-Match: %v", resp.Status)
+	}
+
+	if resp = do("PUT", "/things/systems/http.towerpower.co/a", `{"v": 2}`, "If-Match", tag); resp.StatusCode != http.StatusOK {
+		t.Errorf("PUT If-Match: %v", resp.Status)
+	}
+
+	// tag is stale now
+	if resp = do("PUT", "/things/systems/http.towerpower.co/a", `{"v": 3}`, "If-Match", tag); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PUT stale If-Match: %v", resp.Status)
+	}
+
+	if resp = do("PUT", "/things/systems/http.towerpower.co/a", `{"v": 3}`, "If-None-Match", "*"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PUT If-None-Match on existing thing: %v", resp.Status)
+	}
+
+	if resp = do("PUT", "/things/systems/http.towerpower.co/a", `no json`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PUT invalid body: %v", resp.Status)
+	}
+
+	if resp = do("DELETE", "/things/systems/http.towerpower.co/a", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE: %v", resp.Status)
+	}
+
+	if resp = do("GET", "/things/systems/http.towerpower.co/a", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after DELETE: %v", resp.Status)
+	}
+
+	if resp = do("GET", "/nodes", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /nodes: %v", resp.Status)
+	}
+
+	if resp = do("GET", "/nodes/abc", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /nodes/abc: %v", resp.Status)
+	}
 }
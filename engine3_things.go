@@ -7,97 +7,486 @@
 package engine3
 
 import (
+	"context"
+	"crypto/ed25519"
 	"database/sql"
-	//	"errors"
-	"fmt"
+	"encoding/json"
 	_ "github.com/lib/pq"
-	//"log"
-	//	"os"
-	//	"strings"
-	//	"sync"
 )
 
+// A versioned object of a managed table
+//
+// CKey and CVal are the digests of URL and Data computed with Alg (empty
+// for md5), ClockID and TSN give the spatial and timely coordinate of the
+// version, VV the versions it is derived from (empty for versions written
+// before vectors were recorded) and Sig the signature of the writing node
+// (empty for unsigned versions)
 type Thing struct {
-	ckey    []byte
-	cval    []byte
-	url     []byte
-	data    []byte
-	clockid int64
-	tsn     int64
+	CKey    []byte          `json:"ckey"`
+	CVal    []byte          `json:"cval"`
+	URL     string          `json:"url"`
+	Data    json.RawMessage `json:"data"`
+	ClockID int64           `json:"clockid"`
+	TSN     int64           `json:"tsn"`
+	VV      VersionVector   `json:"vv,omitempty"`
+	Alg     string          `json:"alg,omitempty"`
+	Sig     []byte          `json:"sig,omitempty"`
 }
 
 type Things []Thing
 
-/* read sql Rows into Thing structure
+// a sql.Row or sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+/* read a sql row into a Thing structure
  *
- * the assumed position in the rows is
+ * the assumed position in the row is
  * $1  ckey
  * $2  cval
- * $3  ulr
+ * $3  url
  * $4  data
  * $5  clockid
  * $6  tsn
+ * $7  vv (NULL or a JSON object)
+ * $8  alg (NULL for md5)
+ * $9  sig (NULL for unsigned versions)
  */
-func rowsToThings(rows *sql.Rows) Things {
+func scanThing(row scanner, t *Thing) error {
 	var (
-		t      Thing
-		result Things
-		err    error
+		data, vv []byte
+		alg      sql.NullString
 	)
 
-	checkRows("Things", rows)
+	err := row.Scan(&t.CKey, &t.CVal, &t.URL, &data, &t.ClockID, &t.TSN, &vv, &alg, &t.Sig)
+	if err != nil {
+		return err
+	}
+	t.Data = json.RawMessage(data)
+	t.Alg = alg.String
+
+	t.VV = nil
+	if vv != nil {
+		return json.Unmarshal(vv, &t.VV)
+	}
+	return nil
+}
+
+/* read sql Rows into Things */
+func rowsToThings(ctx context.Context, rows *sql.Rows) (Things, error) {
+	var result Things
 
 	for i := 0; rows.Next(); i++ {
-		err := rows.Scan(&t.ckey, &t.cval, &t.url, &t.data, &t.clockid, &t.tsn)
-		checkErr("scan things", err)
+		var t Thing
+
+		if err := scanThing(rows, &t); err != nil {
+			return nil, wrapErr("scan things", err)
+		}
 
 		result = append(result, t)
 	}
-	err = rows.Err()
-	checkErr("end reading things loop", err)
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("end reading things loop", err)
+	}
 
-	fmt.Printf("returning things: %d rows\n", len(result))
-	return result
+	logger(ctx).Debug("read things", "rows", len(result))
+	return result, nil
 }
 
-func rowToThing(row *sql.Row) Thing {
+/* read a single Thing
+ *
+ * returns false, if there is no row
+ */
+func rowToThing(row *sql.Row) (Thing, bool, error) {
 	var t Thing
 
-	err := row.Scan(&t.ckey, &t.cval, &t.url, &t.data, &t.clockid, &t.tsn)
-	checkErr("scan a thing", err)
+	err := scanThing(row, &t)
+	if err == sql.ErrNoRows {
+		return t, false, nil
+	}
+	if err != nil {
+		return t, false, wrapErr("scan a thing", err)
+	}
+
+	return t, true, nil
+}
+
+/* read a version of a thing from a managed table
+ *
+ * returns false, if the version (clockid, tsn) is not there (anymore)
+ */
+func ae_get(ctx context.Context, q querier, in_name string, in_clockid int64, in_tsn int64) (Thing, bool, error) {
+
+	row := q.QueryRowContext(ctx, "select * from nodes.ae_get( $1, $2, $3 )", in_name, in_clockid, in_tsn)
+	checkRow(row)
+
+	t, ok, err := rowToThing(row)
+
+	return t, ok, wrapErr("nodes.ae_get "+in_name, err)
+}
+
+// result of writing a version with ae_put
+type aeStatus string
+
+const (
+	aeApplied  aeStatus = "applied"  // inserted, or replaced an older version of the clock
+	aeSkipped  aeStatus = "skipped"  // the same or a newer version of the clock is there
+	aeConflict aeStatus = "conflict" // the url is held by another clock, nothing written
+	aeRecorded aeStatus = "recorded" // a tombstone of a url, which is not there: nothing removed
+)
+
+/* write a version of a thing into a managed table
+ *
+ * writing the same version again is a no-op
+ */
+func ae_put(ctx context.Context, q querier, in_name string, t Thing) (aeStatus, error) {
+
+	var status string
+
+	row := q.QueryRowContext(ctx, "select nodes.ae_put( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10 )",
+		in_name, t.CKey, t.CVal, t.URL, string(t.Data), t.ClockID, t.TSN, t.VV.param(), algParam(t.Alg), sigParam(t.Sig))
+	checkRow(row)
+
+	err := row.Scan(&status)
+
+	return aeStatus(status), wrapErr("nodes.ae_put "+in_name, err)
+}
+
+// Managed tables
+
+// create a managed table (idempotent)
+func createManagedTable(ctx context.Context, q querier, in_name string) error {
+
+	_, err := q.ExecContext(ctx, "select nodes.create_managed_table( $1 )", in_name)
+	if err != nil {
+		return wrapErr("nodes.create_managed_table", err)
+	}
+
+	logger(ctx).Info("managed table", "table", in_name)
+	return nil
+}
+
+// read the catalog of managed tables
+func getManagedTables(ctx context.Context, q querier) ([]string, error) {
+	var (
+		name   string
+		result []string
+	)
+
+	rows, err := q.QueryContext(ctx, "select * from nodes.getManagedTables()")
+	if err != nil {
+		return nil, wrapErr("nodes.getManagedTables", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.Scan(&name); err != nil {
+			return nil, wrapErr("scan managed table", err)
+		}
+
+		result = append(result, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("end reading managed tables loop", err)
+	}
+
+	return result, nil
+}
+
+// Calling the generic thing functions of the database
 
-	return t
+// get the current version of a thing by url
+func getThing(ctx context.Context, q querier, in_table string, in_url string) (Thing, bool, error) {
+
+	row := q.QueryRowContext(ctx, "select * from nodes.thing_get( $1, $2 )", in_table, in_url)
+	checkRow(row)
+
+	t, ok, err := rowToThing(row)
+
+	return t, ok, wrapErr("nodes.thing_get", err)
 }
 
-func ae_get(dbconnect *sql.DB, in_name string, in_clockid int64, in_tsn int64) Thing {
-	var statement string = "select * from nodes.ae_get_" + in_name + "( $1, $2 )"
+// write a new version of a thing (new TSN, local clockid), signed if the node has a key
+func putThing(ctx context.Context, q querier, key ed25519.PrivateKey, in_table string, in_url string, in_data []byte) (Thing, error) {
+
+	row := q.QueryRowContext(ctx, "select * from nodes.thing_put( $1, $2, $3 )", in_table, in_url, string(in_data))
+	checkRow(row)
+
+	t, _, err := rowToThing(row)
+	if err != nil {
+		return t, wrapErr("nodes.thing_put", err)
+	}
+	if err := signThing(ctx, q, key, in_table, &t); err != nil {
+		return t, err
+	}
+
+	logger(ctx).Debug("put thing", "table", in_table, "url", in_url, "clockid", t.ClockID, "tsn", t.TSN, "op", "put")
+	return t, nil
+}
+
+// write a new version of a thing, if the current version is (clockid, tsn)
+func putThingIf(ctx context.Context, q querier, key ed25519.PrivateKey, in_table string, in_url string, in_data []byte,
+	in_clockid int64, in_tsn int64) (Thing, error) {
+
+	row := q.QueryRowContext(ctx, "select * from nodes.thing_put_if( $1, $2, $3, $4, $5 )",
+		in_table, in_url, string(in_data), in_clockid, in_tsn)
+	checkRow(row)
+
+	t, _, err := rowToThing(row)
+	if err != nil {
+		return t, wrapErr("nodes.thing_put_if", err)
+	}
+	if err := signThing(ctx, q, key, in_table, &t); err != nil {
+		return t, err
+	}
+
+	logger(ctx).Debug("put thing", "table", in_table, "url", in_url, "clockid", t.ClockID, "tsn", t.TSN, "op", "put_if")
+	return t, nil
+}
+
+/* delete a thing by url
+ *
+ * with a key, the node takes the coordinates of the delete itself, so
+ * that the tombstone is written with its signature
+ */
+func deleteThing(ctx context.Context, q querier, key ed25519.PrivateKey, in_table string, in_url string) (bool, error) {
+
+	var (
+		found bool
+		row   *sql.Row
+		err   error
+	)
 
-	fmt.Printf("Statement: %s\n", statement)
+	if key == nil {
+		row = q.QueryRowContext(ctx, "select nodes.thing_delete( $1, $2 )", in_table, in_url)
+	} else {
+		clockid, err := getMyClockID(ctx, q)
+		if err != nil {
+			return false, err
+		}
+		tsn, err := newTSN(ctx, q)
+		if err != nil {
+			return false, err
+		}
 
-	row := dbconnect.QueryRow(statement, in_clockid, in_tsn)
+		sig := ed25519.Sign(key, signedMessage(in_url, nil, clockid, tsn))
+		row = q.QueryRowContext(ctx, "select nodes.thing_delete( $1, $2, $3, $4, $5 )", in_table, in_url, clockid, tsn, sig)
+	}
 	checkRow(row)
 
-	return rowToThing(row)
+	err = row.Scan(&found)
+	if err != nil {
+		return false, wrapErr("nodes.thing_delete", err)
+	}
+
+	logger(ctx).Debug("delete thing", "table", in_table, "url", in_url, "found", found, "op", "delete")
+	return found, nil
+}
+
+// delete a thing, if the current version is (clockid, tsn)
+func deleteThingIf(ctx context.Context, q querier, key ed25519.PrivateKey, in_table string, in_url string,
+	in_clockid int64, in_tsn int64) (bool, error) {
+
+	// the row stays locked up to the delete
+	_, err := q.ExecContext(ctx, "select nodes.thing_lock_if( $1, $2, $3, $4 )", in_table, in_url, in_clockid, in_tsn)
+	if err != nil {
+		return false, wrapErr("nodes.thing_lock_if", err)
+	}
+
+	return deleteThing(ctx, q, key, in_table, in_url)
+}
+
+// list all things of a table
+func listThings(ctx context.Context, q querier, in_table string) (Things, error) {
+
+	rows, err := q.QueryContext(ctx, "select * from nodes.thing_list( $1 )", in_table)
+	if err != nil {
+		return nil, wrapErr("nodes.thing_list", err)
+	}
+	defer rows.Close()
+
+	return rowsToThings(ctx, rows)
+}
+
+//
+// PACKAGE EXPORTS
+
+// Create a managed table derived from nodes.base
+//
+// The table gets the oplog trigger and the anti-entropy functions and is
+// recorded in the catalog, so that it is synchronized.
+//
+// Package Export
+func (db *Database) CreateManagedTable(in_name string) error {
+	return db.CreateManagedTableContext(context.Background(), in_name)
+}
+
+// Create a managed table derived from nodes.base
+//
+// Package Export
+func (db *Database) CreateManagedTableContext(ctx context.Context, in_name string) error {
+	return createManagedTable(db.withLogger(ctx), db.dbconnect, in_name)
+}
+
+// List the managed tables
+//
+// Package Export
+func (db *Database) ManagedTables() ([]string, error) {
+	return db.ManagedTablesContext(context.Background())
+}
+
+// List the managed tables
+//
+// Package Export
+func (db *Database) ManagedTablesContext(ctx context.Context) ([]string, error) {
+	return getManagedTables(ctx, db.dbconnect)
+}
+
+// Get the current version of a thing
+//
+// A missing thing returns an error wrapping ErrNotFound
+//
+// Package Export
+func (db *Database) GetThing(in_table string, in_url string) (Thing, error) {
+	return db.GetThingContext(context.Background(), in_table, in_url)
+}
+
+// Get the current version of a thing
+//
+// Package Export
+func (db *Database) GetThingContext(ctx context.Context, in_table string, in_url string) (Thing, error) {
+
+	t, ok, err := getThing(ctx, db.dbconnect, in_table, in_url)
+	if err == nil && !ok {
+		err = notFound("thing " + in_table + "/" + in_url)
+	}
+	return t, err
+}
+
+// Put a new version of a thing
+//
+// Package Export
+func (db *Database) PutThing(in_table string, in_url string, in_data []byte) (Thing, error) {
+	return db.PutThingContext(context.Background(), in_table, in_url, in_data)
+}
+
+// Put a new version of a thing
+//
+// Package Export
+func (db *Database) PutThingContext(ctx context.Context, in_table string, in_url string, in_data []byte) (Thing, error) {
+	var t Thing
+
+	key, err := db.signingKey(db.withLogger(ctx))
+	if err != nil {
+		return t, err
+	}
+
+	err = inTx(ctx, db.dbconnect, "put thing", func(tx *sql.Tx) (err error) {
+		t, err = putThing(db.withLogger(ctx), tx, key, in_table, in_url, in_data)
+		return err
+	})
+	return t, err
+}
+
+// Put a new version of a thing, if expected is its current version
+//
+// A zero expected Thing requires that the url does not exist yet.
+// Otherwise the error wraps ErrStaleVersion.
+//
+// Package Export
+func (db *Database) PutThingIf(in_table string, in_url string, in_data []byte, expected Thing) (Thing, error) {
+	return db.PutThingIfContext(context.Background(), in_table, in_url, in_data, expected)
 }
 
-/*
-// Put a new value
-func putPowerData(dbconnect *sql.DB, in_key string, in_value string) {
+// Put a new version of a thing, if expected is its current version
+//
+// Package Export
+func (db *Database) PutThingIfContext(ctx context.Context, in_table string, in_url string, in_data []byte, expected Thing) (Thing, error) {
+	var t Thing
 
-	_, err := dbconnect.Exec("select power.put( $1, $2 )", in_key, in_value)
+	key, err := db.signingKey(db.withLogger(ctx))
+	if err != nil {
+		return t, err
+	}
 
-	checkErr("power.put", err)
+	err = inTx(ctx, db.dbconnect, "put thing", func(tx *sql.Tx) (err error) {
+		t, err = putThingIf(db.withLogger(ctx), tx, key, in_table, in_url, in_data, expected.ClockID, expected.TSN)
+		return err
+	})
+	return t, err
+}
 
-	return
+// Delete a thing
+//
+// Package Export
+func (db *Database) DeleteThing(in_table string, in_url string) error {
+	return db.DeleteThingContext(context.Background(), in_table, in_url)
 }
 
-// delete an entry
-func deletePowerData(dbconnect *sql.DB, in_key string) {
+// Delete a thing
+//
+// Package Export
+func (db *Database) DeleteThingContext(ctx context.Context, in_table string, in_url string) error {
 
-	_, err := dbconnect.Exec("select power.delete( $1 )", in_key)
+	var found bool
 
-	checkErr("power.delete", err)
+	key, err := db.signingKey(db.withLogger(ctx))
+	if err != nil {
+		return err
+	}
 
-	return
+	err = inTx(ctx, db.dbconnect, "delete thing", func(tx *sql.Tx) (err error) {
+		found, err = deleteThing(db.withLogger(ctx), tx, key, in_table, in_url)
+		return err
+	})
+	if err == nil && !found {
+		err = notFound("thing " + in_table + "/" + in_url)
+	}
+	return err
+}
+
+// Delete a thing, if expected is its current version
+//
+// Otherwise the error wraps ErrStaleVersion.
+//
+// Package Export
+func (db *Database) DeleteThingIf(in_table string, in_url string, expected Thing) error {
+	return db.DeleteThingIfContext(context.Background(), in_table, in_url, expected)
+}
+
+// Delete a thing, if expected is its current version
+//
+// Package Export
+func (db *Database) DeleteThingIfContext(ctx context.Context, in_table string, in_url string, expected Thing) error {
+
+	var found bool
+
+	key, err := db.signingKey(db.withLogger(ctx))
+	if err != nil {
+		return err
+	}
+
+	err = inTx(ctx, db.dbconnect, "delete thing", func(tx *sql.Tx) (err error) {
+		found, err = deleteThingIf(db.withLogger(ctx), tx, key, in_table, in_url, expected.ClockID, expected.TSN)
+		return err
+	})
+	if err == nil && !found {
+		err = notFound("thing " + in_table + "/" + in_url)
+	}
+	return err
+}
+
+// List all things of a table
+//
+// Package Export
+func (db *Database) ListThings(in_table string) (Things, error) {
+	return db.ListThingsContext(context.Background(), in_table)
+}
+
+// List all things of a table
+//
+// Package Export
+func (db *Database) ListThingsContext(ctx context.Context, in_table string) (Things, error) {
+	return listThings(db.withLogger(ctx), db.dbconnect, in_table)
 }
-*/
@@ -0,0 +1,205 @@
+// ENGINE TOMBSTONES
+//
+// Package for manage power engine data
+// Replication of deletes
+//
+// Every delete leaves a tombstone with the url, the coordinates of the
+// delete and the version it removed. Sync carries tombstones to the
+// other nodes; they are collected once they are older than the retention
+// and every known peer has passed them.
+package engine3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// the retention of tombstones, if none is set for a Database
+const DefaultTombstoneRetention = 7 * 24 * time.Hour
+
+// a recorded delete
+type tombstone struct {
+	table          string
+	url            string
+	ckey           []byte
+	clockid        int64 // the delete
+	tsn            int64
+	deletedClockID int64 // the version that was deleted
+	deletedTSN     int64
+	deletedVV      VersionVector // its version vector, nil for tombstones from before
+	sig            []byte        // signature of the deleting node
+}
+
+// read the vector of the deleted version
+func (ts *tombstone) scanVV(vv []byte) error {
+
+	ts.deletedVV = nil
+	if vv != nil {
+		return json.Unmarshal(vv, &ts.deletedVV)
+	}
+	return nil
+}
+
+// Calling database stored functions
+
+// read the tombstone of a delete, false if it is not there (anymore)
+func getTombstone(ctx context.Context, q querier, in_table string, in_clockid int64, in_tsn int64) (tombstone, bool, error) {
+
+	ts := tombstone{table: in_table, clockid: in_clockid, tsn: in_tsn}
+
+	row := q.QueryRowContext(ctx, "select * from nodes.getTombstone( $1, $2, $3 )", in_table, in_clockid, in_tsn)
+	checkRow(row)
+
+	var vv []byte
+
+	err := row.Scan(&ts.url, &ts.ckey, &ts.deletedClockID, &ts.deletedTSN, &ts.sig, &vv)
+	if err == sql.ErrNoRows {
+		return ts, false, nil
+	}
+	if err == nil {
+		err = ts.scanVV(vv)
+	}
+
+	return ts, err == nil, wrapErr("nodes.getTombstone "+in_table, err)
+}
+
+// the tombstones of a table, oldest first
+func listTombstones(ctx context.Context, q querier, in_table string) ([]tombstone, error) {
+
+	rows, err := q.QueryContext(ctx, "select * from nodes.list_tombstones( $1 )", in_table)
+	if err != nil {
+		return nil, wrapErr("nodes.list_tombstones "+in_table, err)
+	}
+	defer rows.Close()
+
+	var result []tombstone
+	for rows.Next() {
+		var vv []byte
+		ts := tombstone{table: in_table}
+
+		if err := rows.Scan(&ts.url, &ts.ckey, &ts.clockid, &ts.tsn, &ts.deletedClockID, &ts.deletedTSN, &ts.sig, &vv); err != nil {
+			return nil, wrapErr("scan tombstone", err)
+		}
+		if err := ts.scanVV(vv); err != nil {
+			return nil, wrapErr("scan tombstone", err)
+		}
+		result = append(result, ts)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("end reading tombstones loop", err)
+	}
+
+	return result, nil
+}
+
+// apply the tombstone of another node (idempotent)
+//
+// only a local version the delete covers is removed, a later one is kept
+// (aeSkipped)
+func ae_tombstone(ctx context.Context, q querier, ts tombstone) (aeStatus, error) {
+
+	var status string
+
+	row := q.QueryRowContext(ctx, "select nodes.ae_tombstone( $1, $2, $3, $4, $5, $6, $7, $8, $9 )",
+		ts.table, ts.url, ts.ckey, ts.clockid, ts.tsn, ts.deletedClockID, ts.deletedTSN, ts.deletedVV.param(), sigParam(ts.sig))
+	checkRow(row)
+
+	err := row.Scan(&status)
+
+	return aeStatus(status), wrapErr("nodes.ae_tombstone "+ts.table, err)
+}
+
+// remember a high water mark of a peer
+func putPeerHigh(ctx context.Context, q querier, in_peer int64, in_clockid int64, in_tsn int64) error {
+
+	_, err := q.ExecContext(ctx, "select nodes.putPeerHigh( $1, $2, $3 )", in_peer, in_clockid, in_tsn)
+
+	return wrapErr("nodes.putPeerHigh", err)
+}
+
+// collect the tombstones every known peer has passed
+func gcTombstones(ctx context.Context, q querier, retention time.Duration) (int64, error) {
+
+	var count int64
+
+	row := q.QueryRowContext(ctx, "select nodes.gc_tombstones( make_interval( secs => $1 ) )", retention.Seconds())
+	checkRow(row)
+
+	err := row.Scan(&count)
+	if err == nil {
+		logger(ctx).Info("collected tombstones", "count", count, "retention", retention)
+	}
+
+	return count, wrapErr("nodes.gc_tombstones", err)
+}
+
+/*
+ * apply a remote tombstone in tx
+ *
+ * only a local version the delete covers is removed (see ae_tombstone): a
+ * write after or concurrent to the delete is kept.
+ *
+ * the signature is checked like the one of a version
+ */
+func applyTombstone(ctx context.Context, tx *sql.Tx, policy syncPolicy, ts tombstone, stats *SyncStats) error {
+
+	ok, err := acceptSigned(ctx, tx, policy, ts.table, ts.url, nil, ts.clockid, ts.tsn, ts.sig, nil, stats)
+	if err != nil || !ok {
+		return err
+	}
+
+	status, err := ae_tombstone(ctx, tx, ts)
+	if err != nil {
+		return err
+	}
+
+	// a tombstone, which removed nothing, is no delete
+	switch status {
+	case aeApplied:
+		stats.Deleted++
+	case aeRecorded, aeSkipped:
+		// the url was not there, the tombstone is known already or the url
+		// holds a version written after the delete
+		stats.Skipped++
+	}
+	return nil
+}
+
+//
+// PACKAGE EXPORTS
+
+// Set how long tombstones are kept at least
+//
+// Zero restores DefaultTombstoneRetention.
+//
+// Package Export
+func (db *Database) SetTombstoneRetention(d time.Duration) {
+	db.retention.Store(int64(d))
+}
+
+// the tombstone retention of the database
+func (db *Database) tombstoneRetention() time.Duration {
+
+	if d := time.Duration(db.retention.Load()); d > 0 {
+		return d
+	}
+	return DefaultTombstoneRetention
+}
+
+// Remove the tombstones, which are older than the retention and passed
+// by every peer this database syncs from
+//
+// Package Export
+func (db *Database) CollectTombstones() (int64, error) {
+	return db.CollectTombstonesContext(context.Background())
+}
+
+// Remove the tombstones, which are older than the retention and passed
+// by every peer this database syncs from
+//
+// Package Export
+func (db *Database) CollectTombstonesContext(ctx context.Context) (int64, error) {
+	return gcTombstones(db.withLogger(ctx), db.dbconnect, db.tombstoneRetention())
+}
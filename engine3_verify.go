@@ -0,0 +1,345 @@
+// ENGINE INTEGRITY
+//
+// Package for manage power engine data
+// Verification of the content digests
+//
+// ckey is the digest of url, cval the digest of data. A row, which was
+// edited directly in SQL or corrupted in transfer, no longer matches its
+// digests. Verify reports such rows; in strict mode sync refuses incoming
+// versions with mismatching digests.
+//
+// The algorithm is a setting of the database and recorded per row, so
+// rows and peers with different algorithms can coexist while Rehash
+// converts a database.
+package engine3
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+)
+
+// Digest algorithms
+const (
+	DigestMD5    = "md5" // the original algorithm, rows without alg
+	DigestSHA256 = "sha256"
+)
+
+// rows rehashed per transaction by Rehash
+const rehashBatch = 1000
+
+// compute a digest, false for an unknown algorithm
+func hashWith(alg string, text []byte) ([]byte, bool) {
+
+	switch alg {
+	case "", DigestMD5:
+		sum := md5.Sum(text)
+		return sum[:], true
+	case DigestSHA256:
+		sum := sha256.Sum256(text)
+		return sum[:], true
+	}
+	return nil, false
+}
+
+// the algorithm as a text parameter (NULL for md5 of old rows)
+func algParam(alg string) interface{} {
+
+	if alg == "" {
+		return nil
+	}
+	return alg
+}
+
+// A row, whose digests do not match its content
+type Mismatch struct {
+	Table   string `json:"table"`
+	URL     string `json:"url"`
+	ClockID int64  `json:"clockid"`
+	TSN     int64  `json:"tsn"`
+	Field   string `json:"field"` // "ckey", "cval" or "alg" (unknown algorithm)
+}
+
+// the digest fields of a thing, which do not match its url and data
+func checkDigests(t Thing) []string {
+	var result []string
+
+	ckey, ok := hashWith(t.Alg, []byte(t.URL))
+	if !ok {
+		return []string{"alg"}
+	}
+	if !bytes.Equal(t.CKey, ckey) {
+		result = append(result, "ckey")
+	}
+
+	cval, _ := hashWith(t.Alg, t.Data)
+	if !bytes.Equal(t.CVal, cval) {
+		result = append(result, "cval")
+	}
+
+	return result
+}
+
+// Calling database stored functions
+
+// read the digest algorithm of the database
+func digestAlg(ctx context.Context, q querier) (string, error) {
+
+	var alg string
+
+	row := q.QueryRowContext(ctx, "select nodes.digest_alg()")
+	checkRow(row)
+
+	err := row.Scan(&alg)
+
+	return alg, wrapErr("nodes.digest_alg", err)
+}
+
+// set the digest algorithm of the database for new writes
+func setDigestAlg(ctx context.Context, q querier, in_alg string) error {
+
+	_, err := q.ExecContext(ctx, "select nodes.set_digest_alg( $1 )", in_alg)
+
+	return wrapErr("nodes.set_digest_alg", err)
+}
+
+// a row rehashed by nodes.rehash
+type rehashed struct {
+	url     string
+	cval    []byte
+	clockid int64
+	tsn     int64
+	resign  bool // a signed row of the local clock, which lost its signature
+}
+
+/*
+ * rehash a batch of rows of a table, returns the number of rows
+ *
+ * the signed rows of the local clock are signed again with key; without
+ * a key the batch fails, rather than leave them unsigned
+ */
+func rehashTable(ctx context.Context, q querier, key ed25519.PrivateKey, in_table string, in_alg string, in_limit int) (int64, error) {
+
+	var batch []rehashed
+
+	rows, err := q.QueryContext(ctx, "select * from nodes.rehash( $1, $2, $3 )", in_table, in_alg, in_limit)
+	if err != nil {
+		return 0, wrapErr("nodes.rehash "+in_table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r rehashed
+
+		if err := rows.Scan(&r.url, &r.cval, &r.clockid, &r.tsn, &r.resign); err != nil {
+			return 0, wrapErr("scan rehashed row", err)
+		}
+		batch = append(batch, r)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, wrapErr("end reading rehashed rows loop", err)
+	}
+	rows.Close()
+
+	for _, r := range batch {
+		if !r.resign {
+			continue
+		}
+		if key == nil {
+			return 0, fmt.Errorf("engine3: rehash %s/%s: signed row, but no signing key to sign it again", in_table, r.url)
+		}
+		if err := sign(ctx, q, in_table, r.clockid, r.tsn, ed25519.Sign(key, signedMessage(r.url, r.cval, r.clockid, r.tsn))); err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(batch)), nil
+}
+
+// the number of signed rows of other nodes, which keep their digests
+func rehashKept(ctx context.Context, q querier, in_table string, in_alg string) (int64, error) {
+
+	var count int64
+
+	row := q.QueryRowContext(ctx, "select nodes.rehash_kept( $1, $2 )", in_table, in_alg)
+	checkRow(row)
+
+	err := row.Scan(&count)
+
+	return count, wrapErr("nodes.rehash_kept "+in_table, err)
+}
+
+/*
+ * rehash all managed tables to the algorithm of the database
+ *
+ * every batch is a transaction of its own, so the tables stay available.
+ * Signed rows of other nodes cannot be signed again, they keep their
+ * digests and are logged.
+ */
+func rehash(ctx context.Context, dbconnect *sql.DB, key ed25519.PrivateKey) (int64, error) {
+	var total int64
+
+	alg, err := digestAlg(ctx, dbconnect)
+	if err != nil {
+		return 0, err
+	}
+
+	tables, err := getManagedTables(ctx, dbconnect)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, table := range tables {
+		for {
+			var n int64
+
+			err := inTx(ctx, dbconnect, "rehash", func(tx *sql.Tx) (err error) {
+				n, err = rehashTable(ctx, tx, key, table, alg, rehashBatch)
+				return err
+			})
+			if err != nil {
+				return total, err
+			}
+			total += n
+			if n == 0 {
+				break
+			}
+			logger(ctx).Debug("rehashed", "table", table, "alg", alg, "rows", n)
+		}
+
+		kept, err := rehashKept(ctx, dbconnect, table, alg)
+		if err != nil {
+			return total, err
+		}
+		if kept > 0 {
+			logger(ctx).Warn("signed rows of other nodes keep their digests", "table", table, "alg", alg, "rows", kept)
+		}
+	}
+
+	logger(ctx).Info("rehash", "alg", alg, "rows", total)
+	return total, nil
+}
+
+// scan a table for rows with mismatching digests
+func verify(ctx context.Context, q querier, in_table string) ([]Mismatch, error) {
+	var result []Mismatch
+
+	rows, err := q.QueryContext(ctx, "select * from nodes.thing_list( $1 )", in_table)
+	if err != nil {
+		return nil, wrapErr("nodes.thing_list", err)
+	}
+	defer rows.Close()
+
+	n := 0
+	for ; rows.Next(); n++ {
+		var t Thing
+
+		if err := scanThing(rows, &t); err != nil {
+			return nil, wrapErr("scan things", err)
+		}
+
+		for _, field := range checkDigests(t) {
+			result = append(result, Mismatch{Table: in_table, URL: t.URL, ClockID: t.ClockID, TSN: t.TSN, Field: field})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr("end reading things loop", err)
+	}
+
+	logger(ctx).Info("verified", "table", in_table, "rows", n, "mismatches", len(result))
+	return result, nil
+}
+
+//
+// PACKAGE EXPORTS
+
+// Check ckey and cval of every row of a managed table
+//
+// Returns one Mismatch per wrong digest, nil if the table is intact.
+//
+// Package Export
+func (db *Database) Verify(in_table string) ([]Mismatch, error) {
+	return db.VerifyContext(context.Background(), in_table)
+}
+
+// Check ckey and cval of every row of a managed table
+//
+// Package Export
+func (db *Database) VerifyContext(ctx context.Context, in_table string) ([]Mismatch, error) {
+	return verify(db.withLogger(ctx), db.dbconnect, in_table)
+}
+
+// Refuse incoming versions with mismatching digests or without a valid
+// signature when syncing into this database
+//
+// Refused versions are counted in SyncStats.Rejected and logged. Without
+// strict mode they are applied with a warning; unsigned versions of
+// nodes without a key silently. A wrong signature, and a missing one of a
+// node with a key, is refused always.
+//
+// Package Export
+func (db *Database) SetStrictIntegrity(strict bool) {
+	db.strict.Store(strict)
+}
+
+// Set the digest algorithm for new writes (DigestMD5 or DigestSHA256)
+//
+// Existing rows keep their digests until Rehash converts them.
+//
+// Package Export
+func (db *Database) SetDigestAlgorithm(alg string) error {
+	return db.SetDigestAlgorithmContext(context.Background(), alg)
+}
+
+// Set the digest algorithm for new writes (DigestMD5 or DigestSHA256)
+//
+// Package Export
+func (db *Database) SetDigestAlgorithmContext(ctx context.Context, alg string) error {
+	return setDigestAlg(ctx, db.dbconnect, alg)
+}
+
+// Read the digest algorithm for new writes
+//
+// Package Export
+func (db *Database) DigestAlgorithm() (string, error) {
+	return db.DigestAlgorithmContext(context.Background())
+}
+
+// Read the digest algorithm for new writes
+//
+// Package Export
+func (db *Database) DigestAlgorithmContext(ctx context.Context) (string, error) {
+	return digestAlg(ctx, db.dbconnect)
+}
+
+// Rehash the rows of all managed tables to the digest algorithm
+//
+// The rows are converted in batches while the database stays online;
+// no new versions are written. The signed rows of this node are signed
+// again; signed rows of other nodes keep their digests, only their node
+// can sign them. Rows whose digests do not match their content are left
+// for Verify to report. Returns the number of rows.
+//
+// Package Export
+func (db *Database) Rehash() (int64, error) {
+	return db.RehashContext(context.Background())
+}
+
+// Rehash the rows of all managed tables to the digest algorithm
+//
+// Package Export
+func (db *Database) RehashContext(ctx context.Context) (int64, error) {
+
+	ctx = db.withLogger(ctx)
+
+	key, err := db.signingKey(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return rehash(ctx, db.dbconnect, key)
+}
@@ -0,0 +1,128 @@
+// ENGINE VERSION VECTORS
+//
+// Package for manage power engine data
+// Causal order of versions
+//
+// A version vector maps every clockid a version is derived from to the
+// highest tsn of that clock. Two versions are ordered, if the vector of
+// one dominates the other; otherwise they were written concurrently.
+package engine3
+
+import (
+	"encoding/json"
+)
+
+// clockid -> tsn
+type VersionVector map[int64]int64
+
+// the causal order of two versions
+type Ordering int
+
+const (
+	Equal      Ordering = iota // the same history
+	Before                     // a happened before b
+	After                      // b happened before a
+	Concurrent                 // neither has seen the other
+)
+
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	}
+	return "concurrent"
+}
+
+// Compare two version vectors
+func (vv VersionVector) Compare(other VersionVector) Ordering {
+	var less, greater bool
+
+	for clockid, tsn := range vv {
+		switch o := other[clockid]; {
+		case tsn < o:
+			less = true
+		case tsn > o:
+			greater = true
+		}
+	}
+	for clockid, o := range other {
+		if _, ok := vv[clockid]; !ok && o > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	}
+	return Equal
+}
+
+// the pairwise maximum of two version vectors
+func (vv VersionVector) Merge(other VersionVector) VersionVector {
+
+	result := VersionVector{}
+
+	for clockid, tsn := range vv {
+		result[clockid] = tsn
+	}
+	for clockid, tsn := range other {
+		if tsn > result[clockid] {
+			result[clockid] = tsn
+		}
+	}
+
+	return result
+}
+
+// the version vector as a jsonb parameter (NULL when empty)
+func (vv VersionVector) param() interface{} {
+
+	if len(vv) == 0 {
+		return nil
+	}
+	text, err := json.Marshal(vv)
+	if err != nil {
+		return nil
+	}
+	return string(text)
+}
+
+// The version vector of a thing
+//
+// A thing written before version vectors were recorded falls back to its
+// own coordinate.
+func (t Thing) Version() VersionVector {
+
+	if len(t.VV) > 0 {
+		return t.VV
+	}
+	return VersionVector{t.ClockID: t.TSN}
+}
+
+// Compare the versions of two things
+//
+// Without recorded version vectors, versions of different clocks are
+// Concurrent, unless they are the same version.
+//
+// Package Export
+func Compare(a, b Thing) Ordering {
+
+	if a.ClockID == b.ClockID && a.TSN == b.TSN {
+		return Equal
+	}
+	return a.Version().Compare(b.Version())
+}
+
+// true, if both things carry a recorded version vector
+func hasVersionVectors(a, b Thing) bool {
+	return len(a.VV) > 0 && len(b.VV) > 0
+}
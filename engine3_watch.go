@@ -0,0 +1,235 @@
+// ENGINE WATCH
+//
+// Package for manage power engine data
+// Change feed
+//
+// Every oplog entry is announced with NOTIFY (see
+// migrations/011_change_feed.sql). Watch listens for them on a connection
+// of its own; after a reconnect it reads the oplog entries it missed
+// with an OplogCursor.
+package engine3
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// the channel the oplog entries are announced on
+const changeChannel = "engine3_changes"
+
+// reconnect intervals and idle time before the connection is checked
+const (
+	watchMinReconnect = time.Second
+	watchMaxReconnect = time.Minute
+	watchPing         = 90 * time.Second
+)
+
+// A change announced by the database
+type ChangeEvent struct {
+	Table   string `json:"table"`
+	ClockID int64  `json:"clockid"`
+	TSN     int64  `json:"tsn"`
+	Op      string `json:"op"` // I, U or D
+}
+
+// The changes a Watch delivers, empty fields match all
+type WatchFilter struct {
+	Table   string
+	ClockID int64
+}
+
+func (f WatchFilter) matches(e ChangeEvent) bool {
+	return (f.Table == "" || f.Table == e.Table) && (f.ClockID == 0 || f.ClockID == e.ClockID)
+}
+
+// read the payload of a notification
+func parseChange(payload string) (ChangeEvent, error) {
+	var e ChangeEvent
+
+	err := json.Unmarshal([]byte(payload), &e)
+
+	return e, wrapErr("parse change", err)
+}
+
+// one subscription: the last tsn seen of every clock and, per clock, the
+// highest tsn the last backfill delivered, whose entries may be announced
+// as well
+type watcher struct {
+	db         *Database
+	filter     WatchFilter
+	out        chan ChangeEvent
+	last       map[int64]int64
+	backfilled map[int64]int64
+}
+
+// deliver an event, false when ctx is done
+func (w *watcher) send(ctx context.Context, e ChangeEvent) bool {
+
+	if e.TSN > w.last[e.ClockID] {
+		w.last[e.ClockID] = e.TSN
+	}
+	if !w.filter.matches(e) {
+		return true
+	}
+
+	select {
+	case w.out <- e:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// remember the high water marks as the starting point
+func (w *watcher) start(ctx context.Context) error {
+
+	hwms, err := getRemoteHighs(ctx, w.db.dbconnect)
+	if err != nil {
+		return err
+	}
+	for _, hwm := range hwms {
+		w.last[hwm.ClockID] = hwm.TSN
+	}
+
+	return nil
+}
+
+// deliver the oplog entries written after the last ones seen
+func (w *watcher) backfill(ctx context.Context) error {
+
+	hwms, err := getRemoteHighs(ctx, w.db.dbconnect)
+	if err != nil {
+		return err
+	}
+
+	w.backfilled = map[int64]int64{}
+	for _, hwm := range hwms {
+		if hwm.TSN <= w.last[hwm.ClockID] || (w.filter.ClockID != 0 && w.filter.ClockID != hwm.ClockID) {
+			continue
+		}
+
+		c := newOplogCursor(w.db, hwm.ClockID, w.last[hwm.ClockID], 0)
+		for {
+			oplogs, err := c.next(ctx, w.db.dbconnect)
+			if err != nil {
+				return err
+			}
+			if len(oplogs) == 0 {
+				break
+			}
+
+			for _, ol := range oplogs {
+				e := ChangeEvent{Table: ol.Table, ClockID: ol.ClockID, TSN: ol.TSN, Op: ol.Op}
+
+				if e.TSN > w.backfilled[e.ClockID] {
+					w.backfilled[e.ClockID] = e.TSN
+				}
+				if !w.send(ctx, e) {
+					return ctx.Err()
+				}
+			}
+		}
+		logger(ctx).Debug("change feed backfilled", "clockid", hwm.ClockID, "tsn", c.tsn)
+	}
+
+	return nil
+}
+
+// listen until ctx is done
+func (w *watcher) run(ctx context.Context, l *pq.Listener) {
+	defer close(w.out)
+	defer l.Close()
+
+	log := logger(ctx)
+
+	idle := time.NewTimer(watchPing)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case n := <-l.Notify:
+			if n == nil {
+				// reconnected, notifications may have been lost
+				if err := w.backfill(ctx); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					log.Warn("change feed backfill failed", "error", err)
+				}
+				continue
+			}
+
+			e, err := parseChange(n.Extra)
+			if err != nil {
+				log.Warn("change feed notification ignored", "error", err, "payload", n.Extra)
+				continue
+			}
+			// delivered by the backfill already; live notifications are
+			// not compared with w.last, concurrent writers commit out of order
+			if e.TSN <= w.backfilled[e.ClockID] {
+				continue
+			}
+			if !w.send(ctx, e) {
+				return
+			}
+
+		case <-idle.C:
+			go l.Ping()
+		}
+
+		idle.Reset(watchPing)
+	}
+}
+
+//
+// PACKAGE EXPORTS
+
+// Subscribe to the changes of the database
+//
+// The channel delivers the changes committed after the call, which match
+// filter. The subscription reconnects on its own and delivers the changes
+// written while it was disconnected from the oplog. The channel is closed,
+// when ctx is done or the subscription cannot be started.
+//
+// Package Export
+func (db *Database) Watch(ctx context.Context, filter WatchFilter) <-chan ChangeEvent {
+
+	ctx = db.withLogger(ctx)
+	log := logger(ctx).With("table", filter.Table, "clockid", filter.ClockID)
+
+	w := &watcher{db: db, filter: filter, out: make(chan ChangeEvent, 64), last: map[int64]int64{}}
+
+	l := pq.NewListener(db.dbname, watchMinReconnect, watchMaxReconnect, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			log.Warn("change feed disconnected", "error", err)
+		case pq.ListenerEventReconnected:
+			log.Info("change feed reconnected")
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Debug("change feed connection attempt failed", "error", err)
+		}
+	})
+
+	// listen first, so that no change falls between start and listen
+	err := l.Listen(changeChannel)
+	if err == nil {
+		err = w.start(ctx)
+	}
+	if err != nil {
+		log.Error("change feed not started", "error", err)
+		l.Close()
+		close(w.out)
+		return w.out
+	}
+
+	log.Debug("change feed started")
+	go w.run(ctx, l)
+
+	return w.out
+}
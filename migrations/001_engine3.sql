@@ -1,6 +1,9 @@
 /* Database Schema for Energy Management Cloud
  *
  * Version 3
+ *
+ * Migration 1: applied by (*Database).Migrate. The script can be run
+ * again on a database, which was set up by hand from engine3.sql.
  */
 
 /* 
@@ -40,7 +43,7 @@ CREATE SCHEMA IF NOT EXISTS nodes;
  * the "Things" datastructure and package.
  *
  */
-CREATE TABLE nodes.base (
+CREATE TABLE IF NOT EXISTS nodes.base (
     ckey    bytea,    
     cval    bytea,
     url     text,  
@@ -50,13 +53,6 @@ CREATE TABLE nodes.base (
     primary key(url),
     unique (clockid, tsn )
 );
-/* 
- * the table to describe all management nodes
- * 
- *(derived from base)
- */
-CREATE TABLE nodes.systems ( LIKE nodes.base );
-
 /* 
  * sequence counter (local) (managed via clockid)
  * 
@@ -67,8 +63,8 @@ CREATE TABLE nodes.systems ( LIKE nodes.base );
  * We generate a clockid via the nodes.clockidsn sequence
  * seperately
  */
-CREATE SEQUENCE nodes.tsn;
-CREATE SEQUENCE nodes.clockidsn;
+CREATE SEQUENCE IF NOT EXISTS nodes.tsn;
+CREATE SEQUENCE IF NOT EXISTS nodes.clockidsn;
 
 
 /* 
@@ -110,12 +106,20 @@ $$ LANGUAGE plpgsql;
  *
  * The clockID shoud never be zero!
  * The function is supposed to return a constant (IMMUTABLE)
+ *
+ * It is only created once, so that a registered clockid survives a re-run
  */
-CREATE OR REPLACE FUNCTION nodes.myclockid() RETURNS bigint AS $$ 
-      BEGIN
-       RETURN 0;
-      END;
-$$ LANGUAGE plpgsql IMMUTABLE;
+DO $do$
+   BEGIN
+     IF to_regprocedure( 'nodes.myclockid()' ) IS NULL THEN
+       CREATE FUNCTION nodes.myclockid() RETURNS bigint AS $$ 
+             BEGIN
+              RETURN 0;
+             END;
+       $$ LANGUAGE plpgsql IMMUTABLE;
+     END IF;
+   END;
+$do$;
 
 /* 
  * set my clockid
@@ -188,7 +192,7 @@ $$ LANGUAGE plpgsql;
 /*
  * High-water mark vector of all known nodes
  */
-CREATE TABLE nodes.highwatermarks (
+CREATE TABLE IF NOT EXISTS nodes.highwatermarks (
      clockid    bigint,
      tsn        bigint,
      PRIMARY KEY( clockid )
@@ -199,7 +203,7 @@ CREATE TABLE nodes.highwatermarks (
  *
  * logs all change operations with clockid, tsn and tablename
  */
-CREATE TABLE nodes.oplog (
+CREATE TABLE IF NOT EXISTS nodes.oplog (
      
      clockid    bigint,
      tsn        bigint,
@@ -244,10 +248,6 @@ CREATE OR REPLACE FUNCTION onChange() RETURNS TRIGGER AS $$
      END;
 $$ LANGUAGE plpgsql;
 
-/* All managed tables must be isted here */
-CREATE TRIGGER onChange BEFORE INSERT OR UPDATE OR DELETE ON nodes.systems
-  FOR EACH ROW EXECUTE PROCEDURE onChange();
-
 /* 
  * read the (received) high-water marks of remote nodes
  */
@@ -348,37 +348,225 @@ CREATE OR REPLACE FUNCTION nodes.checkHigh( _clockid bigint ) RETURNS  bigint AS
    END
 $$ LANGUAGE plpgsql;
 
-/* General Anti-Entropy functions : to be used for synchronization only */
+/* 
+ * Catalog of managed tables
+ *
+ * every table derived from nodes.base, which is tracked by the oplog and
+ * synchronized, is recorded here by nodes.create_managed_table
+ */
+CREATE TABLE IF NOT EXISTS nodes.managed_tables (
+     table_name text,
+     created    timestamp with time zone DEFAULT now(),
+     PRIMARY KEY( table_name )
+);
+
+/* 
+ * raise an exception, if a table is not in the catalog
+ */
+CREATE OR REPLACE FUNCTION nodes.check_managed( _table text ) RETURNS VOID AS $$
+   BEGIN
+     PERFORM 1 FROM nodes.managed_tables WHERE table_name = _table;
+     IF NOT FOUND THEN
+       RAISE EXCEPTION 'nodes.% is not a managed table', _table
+         USING ERRCODE = 'undefined_table';
+     END IF;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* 
+ * General Anti-Entropy functions : to be used for synchronization only
+ *
+ * generated for every managed table as
+ *   nodes.ae_get_<table>, nodes.ae_put_<table> and nodes.ae_delete_<table>
+ */
+CREATE OR REPLACE FUNCTION nodes.create_ae_functions( _name text ) RETURNS VOID AS $body$
+   BEGIN
+     /* GET */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _clockid bigint, _tsn bigint ) RETURNS SETOF nodes.base AS $fn$
+          BEGIN
+             RETURN QUERY 
+               SELECT ckey, cval, url, data, clockid, tsn FROM nodes.%2$I
+                  WHERE clockid = _clockid and tsn = _tsn;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_get_' || _name, _name );
+
+     /* PUT */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint ) RETURNS VOID AS $fn$
+          BEGIN
+             LOOP
+               BEGIN
+                INSERT INTO nodes.%2$I( ckey, cval, url, data, clockid, tsn ) 
+                VALUES (_ckey, _cval, _url, _data, _clockid, _tsn );
+                RETURN;
+                EXCEPTION WHEN unique_violation THEN
+                  /*remove older versions, can there be more ?*/
+                  DELETE FROM nodes.%2$I where url = _url AND clockid = _clockid and tsn < _tsn;
+                  IF NOT FOUND THEN
+                    /* same or newer version already there: nothing to do */
+                    RETURN;
+                  END IF;
+               END;
+             END LOOP;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_put_' || _name, _name );
+
+     /* DELETE */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _clockid bigint, _tsn bigint ) RETURNS VOID AS $fn$
+          BEGIN
+             DELETE FROM nodes.%2$I WHERE clockid = _clockid and tsn = _tsn; 
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_delete_' || _name, _name );
+   END;
+$body$ LANGUAGE plpgsql;
+
+/* 
+ * Create a managed table
+ *
+ * the table is derived from nodes.base, gets the onChange trigger for the
+ * oplog and the anti-entropy functions, and is recorded in the catalog.
+ * Calling it for an existing managed table is harmless.
+ */
+CREATE OR REPLACE FUNCTION nodes.create_managed_table( _name text ) RETURNS VOID AS $$
+   BEGIN
+     /* the name becomes part of function names: keep it a plain identifier */
+     IF _name !~ '^[a-z_][a-z0-9_]{0,39}$' THEN
+       RAISE EXCEPTION 'invalid managed table name %', _name
+         USING ERRCODE = 'invalid_name';
+     END IF;
+
+     EXECUTE format( 'CREATE TABLE IF NOT EXISTS nodes.%I ( LIKE nodes.base INCLUDING ALL )', _name );
+
+     EXECUTE format( 'DROP TRIGGER IF EXISTS onChange ON nodes.%I', _name );
+     EXECUTE format( 'CREATE TRIGGER onChange BEFORE INSERT OR UPDATE OR DELETE ON nodes.%I
+                        FOR EACH ROW EXECUTE PROCEDURE onChange()', _name );
+
+     PERFORM nodes.create_ae_functions( _name );
+
+     BEGIN
+       INSERT INTO nodes.managed_tables( table_name ) VALUES ( _name );
+     EXCEPTION WHEN unique_violation THEN
+       /* already registered */
+     END;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* 
+ * Anti-Entropy dispatch : call the generated function of a managed table
+ */
 /* GET */
-CREATE OR REPLACE FUNCTION nodes.ae_get_systems( _clockid bigint, _tsn bigint ) RETURNS  SETOF nodes.base  AS $$
+CREATE OR REPLACE FUNCTION nodes.ae_get( _table text, _clockid bigint, _tsn bigint ) RETURNS SETOF nodes.base AS $$
    BEGIN
-      RETURN QUERY 
-        SELECT ckey, cval, url, data, clockid, tsn  from nodes.systems 
-           where clockid = _clockid and tsn = _tsn;
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format( 'SELECT * FROM nodes.%I( $1, $2 )', 'ae_get_' || _table )
+        USING _clockid, _tsn;
    END;
 $$ LANGUAGE plpgsql;
 
 /* PUT */
-CREATE OR REPLACE FUNCTION nodes.ae_put_systems( _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint ) RETURNS VOID AS $$
+CREATE OR REPLACE FUNCTION nodes.ae_put( _table text, _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint ) RETURNS VOID AS $$
    BEGIN
-      LOOP
-        BEGIN
-         INSERT INTO nodes.systems( ckey, cval, url, data, clockid, tsn ) 
-         VALUES (_ckey, _cval, _url, _data, _clockid, _tsn );
-         EXCEPTION WHEN unique_violation THEN
-           /*remove older versions, can there be more ?*/
-           DELETE FROM nodes.systems where url = _url AND clockid = _clockid and tsn < _tsn;
-        END;
-      END LOOP;
+      PERFORM nodes.check_managed( _table );
+      EXECUTE format( 'SELECT nodes.%I( $1, $2, $3, $4, $5, $6 )', 'ae_put_' || _table )
+        USING _ckey, _cval, _url, _data, _clockid, _tsn;
    END;
 $$ LANGUAGE plpgsql;
 
 /* DELETE */
-CREATE OR REPLACE FUNCTION nodes.ae_delete_systems( _clockid bigint, _tsn bigint ) RETURNS VOID AS $$
+CREATE OR REPLACE FUNCTION nodes.ae_delete( _table text, _clockid bigint, _tsn bigint ) RETURNS VOID AS $$
    BEGIN
-        BEGIN
-         DELETE FROM nodes.systems WHERE clockid = _clockid and tsn = _tsn; 
-        END;
+      PERFORM nodes.check_managed( _table );
+      EXECUTE format( 'SELECT nodes.%I( $1, $2 )', 'ae_delete_' || _table )
+        USING _clockid, _tsn;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* 
+ * list the managed tables
+ */
+CREATE OR REPLACE FUNCTION nodes.getManagedTables() RETURNS TABLE( _table_name text ) AS $$
+   BEGIN
+     RETURN QUERY
+        SELECT table_name FROM nodes.managed_tables ORDER BY table_name;
+   END;
+$$ LANGUAGE plpgsql;
+
+
+/* 
+ * Generic thing functions : read and write the current version of an
+ * object of any table derived from nodes.base
+ *
+ * Writes get a new tsn and the local clockid, ckey and cval are computed
+ * as in nodes.register
+ */
+/* GET */
+CREATE OR REPLACE FUNCTION nodes.thing_get( _table text, _url text ) RETURNS SETOF nodes.base AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT ckey, cval, url, data, clockid, tsn FROM nodes.%I WHERE url = $1', _table )
+        USING _url;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* LIST */
+CREATE OR REPLACE FUNCTION nodes.thing_list( _table text ) RETURNS SETOF nodes.base AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT ckey, cval, url, data, clockid, tsn FROM nodes.%I ORDER BY url', _table );
+   END;
+$$ LANGUAGE plpgsql;
+
+/* PUT */
+CREATE OR REPLACE FUNCTION nodes.thing_put( _table text, _url text, _data json ) RETURNS SETOF nodes.base AS $$
+   DECLARE
+      _ckey    bytea;
+      _cval    bytea;
+      old_cval bytea;
+      old_data json;
+      _count   bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     _ckey := digest( _url, 'md5' );
+     _cval := digest( _data::text, 'md5' );
+
+     EXECUTE format( 'SELECT cval, data FROM nodes.%I WHERE url = $1', _table )
+        INTO old_cval, old_data USING _url;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     IF _count = 0 THEN
+        EXECUTE format( 'INSERT INTO nodes.%I( ckey, cval, url, data, clockid, tsn )
+                          VALUES ( $1, $2, $3, $4, nodes.myclockid(), nodes.new_tsn() )', _table )
+           USING _ckey, _cval, _url, _data;
+     ELSIF old_cval <> _cval OR old_data::text <> _data::text THEN
+        /* changed: new version with new tsn */
+        EXECUTE format( 'UPDATE nodes.%I
+                            SET cval = $1, data = $2, clockid = nodes.myclockid(), tsn = nodes.new_tsn()
+                          WHERE url = $3', _table )
+           USING _cval, _data, _url;
+     END IF;
+
+     RETURN QUERY SELECT * FROM nodes.thing_get( _table, _url );
+   END;
+$$ LANGUAGE plpgsql;
+
+/* DELETE */
+CREATE OR REPLACE FUNCTION nodes.thing_delete( _table text, _url text ) RETURNS boolean AS $$
+   DECLARE
+      _count bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     EXECUTE format( 'DELETE FROM nodes.%I WHERE url = $1', _table ) USING _url;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+     RETURN _count > 0;
    END;
 $$ LANGUAGE plpgsql;
 
@@ -395,3 +583,10 @@ CREATE OR REPLACE FUNCTION nodes.SyncGet_Systems( in_clockid bigint, in_tsn bigi
 $$ LANGUAGE plpgsql;
  */
 
+
+/* 
+ * the table to describe all management nodes
+ * 
+ *(derived from base)
+ */
+SELECT nodes.create_managed_table( 'systems' );
@@ -0,0 +1,89 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 2: error codes
+ *
+ * Errors raised for the Go side carry their own SQLSTATE:
+ *
+ *   EN001  the local node has no clockid yet (not registered)
+ *   EN003  the current version is not the expected one (stale)
+ */
+
+/* 
+ * raise an exception, if the local node is not registered
+ */
+CREATE OR REPLACE FUNCTION nodes.check_registered() RETURNS VOID AS $$
+   BEGIN
+     IF nodes.myclockid() = 0 THEN
+       RAISE EXCEPTION 'node is not registered (clockid 0)'
+         USING ERRCODE = 'EN001';
+     END IF;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* PUT (replaces version 1: refuse writes without clockid) */
+CREATE OR REPLACE FUNCTION nodes.thing_put( _table text, _url text, _data json ) RETURNS SETOF nodes.base AS $$
+   DECLARE
+      _ckey    bytea;
+      _cval    bytea;
+      old_cval bytea;
+      old_data json;
+      _count   bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+     PERFORM nodes.check_registered();
+
+     _ckey := digest( _url, 'md5' );
+     _cval := digest( _data::text, 'md5' );
+
+     EXECUTE format( 'SELECT cval, data FROM nodes.%I WHERE url = $1', _table )
+        INTO old_cval, old_data USING _url;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     IF _count = 0 THEN
+        EXECUTE format( 'INSERT INTO nodes.%I( ckey, cval, url, data, clockid, tsn )
+                          VALUES ( $1, $2, $3, $4, nodes.myclockid(), nodes.new_tsn() )', _table )
+           USING _ckey, _cval, _url, _data;
+     ELSIF old_cval <> _cval OR old_data::text <> _data::text THEN
+        /* changed: new version with new tsn */
+        EXECUTE format( 'UPDATE nodes.%I
+                            SET cval = $1, data = $2, clockid = nodes.myclockid(), tsn = nodes.new_tsn()
+                          WHERE url = $3', _table )
+           USING _cval, _data, _url;
+     END IF;
+
+     RETURN QUERY SELECT * FROM nodes.thing_get( _table, _url );
+   END;
+$$ LANGUAGE plpgsql;
+
+/* 
+ * conditional PUT
+ *
+ * writes only, if the current version is (_clockid, _tsn);
+ * (0, 0) expects that the url does not exist yet
+ */
+CREATE OR REPLACE FUNCTION nodes.thing_put_if( _table text, _url text, _data json, _clockid bigint, _tsn bigint ) RETURNS SETOF nodes.base AS $$
+   DECLARE
+      old_clockid bigint;
+      old_tsn     bigint;
+      _count      bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     EXECUTE format( 'SELECT clockid, tsn FROM nodes.%I WHERE url = $1 FOR UPDATE', _table )
+        INTO old_clockid, old_tsn USING _url;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     IF _count = 0 THEN
+        old_clockid := 0;
+        old_tsn     := 0;
+     END IF;
+
+     IF old_clockid <> _clockid OR old_tsn <> _tsn THEN
+        RAISE EXCEPTION 'stale version of %: expected %/%, found %/%',
+           _url, _clockid, _tsn, old_clockid, old_tsn
+          USING ERRCODE = 'EN003';
+     END IF;
+
+     RETURN QUERY SELECT * FROM nodes.thing_put( _table, _url, _data );
+   END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,132 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 3: conflict resolution
+ *
+ * Two nodes can write the same url independently. Sync detects this and
+ * lets a resolver on the Go side decide; the winning version is written
+ * with nodes.ae_replace_<table>, every decision is recorded in
+ * nodes.conflicts.
+ */
+
+/* 
+ * Anti-Entropy functions, version 2: adds nodes.ae_replace_<table>
+ */
+CREATE OR REPLACE FUNCTION nodes.create_ae_functions( _name text ) RETURNS VOID AS $body$
+   BEGIN
+     /* GET */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _clockid bigint, _tsn bigint ) RETURNS SETOF nodes.base AS $fn$
+          BEGIN
+             RETURN QUERY 
+               SELECT ckey, cval, url, data, clockid, tsn FROM nodes.%2$I
+                  WHERE clockid = _clockid and tsn = _tsn;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_get_' || _name, _name );
+
+     /* PUT */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint ) RETURNS VOID AS $fn$
+          BEGIN
+             LOOP
+               BEGIN
+                INSERT INTO nodes.%2$I( ckey, cval, url, data, clockid, tsn ) 
+                VALUES (_ckey, _cval, _url, _data, _clockid, _tsn );
+                RETURN;
+                EXCEPTION WHEN unique_violation THEN
+                  /*remove older versions, can there be more ?*/
+                  DELETE FROM nodes.%2$I where url = _url AND clockid = _clockid and tsn < _tsn;
+                  IF NOT FOUND THEN
+                    /* same or newer version already there: nothing to do */
+                    RETURN;
+                  END IF;
+               END;
+             END LOOP;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_put_' || _name, _name );
+
+     /* DELETE */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _clockid bigint, _tsn bigint ) RETURNS VOID AS $fn$
+          BEGIN
+             DELETE FROM nodes.%2$I WHERE clockid = _clockid and tsn = _tsn; 
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_delete_' || _name, _name );
+
+     /* REPLACE : overwrite the current version of the url, whatever it is */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint ) RETURNS VOID AS $fn$
+          BEGIN
+             UPDATE nodes.%2$I
+                SET ckey = _ckey, cval = _cval, data = _data, clockid = _clockid, tsn = _tsn
+              WHERE url = _url;
+             IF NOT FOUND THEN
+                INSERT INTO nodes.%2$I( ckey, cval, url, data, clockid, tsn )
+                VALUES (_ckey, _cval, _url, _data, _clockid, _tsn );
+             END IF;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_replace_' || _name, _name );
+   END;
+$body$ LANGUAGE plpgsql;
+
+SELECT nodes.create_ae_functions( table_name ) FROM nodes.managed_tables;
+
+/* REPLACE (dispatch) */
+CREATE OR REPLACE FUNCTION nodes.ae_replace( _table text, _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint ) RETURNS VOID AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      EXECUTE format( 'SELECT nodes.%I( $1, $2, $3, $4, $5, $6 )', 'ae_replace_' || _table )
+        USING _ckey, _cval, _url, _data, _clockid, _tsn;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* 
+ * Recorded conflicts
+ *
+ * outcome is 'local', 'remote' or 'merged'
+ */
+CREATE TABLE IF NOT EXISTS nodes.conflicts (
+     id             bigserial,
+     table_name     text,
+     url            text,
+     local_clockid  bigint,
+     local_tsn      bigint,
+     local_data     json,
+     remote_clockid bigint,
+     remote_tsn     bigint,
+     remote_data    json,
+     policy         text,
+     outcome        text,
+     merged_data    json,
+     resolved       timestamp with time zone DEFAULT now(),
+     PRIMARY KEY( id )
+);
+
+CREATE OR REPLACE FUNCTION nodes.putConflict( _table text, _url text,
+       _local_clockid bigint, _local_tsn bigint, _local_data json,
+       _remote_clockid bigint, _remote_tsn bigint, _remote_data json,
+       _policy text, _outcome text, _merged_data json ) RETURNS bigint AS $$
+   DECLARE
+      _id bigint;
+   BEGIN
+     INSERT INTO nodes.conflicts( table_name, url, local_clockid, local_tsn, local_data,
+                                  remote_clockid, remote_tsn, remote_data, policy, outcome, merged_data )
+       VALUES ( _table, _url, _local_clockid, _local_tsn, _local_data,
+                _remote_clockid, _remote_tsn, _remote_data, _policy, _outcome, _merged_data )
+       RETURNING id INTO _id;
+     RETURN _id;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* 
+ * read the recorded conflicts after an id, oldest first
+ */
+CREATE OR REPLACE FUNCTION nodes.getConflicts( _after bigint ) RETURNS SETOF nodes.conflicts AS $$
+   BEGIN
+     RETURN QUERY
+        SELECT * FROM nodes.conflicts WHERE id > _after ORDER BY id;
+   END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,116 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 4: idempotent anti-entropy apply
+ *
+ * nodes.ae_put_<table> looped forever, when the row of the url was held
+ * by another clock or by a newer version of the same clock. It now
+ * compares the versions and returns a status:
+ *
+ *   'applied'   the version was inserted or replaced an older version
+ *               of the same clock
+ *   'skipped'   the same or a newer version of the clock is already there
+ *   'conflict'  the url is held by a version of another clock, nothing
+ *               is written: the caller decides (see nodes.ae_replace)
+ *
+ * Applying the same version twice is therefore a no-op.
+ */
+
+/*
+ * Anti-Entropy functions, version 3: ae_put_<table> returns a status
+ */
+CREATE OR REPLACE FUNCTION nodes.create_ae_functions( _name text ) RETURNS VOID AS $body$
+   BEGIN
+     /* GET */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _clockid bigint, _tsn bigint ) RETURNS SETOF nodes.base AS $fn$
+          BEGIN
+             RETURN QUERY
+               SELECT ckey, cval, url, data, clockid, tsn FROM nodes.%2$I
+                  WHERE clockid = _clockid and tsn = _tsn;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_get_' || _name, _name );
+
+     /* PUT : the return type changed, drop the old version first */
+     EXECUTE format( 'DROP FUNCTION IF EXISTS nodes.%I( bytea, bytea, text, json, bigint, bigint )', 'ae_put_' || _name );
+     EXECUTE format( $f$
+       CREATE FUNCTION nodes.%1$I( _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint ) RETURNS text AS $fn$
+          DECLARE
+             _old_clockid bigint;
+             _old_tsn     bigint;
+          BEGIN
+             FOR _attempt IN 1..2 LOOP
+               SELECT clockid, tsn INTO _old_clockid, _old_tsn FROM nodes.%2$I
+                  WHERE url = _url FOR UPDATE;
+
+               IF NOT FOUND THEN
+                 BEGIN
+                   INSERT INTO nodes.%2$I( ckey, cval, url, data, clockid, tsn )
+                   VALUES (_ckey, _cval, _url, _data, _clockid, _tsn );
+                   RETURN 'applied';
+                 EXCEPTION WHEN unique_violation THEN
+                   /* inserted concurrently: compare with that one */
+                   IF _attempt = 2 THEN
+                     RAISE;
+                   END IF;
+                   CONTINUE;
+                 END;
+               END IF;
+
+               IF _old_clockid <> _clockid THEN
+                 RETURN 'conflict';
+               END IF;
+               IF _old_tsn >= _tsn THEN
+                 RETURN 'skipped';
+               END IF;
+
+               UPDATE nodes.%2$I
+                  SET ckey = _ckey, cval = _cval, data = _data, tsn = _tsn
+                WHERE url = _url;
+               RETURN 'applied';
+             END LOOP;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_put_' || _name, _name );
+
+     /* DELETE */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _clockid bigint, _tsn bigint ) RETURNS VOID AS $fn$
+          BEGIN
+             DELETE FROM nodes.%2$I WHERE clockid = _clockid and tsn = _tsn;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_delete_' || _name, _name );
+
+     /* REPLACE : overwrite the current version of the url, whatever it is */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint ) RETURNS VOID AS $fn$
+          BEGIN
+             UPDATE nodes.%2$I
+                SET ckey = _ckey, cval = _cval, data = _data, clockid = _clockid, tsn = _tsn
+              WHERE url = _url;
+             IF NOT FOUND THEN
+                INSERT INTO nodes.%2$I( ckey, cval, url, data, clockid, tsn )
+                VALUES (_ckey, _cval, _url, _data, _clockid, _tsn );
+             END IF;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_replace_' || _name, _name );
+   END;
+$body$ LANGUAGE plpgsql;
+
+SELECT nodes.create_ae_functions( table_name ) FROM nodes.managed_tables;
+
+/* PUT (dispatch) */
+DROP FUNCTION IF EXISTS nodes.ae_put( text, bytea, bytea, text, json, bigint, bigint );
+CREATE FUNCTION nodes.ae_put( _table text, _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint ) RETURNS text AS $$
+   DECLARE
+      _status text;
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      EXECUTE format( 'SELECT nodes.%I( $1, $2, $3, $4, $5, $6 )', 'ae_put_' || _table )
+        INTO _status
+        USING _ckey, _cval, _url, _data, _clockid, _tsn;
+      RETURN _status;
+   END;
+$$ LANGUAGE plpgsql;
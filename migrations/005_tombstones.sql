@@ -0,0 +1,193 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 5: tombstones
+ *
+ * A deleted row is gone, so ae_get_<table> cannot return anything for the
+ * D entry in the oplog. Every delete now leaves a tombstone: the url, the
+ * coordinates (clockid, tsn) of the delete and the version it removed.
+ * Sync reads the tombstone for a D entry and applies it with
+ * nodes.ae_tombstone, which keeps the coordinates of the deleting node.
+ *
+ * Tombstones are collected by nodes.gc_tombstones, once they are older
+ * than the retention and every known peer has passed them.
+ */
+
+CREATE TABLE IF NOT EXISTS nodes.tombstones (
+     clockid         bigint,  /* the delete */
+     tsn             bigint,
+     table_name      text,
+     url             text,
+     ckey            bytea,
+     deleted_clockid bigint,  /* the version that was deleted */
+     deleted_tsn     bigint,
+     created         timestamp with time zone DEFAULT now(),
+     PRIMARY KEY( clockid, tsn )
+);
+
+CREATE INDEX IF NOT EXISTS tombstones_url ON nodes.tombstones( table_name, url );
+
+/*
+ * What the peers we sync from have seen
+ *
+ * peer is the clockid of the remote node, (clockid, tsn) one of its
+ * high-water marks at the last sync.
+ */
+CREATE TABLE IF NOT EXISTS nodes.peer_highwatermarks (
+     peer       bigint,
+     clockid    bigint,
+     tsn        bigint,
+     updated    timestamp with time zone DEFAULT now(),
+     PRIMARY KEY( peer, clockid )
+);
+
+CREATE OR REPLACE FUNCTION nodes.putPeerHigh( _peer bigint, _clockid bigint, _tsn bigint ) RETURNS VOID AS $$
+   BEGIN
+     INSERT INTO nodes.peer_highwatermarks( peer, clockid, tsn ) VALUES ( _peer, _clockid, _tsn )
+       ON CONFLICT ( peer, clockid ) DO UPDATE
+         SET tsn = greatest( nodes.peer_highwatermarks.tsn, EXCLUDED.tsn ), updated = now();
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * log a delete: oplog entry, tombstone and high-water mark
+ */
+CREATE OR REPLACE FUNCTION nodes.log_delete( _table text, _url text, _ckey bytea, _clockid bigint, _tsn bigint,
+       _deleted_clockid bigint, _deleted_tsn bigint ) RETURNS VOID AS $$
+   BEGIN
+     INSERT INTO nodes.oplog( clockid, tsn, table_name, op )
+          VALUES ( _clockid, _tsn, _table, 'D' );
+
+     INSERT INTO nodes.tombstones( clockid, tsn, table_name, url, ckey, deleted_clockid, deleted_tsn )
+          VALUES ( _clockid, _tsn, _table, _url, _ckey, _deleted_clockid, _deleted_tsn );
+
+     PERFORM nodes.putRemoteHigh( _clockid, _tsn );
+   END;
+$$ LANGUAGE plpgsql;
+
+/* Trigger function, version 2
+ *
+ * deletes leave a tombstone. A delete replayed by nodes.ae_tombstone
+ * carries the coordinates of the deleting node in engine3.delete_clockid
+ * and engine3.delete_tsn, a local delete gets a new local tsn.
+ *
+ * A BEFORE DELETE trigger has to return OLD, otherwise the delete is
+ * skipped.
+ */
+CREATE OR REPLACE FUNCTION onChange() RETURNS TRIGGER AS $$
+     DECLARE
+          _opcode text;
+          _clockid bigint;
+          _tsn     bigint;
+     BEGIN
+          /* I, U or D: Insert, Update, Delete */
+          _opcode = left( TG_OP , 1 ); /* first letter is enough */
+
+          IF _opcode = 'D' THEN
+           _clockid = nullif( current_setting( 'engine3.delete_clockid', true ), '' )::bigint;
+           IF _clockid IS NULL THEN
+             _clockid = nodes.myclockid();
+             _tsn     = nodes.new_tsn();
+           ELSE
+             _tsn     = current_setting( 'engine3.delete_tsn' )::bigint;
+           END IF;
+
+           PERFORM nodes.log_delete( TG_TABLE_NAME, OLD.url, OLD.ckey, _clockid, _tsn, OLD.clockid, OLD.tsn );
+           RETURN OLD;
+          END IF;
+
+          INSERT INTO nodes.oplog( clockid, tsn, table_name, op )
+               VALUES (NEW.clockid, NEW.tsn, TG_TABLE_NAME, _opcode );
+
+          PERFORM nodes.putRemoteHigh( NEW.clockid, NEW.tsn );
+          RETURN NEW;
+     END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * read the tombstone of a delete
+ */
+CREATE OR REPLACE FUNCTION nodes.getTombstone( _table text, _clockid bigint, _tsn bigint ) RETURNS TABLE(
+       _url text, _ckey bytea, _deleted_clockid bigint, _deleted_tsn bigint ) AS $$
+   BEGIN
+     RETURN QUERY
+        SELECT url, ckey, deleted_clockid, deleted_tsn FROM nodes.tombstones
+         WHERE table_name = _table AND clockid = _clockid AND tsn = _tsn;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * apply the tombstone of another node
+ *
+ * the row of the url is deleted under the coordinates of the delete. If
+ * there is no row, the tombstone is recorded anyway, so that it travels
+ * on to the next node. Returns 'applied' or 'skipped' (already there).
+ */
+CREATE OR REPLACE FUNCTION nodes.ae_tombstone( _table text, _url text, _ckey bytea, _clockid bigint, _tsn bigint,
+       _deleted_clockid bigint, _deleted_tsn bigint ) RETURNS text AS $$
+   DECLARE
+      _count bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     IF EXISTS ( SELECT 1 FROM nodes.tombstones WHERE clockid = _clockid AND tsn = _tsn ) THEN
+       RETURN 'skipped';
+     END IF;
+
+     PERFORM set_config( 'engine3.delete_clockid', _clockid::text, true );
+     PERFORM set_config( 'engine3.delete_tsn', _tsn::text, true );
+
+     EXECUTE format( 'DELETE FROM nodes.%I WHERE url = $1', _table ) USING _url;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     PERFORM set_config( 'engine3.delete_clockid', '', true );
+     PERFORM set_config( 'engine3.delete_tsn', '', true );
+
+     IF _count = 0 THEN
+       PERFORM nodes.log_delete( _table, _url, _ckey, _clockid, _tsn, _deleted_clockid, _deleted_tsn );
+     END IF;
+
+     RETURN 'applied';
+   END;
+$$ LANGUAGE plpgsql;
+
+/* PUT (dispatch), version 3
+ *
+ * a version, which was deleted here already, is not brought back
+ */
+CREATE OR REPLACE FUNCTION nodes.ae_put( _table text, _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint ) RETURNS text AS $$
+   DECLARE
+      _status text;
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+
+      IF EXISTS ( SELECT 1 FROM nodes.tombstones
+                   WHERE table_name = _table AND url = _url
+                     AND deleted_clockid = _clockid AND deleted_tsn >= _tsn ) THEN
+        RETURN 'skipped';
+      END IF;
+
+      EXECUTE format( 'SELECT nodes.%I( $1, $2, $3, $4, $5, $6 )', 'ae_put_' || _table )
+        INTO _status
+        USING _ckey, _cval, _url, _data, _clockid, _tsn;
+      RETURN _status;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * collect tombstones older than the retention, which every known peer
+ * has passed; returns the number collected
+ */
+CREATE OR REPLACE FUNCTION nodes.gc_tombstones( _retention interval ) RETURNS bigint AS $$
+   DECLARE
+      _count bigint;
+   BEGIN
+     DELETE FROM nodes.tombstones t
+      WHERE t.created < now() - _retention
+        AND NOT EXISTS (
+              SELECT 1 FROM ( SELECT DISTINCT peer FROM nodes.peer_highwatermarks ) p
+               WHERE coalesce( ( SELECT h.tsn FROM nodes.peer_highwatermarks h
+                                  WHERE h.peer = p.peer AND h.clockid = t.clockid ), 0 ) < t.tsn );
+     GET DIAGNOSTICS _count = ROW_COUNT;
+     RETURN _count;
+   END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,231 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 6: version vectors
+ *
+ * (clockid, tsn) names a version, but cannot tell whether the writer had
+ * seen the version it replaced. Every row gets an optional version vector
+ * vv: a JSON object { "<clockid>": tsn, ... } with the highest tsn of
+ * every clock the version is derived from.
+ *
+ * The trigger maintains vv: a write keeps the vector of the row it
+ * replaces and adds its own (clockid, tsn). Replicated versions bring
+ * their vector along. Rows written before this migration have no vector,
+ * the Go side falls back to (clockid, tsn) for them.
+ */
+
+ALTER TABLE nodes.base ADD COLUMN IF NOT EXISTS vv jsonb;
+
+DO $$
+   DECLARE
+      _name text;
+   BEGIN
+     FOR _name IN SELECT table_name FROM nodes.managed_tables LOOP
+       EXECUTE format( 'ALTER TABLE nodes.%I ADD COLUMN IF NOT EXISTS vv jsonb', _name );
+     END LOOP;
+   END;
+$$;
+
+/* Trigger function, version 3
+ *
+ * adds the coordinate of a written version to its version vector
+ */
+CREATE OR REPLACE FUNCTION onChange() RETURNS TRIGGER AS $$
+     DECLARE
+          _opcode text;
+          _clockid bigint;
+          _tsn     bigint;
+     BEGIN
+          /* I, U or D: Insert, Update, Delete */
+          _opcode = left( TG_OP , 1 ); /* first letter is enough */
+
+          IF _opcode = 'D' THEN
+           _clockid = nullif( current_setting( 'engine3.delete_clockid', true ), '' )::bigint;
+           IF _clockid IS NULL THEN
+             _clockid = nodes.myclockid();
+             _tsn     = nodes.new_tsn();
+           ELSE
+             _tsn     = current_setting( 'engine3.delete_tsn' )::bigint;
+           END IF;
+
+           PERFORM nodes.log_delete( TG_TABLE_NAME, OLD.url, OLD.ckey, _clockid, _tsn, OLD.clockid, OLD.tsn );
+           RETURN OLD;
+          END IF;
+
+          /* an UPDATE, which does not set vv, keeps the vector of the old row */
+          IF coalesce( ( NEW.vv ->> NEW.clockid::text )::bigint, 0 ) < NEW.tsn THEN
+            NEW.vv = coalesce( NEW.vv, '{}'::jsonb ) || jsonb_build_object( NEW.clockid::text, NEW.tsn );
+          END IF;
+
+          INSERT INTO nodes.oplog( clockid, tsn, table_name, op )
+               VALUES (NEW.clockid, NEW.tsn, TG_TABLE_NAME, _opcode );
+
+          PERFORM nodes.putRemoteHigh( NEW.clockid, NEW.tsn );
+          RETURN NEW;
+     END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * Anti-Entropy functions, version 4: versions carry their vector
+ */
+CREATE OR REPLACE FUNCTION nodes.create_ae_functions( _name text ) RETURNS VOID AS $body$
+   BEGIN
+     /* GET */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _clockid bigint, _tsn bigint ) RETURNS SETOF nodes.base AS $fn$
+          BEGIN
+             RETURN QUERY
+               SELECT ckey, cval, url, data, clockid, tsn, vv FROM nodes.%2$I
+                  WHERE clockid = _clockid and tsn = _tsn;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_get_' || _name, _name );
+
+     /* PUT : the arguments changed, drop the old version first */
+     EXECUTE format( 'DROP FUNCTION IF EXISTS nodes.%I( bytea, bytea, text, json, bigint, bigint )', 'ae_put_' || _name );
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint, _vv jsonb ) RETURNS text AS $fn$
+          DECLARE
+             _old_clockid bigint;
+             _old_tsn     bigint;
+          BEGIN
+             FOR _attempt IN 1..2 LOOP
+               SELECT clockid, tsn INTO _old_clockid, _old_tsn FROM nodes.%2$I
+                  WHERE url = _url FOR UPDATE;
+
+               IF NOT FOUND THEN
+                 BEGIN
+                   INSERT INTO nodes.%2$I( ckey, cval, url, data, clockid, tsn, vv )
+                   VALUES (_ckey, _cval, _url, _data, _clockid, _tsn, _vv );
+                   RETURN 'applied';
+                 EXCEPTION WHEN unique_violation THEN
+                   /* inserted concurrently: compare with that one */
+                   IF _attempt = 2 THEN
+                     RAISE;
+                   END IF;
+                   CONTINUE;
+                 END;
+               END IF;
+
+               IF _old_clockid <> _clockid THEN
+                 RETURN 'conflict';
+               END IF;
+               IF _old_tsn >= _tsn THEN
+                 RETURN 'skipped';
+               END IF;
+
+               UPDATE nodes.%2$I
+                  SET ckey = _ckey, cval = _cval, data = _data, tsn = _tsn, vv = _vv
+                WHERE url = _url;
+               RETURN 'applied';
+             END LOOP;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_put_' || _name, _name );
+
+     /* DELETE */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _clockid bigint, _tsn bigint ) RETURNS VOID AS $fn$
+          BEGIN
+             DELETE FROM nodes.%2$I WHERE clockid = _clockid and tsn = _tsn;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_delete_' || _name, _name );
+
+     /* REPLACE : overwrite the current version of the url, whatever it is */
+     EXECUTE format( 'DROP FUNCTION IF EXISTS nodes.%I( bytea, bytea, text, json, bigint, bigint )', 'ae_replace_' || _name );
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint, _vv jsonb ) RETURNS VOID AS $fn$
+          BEGIN
+             UPDATE nodes.%2$I
+                SET ckey = _ckey, cval = _cval, data = _data, clockid = _clockid, tsn = _tsn, vv = _vv
+              WHERE url = _url;
+             IF NOT FOUND THEN
+                INSERT INTO nodes.%2$I( ckey, cval, url, data, clockid, tsn, vv )
+                VALUES (_ckey, _cval, _url, _data, _clockid, _tsn, _vv );
+             END IF;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_replace_' || _name, _name );
+   END;
+$body$ LANGUAGE plpgsql;
+
+SELECT nodes.create_ae_functions( table_name ) FROM nodes.managed_tables;
+
+/* PUT (dispatch), version 4 */
+DROP FUNCTION IF EXISTS nodes.ae_put( text, bytea, bytea, text, json, bigint, bigint );
+CREATE OR REPLACE FUNCTION nodes.ae_put( _table text, _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint, _vv jsonb ) RETURNS text AS $$
+   DECLARE
+      _status text;
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+
+      IF EXISTS ( SELECT 1 FROM nodes.tombstones
+                   WHERE table_name = _table AND url = _url
+                     AND deleted_clockid = _clockid AND deleted_tsn >= _tsn ) THEN
+        RETURN 'skipped';
+      END IF;
+
+      EXECUTE format( 'SELECT nodes.%I( $1, $2, $3, $4, $5, $6, $7 )', 'ae_put_' || _table )
+        INTO _status
+        USING _ckey, _cval, _url, _data, _clockid, _tsn, _vv;
+      RETURN _status;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* REPLACE (dispatch), version 2 */
+DROP FUNCTION IF EXISTS nodes.ae_replace( text, bytea, bytea, text, json, bigint, bigint );
+CREATE OR REPLACE FUNCTION nodes.ae_replace( _table text, _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint, _vv jsonb ) RETURNS VOID AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      EXECUTE format( 'SELECT nodes.%I( $1, $2, $3, $4, $5, $6, $7 )', 'ae_replace_' || _table )
+        USING _ckey, _cval, _url, _data, _clockid, _tsn, _vv;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* GET, version 2 */
+CREATE OR REPLACE FUNCTION nodes.thing_get( _table text, _url text ) RETURNS SETOF nodes.base AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT ckey, cval, url, data, clockid, tsn, vv FROM nodes.%I WHERE url = $1', _table )
+        USING _url;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* LIST, version 2 */
+CREATE OR REPLACE FUNCTION nodes.thing_list( _table text ) RETURNS SETOF nodes.base AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT ckey, cval, url, data, clockid, tsn, vv FROM nodes.%I ORDER BY url', _table );
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * MERGE : write a merged document as a new local version
+ *
+ * _vv is the union of the vectors of the merged versions, the trigger
+ * adds the new local coordinate
+ */
+CREATE OR REPLACE FUNCTION nodes.thing_merge( _table text, _url text, _data json, _vv jsonb ) RETURNS SETOF nodes.base AS $$
+   DECLARE
+      _count bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+     PERFORM nodes.check_registered();
+
+     EXECUTE format( 'UPDATE nodes.%I
+                         SET cval = $1, data = $2, clockid = nodes.myclockid(), tsn = nodes.new_tsn(), vv = $3
+                       WHERE url = $4', _table )
+        USING digest( _data::text, 'md5' ), _data, _vv, _url;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     IF _count = 0 THEN
+        EXECUTE format( 'INSERT INTO nodes.%I( ckey, cval, url, data, clockid, tsn, vv )
+                          VALUES ( $1, $2, $3, $4, nodes.myclockid(), nodes.new_tsn(), $5 )', _table )
+           USING digest( _url, 'md5' ), digest( _data::text, 'md5' ), _url, _data, _vv;
+     END IF;
+
+     RETURN QUERY SELECT * FROM nodes.thing_get( _table, _url );
+   END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,43 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 7: table digests
+ *
+ * The rows of a managed table are bucketed by the leading hex digits of
+ * their ckey. The digest of a bucket is the md5 over ckey and cval of its
+ * rows in ckey order, so two nodes holding the same documents have the
+ * same bucket digests, whatever their oplogs look like. The Go side builds
+ * the Merkle tree over the buckets.
+ */
+
+/*
+ * the digests of all non-empty buckets of a table
+ *
+ * _depth is the number of hex digits of the bucket prefix
+ */
+CREATE OR REPLACE FUNCTION nodes.bucket_digests( _table text, _depth int ) RETURNS TABLE(
+       _bucket text, _count bigint, _digest bytea ) AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT left( encode( ckey, ''hex'' ), $1 ) AS bucket, count(*),
+                digest( string_agg( encode( ckey, ''hex'' ) || encode( cval, ''hex'' ), '''' ORDER BY ckey ), ''md5'' )
+           FROM nodes.%I
+          GROUP BY bucket
+          ORDER BY bucket', _table )
+        USING _depth;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * the rows of a bucket
+ */
+CREATE OR REPLACE FUNCTION nodes.bucket_things( _table text, _bucket text ) RETURNS SETOF nodes.base AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT ckey, cval, url, data, clockid, tsn, vv FROM nodes.%I
+          WHERE left( encode( ckey, ''hex'' ), length( $1 ) ) = $1
+          ORDER BY ckey', _table )
+        USING _bucket;
+   END;
+$$ LANGUAGE plpgsql;
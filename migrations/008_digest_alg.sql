@@ -0,0 +1,387 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 8: digest algorithms
+ *
+ * ckey and cval were always md5. The algorithm is now a setting of the
+ * node (nodes.settings 'digest_alg': md5 or sha256) and every row records
+ * the algorithm of its digests in alg; NULL is md5 (rows written before
+ * this migration).
+ *
+ * Switching the algorithm only affects new writes. nodes.rehash converts
+ * existing rows in batches, without creating new versions: an UPDATE,
+ * which keeps clockid and tsn, is not logged by the trigger. Replicated
+ * versions keep the algorithm of the node, which wrote them, so peers
+ * with different algorithms can sync during the transition.
+ */
+
+ALTER TABLE nodes.base ADD COLUMN IF NOT EXISTS alg text;
+
+DO $$
+   DECLARE
+      _name text;
+   BEGIN
+     FOR _name IN SELECT table_name FROM nodes.managed_tables LOOP
+       EXECUTE format( 'ALTER TABLE nodes.%I ADD COLUMN IF NOT EXISTS alg text', _name );
+     END LOOP;
+   END;
+$$;
+
+/*
+ * Settings of the node
+ */
+CREATE TABLE IF NOT EXISTS nodes.settings (
+     key        text,
+     value      text,
+     PRIMARY KEY( key )
+);
+
+INSERT INTO nodes.settings( key, value ) VALUES ( 'digest_alg', 'md5' ) ON CONFLICT DO NOTHING;
+
+CREATE OR REPLACE FUNCTION nodes.digest_alg() RETURNS text AS $$
+   BEGIN
+     RETURN coalesce( ( SELECT value FROM nodes.settings WHERE key = 'digest_alg' ), 'md5' );
+   END;
+$$ LANGUAGE plpgsql STABLE;
+
+CREATE OR REPLACE FUNCTION nodes.set_digest_alg( _alg text ) RETURNS VOID AS $$
+   BEGIN
+     IF _alg NOT IN ( 'md5', 'sha256' ) THEN
+       RAISE EXCEPTION 'unknown digest algorithm %', _alg
+         USING ERRCODE = 'invalid_parameter_value';
+     END IF;
+
+     INSERT INTO nodes.settings( key, value ) VALUES ( 'digest_alg', _alg )
+       ON CONFLICT ( key ) DO UPDATE SET value = EXCLUDED.value;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * digest of a text with the algorithm of the node
+ */
+CREATE OR REPLACE FUNCTION nodes.hash( _text text ) RETURNS bytea AS $$
+   BEGIN
+     RETURN digest( _text, nodes.digest_alg() );
+   END;
+$$ LANGUAGE plpgsql STABLE;
+
+/* Trigger function, version 4
+ *
+ * an UPDATE, which keeps clockid and tsn, is no new version (rehash):
+ * it is not logged
+ */
+CREATE OR REPLACE FUNCTION onChange() RETURNS TRIGGER AS $$
+     DECLARE
+          _opcode text;
+          _clockid bigint;
+          _tsn     bigint;
+     BEGIN
+          /* I, U or D: Insert, Update, Delete */
+          _opcode = left( TG_OP , 1 ); /* first letter is enough */
+
+          IF _opcode = 'D' THEN
+           _clockid = nullif( current_setting( 'engine3.delete_clockid', true ), '' )::bigint;
+           IF _clockid IS NULL THEN
+             _clockid = nodes.myclockid();
+             _tsn     = nodes.new_tsn();
+           ELSE
+             _tsn     = current_setting( 'engine3.delete_tsn' )::bigint;
+           END IF;
+
+           PERFORM nodes.log_delete( TG_TABLE_NAME, OLD.url, OLD.ckey, _clockid, _tsn, OLD.clockid, OLD.tsn );
+           RETURN OLD;
+          END IF;
+
+          IF _opcode = 'U' AND NEW.clockid = OLD.clockid AND NEW.tsn = OLD.tsn THEN
+            RETURN NEW;
+          END IF;
+
+          /* an UPDATE, which does not set vv, keeps the vector of the old row */
+          IF coalesce( ( NEW.vv ->> NEW.clockid::text )::bigint, 0 ) < NEW.tsn THEN
+            NEW.vv = coalesce( NEW.vv, '{}'::jsonb ) || jsonb_build_object( NEW.clockid::text, NEW.tsn );
+          END IF;
+
+          INSERT INTO nodes.oplog( clockid, tsn, table_name, op )
+               VALUES (NEW.clockid, NEW.tsn, TG_TABLE_NAME, _opcode );
+
+          PERFORM nodes.putRemoteHigh( NEW.clockid, NEW.tsn );
+          RETURN NEW;
+     END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * Anti-Entropy functions, version 5: versions carry their algorithm
+ */
+CREATE OR REPLACE FUNCTION nodes.create_ae_functions( _name text ) RETURNS VOID AS $body$
+   BEGIN
+     /* GET */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _clockid bigint, _tsn bigint ) RETURNS SETOF nodes.base AS $fn$
+          BEGIN
+             RETURN QUERY
+               SELECT ckey, cval, url, data, clockid, tsn, vv, alg FROM nodes.%2$I
+                  WHERE clockid = _clockid and tsn = _tsn;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_get_' || _name, _name );
+
+     /* PUT : the arguments changed, drop the old version first */
+     EXECUTE format( 'DROP FUNCTION IF EXISTS nodes.%I( bytea, bytea, text, json, bigint, bigint, jsonb )', 'ae_put_' || _name );
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint,
+              _vv jsonb, _alg text ) RETURNS text AS $fn$
+          DECLARE
+             _old_clockid bigint;
+             _old_tsn     bigint;
+          BEGIN
+             FOR _attempt IN 1..2 LOOP
+               SELECT clockid, tsn INTO _old_clockid, _old_tsn FROM nodes.%2$I
+                  WHERE url = _url FOR UPDATE;
+
+               IF NOT FOUND THEN
+                 BEGIN
+                   INSERT INTO nodes.%2$I( ckey, cval, url, data, clockid, tsn, vv, alg )
+                   VALUES (_ckey, _cval, _url, _data, _clockid, _tsn, _vv, _alg );
+                   RETURN 'applied';
+                 EXCEPTION WHEN unique_violation THEN
+                   /* inserted concurrently: compare with that one */
+                   IF _attempt = 2 THEN
+                     RAISE;
+                   END IF;
+                   CONTINUE;
+                 END;
+               END IF;
+
+               IF _old_clockid <> _clockid THEN
+                 RETURN 'conflict';
+               END IF;
+               IF _old_tsn >= _tsn THEN
+                 RETURN 'skipped';
+               END IF;
+
+               UPDATE nodes.%2$I
+                  SET ckey = _ckey, cval = _cval, data = _data, tsn = _tsn, vv = _vv, alg = _alg
+                WHERE url = _url;
+               RETURN 'applied';
+             END LOOP;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_put_' || _name, _name );
+
+     /* DELETE */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _clockid bigint, _tsn bigint ) RETURNS VOID AS $fn$
+          BEGIN
+             DELETE FROM nodes.%2$I WHERE clockid = _clockid and tsn = _tsn;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_delete_' || _name, _name );
+
+     /* REPLACE : overwrite the current version of the url, whatever it is */
+     EXECUTE format( 'DROP FUNCTION IF EXISTS nodes.%I( bytea, bytea, text, json, bigint, bigint, jsonb )', 'ae_replace_' || _name );
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint,
+              _vv jsonb, _alg text ) RETURNS VOID AS $fn$
+          BEGIN
+             UPDATE nodes.%2$I
+                SET ckey = _ckey, cval = _cval, data = _data, clockid = _clockid, tsn = _tsn, vv = _vv, alg = _alg
+              WHERE url = _url;
+             IF NOT FOUND THEN
+                INSERT INTO nodes.%2$I( ckey, cval, url, data, clockid, tsn, vv, alg )
+                VALUES (_ckey, _cval, _url, _data, _clockid, _tsn, _vv, _alg );
+             END IF;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_replace_' || _name, _name );
+   END;
+$body$ LANGUAGE plpgsql;
+
+SELECT nodes.create_ae_functions( table_name ) FROM nodes.managed_tables;
+
+/* PUT (dispatch), version 5 */
+DROP FUNCTION IF EXISTS nodes.ae_put( text, bytea, bytea, text, json, bigint, bigint, jsonb );
+CREATE OR REPLACE FUNCTION nodes.ae_put( _table text, _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint,
+       _vv jsonb, _alg text ) RETURNS text AS $$
+   DECLARE
+      _status text;
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+
+      IF EXISTS ( SELECT 1 FROM nodes.tombstones
+                   WHERE table_name = _table AND url = _url
+                     AND deleted_clockid = _clockid AND deleted_tsn >= _tsn ) THEN
+        RETURN 'skipped';
+      END IF;
+
+      EXECUTE format( 'SELECT nodes.%I( $1, $2, $3, $4, $5, $6, $7, $8 )', 'ae_put_' || _table )
+        INTO _status
+        USING _ckey, _cval, _url, _data, _clockid, _tsn, _vv, _alg;
+      RETURN _status;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* REPLACE (dispatch), version 3 */
+DROP FUNCTION IF EXISTS nodes.ae_replace( text, bytea, bytea, text, json, bigint, bigint, jsonb );
+CREATE OR REPLACE FUNCTION nodes.ae_replace( _table text, _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint,
+       _vv jsonb, _alg text ) RETURNS VOID AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      EXECUTE format( 'SELECT nodes.%I( $1, $2, $3, $4, $5, $6, $7, $8 )', 'ae_replace_' || _table )
+        USING _ckey, _cval, _url, _data, _clockid, _tsn, _vv, _alg;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* GET, version 3 */
+CREATE OR REPLACE FUNCTION nodes.thing_get( _table text, _url text ) RETURNS SETOF nodes.base AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT ckey, cval, url, data, clockid, tsn, vv, alg FROM nodes.%I WHERE url = $1', _table )
+        USING _url;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* LIST, version 3 */
+CREATE OR REPLACE FUNCTION nodes.thing_list( _table text ) RETURNS SETOF nodes.base AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT ckey, cval, url, data, clockid, tsn, vv, alg FROM nodes.%I ORDER BY url', _table );
+   END;
+$$ LANGUAGE plpgsql;
+
+/* BUCKET, version 2 */
+CREATE OR REPLACE FUNCTION nodes.bucket_things( _table text, _bucket text ) RETURNS SETOF nodes.base AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT ckey, cval, url, data, clockid, tsn, vv, alg FROM nodes.%I
+          WHERE left( encode( ckey, ''hex'' ), length( $1 ) ) = $1
+          ORDER BY ckey', _table )
+        USING _bucket;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* PUT, version 3
+ *
+ * digests with the algorithm of the node. A new version is only written,
+ * if the document changed: a different algorithm alone is left to
+ * nodes.rehash
+ */
+CREATE OR REPLACE FUNCTION nodes.thing_put( _table text, _url text, _data json ) RETURNS SETOF nodes.base AS $$
+   DECLARE
+      old_data json;
+      _count   bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+     PERFORM nodes.check_registered();
+
+     EXECUTE format( 'SELECT data FROM nodes.%I WHERE url = $1', _table )
+        INTO old_data USING _url;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     IF _count = 0 THEN
+        EXECUTE format( 'INSERT INTO nodes.%I( ckey, cval, url, data, clockid, tsn, alg )
+                          VALUES ( $1, $2, $3, $4, nodes.myclockid(), nodes.new_tsn(), nodes.digest_alg() )', _table )
+           USING nodes.hash( _url ), nodes.hash( _data::text ), _url, _data;
+     ELSIF old_data::text <> _data::text THEN
+        /* changed: new version with new tsn */
+        EXECUTE format( 'UPDATE nodes.%I
+                            SET ckey = $1, cval = $2, data = $3, clockid = nodes.myclockid(), tsn = nodes.new_tsn(),
+                                alg = nodes.digest_alg()
+                          WHERE url = $4', _table )
+           USING nodes.hash( _url ), nodes.hash( _data::text ), _data, _url;
+     END IF;
+
+     RETURN QUERY SELECT * FROM nodes.thing_get( _table, _url );
+   END;
+$$ LANGUAGE plpgsql;
+
+/* MERGE, version 2 */
+CREATE OR REPLACE FUNCTION nodes.thing_merge( _table text, _url text, _data json, _vv jsonb ) RETURNS SETOF nodes.base AS $$
+   DECLARE
+      _count bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+     PERFORM nodes.check_registered();
+
+     EXECUTE format( 'UPDATE nodes.%I
+                         SET ckey = $1, cval = $2, data = $3, clockid = nodes.myclockid(), tsn = nodes.new_tsn(), vv = $4,
+                             alg = nodes.digest_alg()
+                       WHERE url = $5', _table )
+        USING nodes.hash( _url ), nodes.hash( _data::text ), _data, _vv, _url;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     IF _count = 0 THEN
+        EXECUTE format( 'INSERT INTO nodes.%I( ckey, cval, url, data, clockid, tsn, vv, alg )
+                          VALUES ( $1, $2, $3, $4, nodes.myclockid(), nodes.new_tsn(), $5, nodes.digest_alg() )', _table )
+           USING nodes.hash( _url ), nodes.hash( _data::text ), _url, _data, _vv;
+     END IF;
+
+     RETURN QUERY SELECT * FROM nodes.thing_get( _table, _url );
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * Registers the local node, version 2: digests with the algorithm of the node
+ */
+CREATE OR REPLACE FUNCTION nodes.register( _url text, _data json) RETURNS bigint  AS $$
+   DECLARE
+      _clockid bigint;
+      old_data json;
+   BEGIN
+     /* do we have a clock already */
+     SELECT clockid, data FROM nodes.systems WHERE url = _url INTO _clockid, old_data;
+
+     IF NOT FOUND THEN
+
+            /* no: initialize it */
+            SELECT nodes.clockidsn() INTO _clockid;
+
+            INSERT INTO nodes.systems( ckey, cval, url, data, clockid, tsn, alg )
+              VALUES ( nodes.hash( _url ), nodes.hash( _data::text ), _url, _data, _clockid, nextval( 'nodes.tsn' ),
+                       nodes.digest_alg() );
+
+     ELSIF old_data::text <> _data::text THEN
+            /* re-register and update with new tsn */
+            UPDATE nodes.systems
+               SET ckey = nodes.hash( _url ), cval = nodes.hash( _data::text ), data = _data,
+                   tsn = nextval( 'nodes.tsn' ), alg = nodes.digest_alg()
+             WHERE url = _url;
+     END IF;
+
+     RETURN _clockid;
+   END
+$$ LANGUAGE plpgsql;
+
+/*
+ * rehash up to _limit rows of a table to _alg
+ *
+ * rows, whose digests do not match their content, are left alone (see
+ * Verify). Returns the number of rows rehashed, 0 when done.
+ */
+CREATE OR REPLACE FUNCTION nodes.rehash( _table text, _alg text, _limit int ) RETURNS bigint AS $$
+   DECLARE
+      _count bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     IF _alg NOT IN ( 'md5', 'sha256' ) THEN
+       RAISE EXCEPTION 'unknown digest algorithm %', _alg
+         USING ERRCODE = 'invalid_parameter_value';
+     END IF;
+
+     EXECUTE format(
+       'UPDATE nodes.%1$I
+           SET ckey = digest( url, $1 ), cval = digest( data::text, $1 ), alg = $1
+         WHERE url IN ( SELECT url FROM nodes.%1$I
+                         WHERE coalesce( alg, ''md5'' ) <> $1
+                           AND ckey = digest( url, coalesce( alg, ''md5'' ) )
+                           AND cval = digest( data::text, coalesce( alg, ''md5'' ) )
+                         LIMIT $2
+                         FOR UPDATE SKIP LOCKED )', _table )
+       USING _alg, _limit;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     RETURN _count;
+   END;
+$$ LANGUAGE plpgsql;
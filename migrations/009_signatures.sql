@@ -0,0 +1,387 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 9: signed versions
+ *
+ * Every registered node holds an Ed25519 key; the public key is part of
+ * its entry in nodes.systems, the private key stays in the settings of
+ * the node ('signing_key'). A node signs (url, cval, clockid, tsn) of the
+ * versions and deletes it writes. The signature is kept with the row, its
+ * oplog entry and tombstone, and travels with them through sync.
+ *
+ * The database cannot sign: the engine writes a version first and adds
+ * the signature with nodes.sign in the same transaction.
+ */
+
+ALTER TABLE nodes.base ADD COLUMN IF NOT EXISTS sig bytea;
+ALTER TABLE nodes.oplog ADD COLUMN IF NOT EXISTS sig bytea;
+ALTER TABLE nodes.tombstones ADD COLUMN IF NOT EXISTS sig bytea;
+
+DO $$
+   DECLARE
+      _name text;
+   BEGIN
+     FOR _name IN SELECT table_name FROM nodes.managed_tables LOOP
+       EXECUTE format( 'ALTER TABLE nodes.%I ADD COLUMN IF NOT EXISTS sig bytea', _name );
+     END LOOP;
+   END;
+$$;
+
+/*
+ * the private key (Ed25519 seed) of the node, NULL if it has none
+ */
+CREATE OR REPLACE FUNCTION nodes.signing_key() RETURNS bytea AS $$
+   BEGIN
+     RETURN decode( ( SELECT value FROM nodes.settings WHERE key = 'signing_key' ), 'hex' );
+   END;
+$$ LANGUAGE plpgsql STABLE;
+
+/*
+ * store the private key of the node, unless it has one already
+ *
+ * returns the key of the node, so that concurrent callers agree
+ */
+CREATE OR REPLACE FUNCTION nodes.set_signing_key( _seed bytea ) RETURNS bytea AS $$
+   BEGIN
+     INSERT INTO nodes.settings( key, value ) VALUES ( 'signing_key', encode( _seed, 'hex' ) )
+       ON CONFLICT ( key ) DO NOTHING;
+     RETURN nodes.signing_key();
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * add the signature of a version or a delete
+ *
+ * the row, the oplog entry and the tombstone with the coordinates
+ * (clockid, tsn) get the signature. Returns false, if none is there.
+ */
+CREATE OR REPLACE FUNCTION nodes.sign( _table text, _clockid bigint, _tsn bigint, _sig bytea ) RETURNS boolean AS $$
+   DECLARE
+      _count bigint;
+      _total bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     EXECUTE format( 'UPDATE nodes.%I SET sig = $3 WHERE clockid = $1 AND tsn = $2', _table )
+        USING _clockid, _tsn, _sig;
+     GET DIAGNOSTICS _total = ROW_COUNT;
+
+     UPDATE nodes.oplog SET sig = _sig WHERE clockid = _clockid AND tsn = _tsn;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+     _total = _total + _count;
+
+     UPDATE nodes.tombstones SET sig = _sig WHERE clockid = _clockid AND tsn = _tsn;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     RETURN _total + _count > 0;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* Trigger function, version 5
+ *
+ * the oplog entry of a replicated version gets its signature. A new
+ * version, which does not bring a signature, loses the signature of the
+ * version it replaces.
+ */
+CREATE OR REPLACE FUNCTION onChange() RETURNS TRIGGER AS $$
+     DECLARE
+          _opcode text;
+          _clockid bigint;
+          _tsn     bigint;
+     BEGIN
+          /* I, U or D: Insert, Update, Delete */
+          _opcode = left( TG_OP , 1 ); /* first letter is enough */
+
+          IF _opcode = 'D' THEN
+           _clockid = nullif( current_setting( 'engine3.delete_clockid', true ), '' )::bigint;
+           IF _clockid IS NULL THEN
+             _clockid = nodes.myclockid();
+             _tsn     = nodes.new_tsn();
+           ELSE
+             _tsn     = current_setting( 'engine3.delete_tsn' )::bigint;
+           END IF;
+
+           PERFORM nodes.log_delete( TG_TABLE_NAME, OLD.url, OLD.ckey, _clockid, _tsn, OLD.clockid, OLD.tsn );
+           RETURN OLD;
+          END IF;
+
+          IF _opcode = 'U' THEN
+            IF NEW.clockid = OLD.clockid AND NEW.tsn = OLD.tsn THEN
+              RETURN NEW;
+            END IF;
+            IF NEW.sig IS NOT DISTINCT FROM OLD.sig THEN
+              NEW.sig = NULL;
+            END IF;
+          END IF;
+
+          /* an UPDATE, which does not set vv, keeps the vector of the old row */
+          IF coalesce( ( NEW.vv ->> NEW.clockid::text )::bigint, 0 ) < NEW.tsn THEN
+            NEW.vv = coalesce( NEW.vv, '{}'::jsonb ) || jsonb_build_object( NEW.clockid::text, NEW.tsn );
+          END IF;
+
+          INSERT INTO nodes.oplog( clockid, tsn, table_name, op, sig )
+               VALUES (NEW.clockid, NEW.tsn, TG_TABLE_NAME, _opcode, NEW.sig );
+
+          PERFORM nodes.putRemoteHigh( NEW.clockid, NEW.tsn );
+          RETURN NEW;
+     END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * Anti-Entropy functions, version 6: versions carry their signature
+ */
+CREATE OR REPLACE FUNCTION nodes.create_ae_functions( _name text ) RETURNS VOID AS $body$
+   BEGIN
+     /* GET */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _clockid bigint, _tsn bigint ) RETURNS SETOF nodes.base AS $fn$
+          BEGIN
+             RETURN QUERY
+               SELECT ckey, cval, url, data, clockid, tsn, vv, alg, sig FROM nodes.%2$I
+                  WHERE clockid = _clockid and tsn = _tsn;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_get_' || _name, _name );
+
+     /* PUT : the arguments changed, drop the old version first */
+     EXECUTE format( 'DROP FUNCTION IF EXISTS nodes.%I( bytea, bytea, text, json, bigint, bigint, jsonb, text )', 'ae_put_' || _name );
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint,
+              _vv jsonb, _alg text, _sig bytea ) RETURNS text AS $fn$
+          DECLARE
+             _old_clockid bigint;
+             _old_tsn     bigint;
+          BEGIN
+             FOR _attempt IN 1..2 LOOP
+               SELECT clockid, tsn INTO _old_clockid, _old_tsn FROM nodes.%2$I
+                  WHERE url = _url FOR UPDATE;
+
+               IF NOT FOUND THEN
+                 BEGIN
+                   INSERT INTO nodes.%2$I( ckey, cval, url, data, clockid, tsn, vv, alg, sig )
+                   VALUES (_ckey, _cval, _url, _data, _clockid, _tsn, _vv, _alg, _sig );
+                   RETURN 'applied';
+                 EXCEPTION WHEN unique_violation THEN
+                   /* inserted concurrently: compare with that one */
+                   IF _attempt = 2 THEN
+                     RAISE;
+                   END IF;
+                   CONTINUE;
+                 END;
+               END IF;
+
+               IF _old_clockid <> _clockid THEN
+                 RETURN 'conflict';
+               END IF;
+               IF _old_tsn >= _tsn THEN
+                 RETURN 'skipped';
+               END IF;
+
+               UPDATE nodes.%2$I
+                  SET ckey = _ckey, cval = _cval, data = _data, tsn = _tsn, vv = _vv, alg = _alg, sig = _sig
+                WHERE url = _url;
+               RETURN 'applied';
+             END LOOP;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_put_' || _name, _name );
+
+     /* DELETE */
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _clockid bigint, _tsn bigint ) RETURNS VOID AS $fn$
+          BEGIN
+             DELETE FROM nodes.%2$I WHERE clockid = _clockid and tsn = _tsn;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_delete_' || _name, _name );
+
+     /* REPLACE : overwrite the current version of the url, whatever it is */
+     EXECUTE format( 'DROP FUNCTION IF EXISTS nodes.%I( bytea, bytea, text, json, bigint, bigint, jsonb, text )', 'ae_replace_' || _name );
+     EXECUTE format( $f$
+       CREATE OR REPLACE FUNCTION nodes.%1$I( _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint,
+              _vv jsonb, _alg text, _sig bytea ) RETURNS VOID AS $fn$
+          BEGIN
+             UPDATE nodes.%2$I
+                SET ckey = _ckey, cval = _cval, data = _data, clockid = _clockid, tsn = _tsn, vv = _vv, alg = _alg,
+                    sig = _sig
+              WHERE url = _url;
+             IF NOT FOUND THEN
+                INSERT INTO nodes.%2$I( ckey, cval, url, data, clockid, tsn, vv, alg, sig )
+                VALUES (_ckey, _cval, _url, _data, _clockid, _tsn, _vv, _alg, _sig );
+             END IF;
+          END;
+       $fn$ LANGUAGE plpgsql;
+     $f$, 'ae_replace_' || _name, _name );
+   END;
+$body$ LANGUAGE plpgsql;
+
+SELECT nodes.create_ae_functions( table_name ) FROM nodes.managed_tables;
+
+/* PUT (dispatch), version 6 */
+DROP FUNCTION IF EXISTS nodes.ae_put( text, bytea, bytea, text, json, bigint, bigint, jsonb, text );
+CREATE OR REPLACE FUNCTION nodes.ae_put( _table text, _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint,
+       _vv jsonb, _alg text, _sig bytea ) RETURNS text AS $$
+   DECLARE
+      _status text;
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+
+      IF EXISTS ( SELECT 1 FROM nodes.tombstones
+                   WHERE table_name = _table AND url = _url
+                     AND deleted_clockid = _clockid AND deleted_tsn >= _tsn ) THEN
+        RETURN 'skipped';
+      END IF;
+
+      EXECUTE format( 'SELECT nodes.%I( $1, $2, $3, $4, $5, $6, $7, $8, $9 )', 'ae_put_' || _table )
+        INTO _status
+        USING _ckey, _cval, _url, _data, _clockid, _tsn, _vv, _alg, _sig;
+      RETURN _status;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* REPLACE (dispatch), version 4 */
+DROP FUNCTION IF EXISTS nodes.ae_replace( text, bytea, bytea, text, json, bigint, bigint, jsonb, text );
+CREATE OR REPLACE FUNCTION nodes.ae_replace( _table text, _ckey bytea, _cval bytea, _url text, _data json, _clockid bigint, _tsn bigint,
+       _vv jsonb, _alg text, _sig bytea ) RETURNS VOID AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      EXECUTE format( 'SELECT nodes.%I( $1, $2, $3, $4, $5, $6, $7, $8, $9 )', 'ae_replace_' || _table )
+        USING _ckey, _cval, _url, _data, _clockid, _tsn, _vv, _alg, _sig;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* GET, version 4 */
+CREATE OR REPLACE FUNCTION nodes.thing_get( _table text, _url text ) RETURNS SETOF nodes.base AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT ckey, cval, url, data, clockid, tsn, vv, alg, sig FROM nodes.%I WHERE url = $1', _table )
+        USING _url;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* LIST, version 4 */
+CREATE OR REPLACE FUNCTION nodes.thing_list( _table text ) RETURNS SETOF nodes.base AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT ckey, cval, url, data, clockid, tsn, vv, alg, sig FROM nodes.%I ORDER BY url', _table );
+   END;
+$$ LANGUAGE plpgsql;
+
+/* BUCKET, version 3 */
+CREATE OR REPLACE FUNCTION nodes.bucket_things( _table text, _bucket text ) RETURNS SETOF nodes.base AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT ckey, cval, url, data, clockid, tsn, vv, alg, sig FROM nodes.%I
+          WHERE left( encode( ckey, ''hex'' ), length( $1 ) ) = $1
+          ORDER BY ckey', _table )
+        USING _bucket;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * DELETE with the coordinates and signature given by the engine
+ *
+ * returns false, if there was no row for the url
+ */
+CREATE OR REPLACE FUNCTION nodes.thing_delete( _table text, _url text, _clockid bigint, _tsn bigint, _sig bytea ) RETURNS boolean AS $$
+   DECLARE
+      _count bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     PERFORM set_config( 'engine3.delete_clockid', _clockid::text, true );
+     PERFORM set_config( 'engine3.delete_tsn', _tsn::text, true );
+
+     EXECUTE format( 'DELETE FROM nodes.%I WHERE url = $1', _table ) USING _url;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     PERFORM set_config( 'engine3.delete_clockid', '', true );
+     PERFORM set_config( 'engine3.delete_tsn', '', true );
+
+     IF _count = 0 THEN
+       RETURN false;
+     END IF;
+
+     PERFORM nodes.sign( _table, _clockid, _tsn, _sig );
+     RETURN true;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * read the tombstone of a delete, version 2: with its signature
+ */
+DROP FUNCTION IF EXISTS nodes.getTombstone( text, bigint, bigint );
+CREATE OR REPLACE FUNCTION nodes.getTombstone( _table text, _clockid bigint, _tsn bigint ) RETURNS TABLE(
+       _url text, _ckey bytea, _deleted_clockid bigint, _deleted_tsn bigint, _sig bytea ) AS $$
+   BEGIN
+     RETURN QUERY
+        SELECT url, ckey, deleted_clockid, deleted_tsn, sig FROM nodes.tombstones
+         WHERE table_name = _table AND clockid = _clockid AND tsn = _tsn;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * apply the tombstone of another node, version 2: with its signature
+ */
+DROP FUNCTION IF EXISTS nodes.ae_tombstone( text, text, bytea, bigint, bigint, bigint, bigint );
+CREATE OR REPLACE FUNCTION nodes.ae_tombstone( _table text, _url text, _ckey bytea, _clockid bigint, _tsn bigint,
+       _deleted_clockid bigint, _deleted_tsn bigint, _sig bytea ) RETURNS text AS $$
+   DECLARE
+      _count bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     IF EXISTS ( SELECT 1 FROM nodes.tombstones WHERE clockid = _clockid AND tsn = _tsn ) THEN
+       RETURN 'skipped';
+     END IF;
+
+     PERFORM set_config( 'engine3.delete_clockid', _clockid::text, true );
+     PERFORM set_config( 'engine3.delete_tsn', _tsn::text, true );
+
+     EXECUTE format( 'DELETE FROM nodes.%I WHERE url = $1', _table ) USING _url;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     PERFORM set_config( 'engine3.delete_clockid', '', true );
+     PERFORM set_config( 'engine3.delete_tsn', '', true );
+
+     IF _count = 0 THEN
+       PERFORM nodes.log_delete( _table, _url, _ckey, _clockid, _tsn, _deleted_clockid, _deleted_tsn );
+     END IF;
+
+     PERFORM nodes.sign( _table, _clockid, _tsn, _sig );
+     RETURN 'applied';
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * rehash, version 2: signed rows keep the digests they were signed with
+ */
+CREATE OR REPLACE FUNCTION nodes.rehash( _table text, _alg text, _limit int ) RETURNS bigint AS $$
+   DECLARE
+      _count bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     IF _alg NOT IN ( 'md5', 'sha256' ) THEN
+       RAISE EXCEPTION 'unknown digest algorithm %', _alg
+         USING ERRCODE = 'invalid_parameter_value';
+     END IF;
+
+     EXECUTE format(
+       'UPDATE nodes.%1$I
+           SET ckey = digest( url, $1 ), cval = digest( data::text, $1 ), alg = $1
+         WHERE url IN ( SELECT url FROM nodes.%1$I
+                         WHERE coalesce( alg, ''md5'' ) <> $1
+                           AND sig IS NULL
+                           AND ckey = digest( url, coalesce( alg, ''md5'' ) )
+                           AND cval = digest( data::text, coalesce( alg, ''md5'' ) )
+                         LIMIT $2
+                         FOR UPDATE SKIP LOCKED )', _table )
+       USING _alg, _limit;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     RETURN _count;
+   END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,153 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 10: hash chained oplog
+ *
+ * The entries of every clock in the oplog form a chain: an entry holds
+ * the hash of the entry of the same clock written before it (prev) and
+ * its own hash over prev, clockid, tsn, table_name and op. The last
+ * entry of every chain is kept in nodes.oplog_heads. An entry removed or
+ * rewritten breaks the chain; a history rewritten as a whole changes the
+ * hashes, which the peers remember from the last sync.
+ *
+ * The signature of an entry is added after the entry and not hashed, it
+ * protects itself.
+ */
+
+ALTER TABLE nodes.oplog ADD COLUMN IF NOT EXISTS prev bytea;
+ALTER TABLE nodes.oplog ADD COLUMN IF NOT EXISTS hash bytea;
+
+CREATE INDEX IF NOT EXISTS oplog_hash ON nodes.oplog( clockid, hash );
+
+/*
+ * the last entry of the chain of every clock
+ */
+CREATE TABLE IF NOT EXISTS nodes.oplog_heads (
+     clockid    bigint,
+     tsn        bigint,
+     hash       bytea,
+     PRIMARY KEY( clockid )
+);
+
+/*
+ * the chain heads of the peers we sync from, as seen at the last sync
+ */
+CREATE TABLE IF NOT EXISTS nodes.peer_chain_heads (
+     peer       bigint,
+     clockid    bigint,
+     tsn        bigint,
+     hash       bytea,
+     updated    timestamp with time zone DEFAULT now(),
+     PRIMARY KEY( peer, clockid )
+);
+
+/*
+ * the hash of an oplog entry
+ */
+CREATE OR REPLACE FUNCTION nodes.oplog_hash( _prev bytea, _clockid bigint, _tsn bigint, _table text, _op text ) RETURNS bytea AS $$
+   BEGIN
+     RETURN digest( coalesce( _prev, ''::bytea ) || convert_to( format( '%s/%s/%s/%s', _clockid, _tsn, _table, _op ), 'UTF8' ),
+                    'sha256' );
+   END;
+$$ LANGUAGE plpgsql IMMUTABLE;
+
+/* chain the existing entries in tsn order */
+DO $$
+   DECLARE
+      _entry record;
+      _prev  bytea;
+      _clock bigint;
+   BEGIN
+     FOR _entry IN SELECT clockid, tsn, table_name, op FROM nodes.oplog WHERE hash IS NULL ORDER BY clockid, tsn LOOP
+       IF _clock IS DISTINCT FROM _entry.clockid THEN
+         _clock = _entry.clockid;
+         _prev  = NULL;
+       END IF;
+
+       UPDATE nodes.oplog
+          SET prev = _prev, hash = nodes.oplog_hash( _prev, _entry.clockid, _entry.tsn, _entry.table_name, _entry.op )
+        WHERE clockid = _entry.clockid AND tsn = _entry.tsn
+        RETURNING hash INTO _prev;
+
+       INSERT INTO nodes.oplog_heads( clockid, tsn, hash ) VALUES ( _entry.clockid, _entry.tsn, _prev )
+         ON CONFLICT ( clockid ) DO UPDATE SET tsn = EXCLUDED.tsn, hash = EXCLUDED.hash;
+     END LOOP;
+   END;
+$$;
+
+/*
+ * chain a new oplog entry to the head of its clock
+ *
+ * the head row is locked until the end of the transaction, so the
+ * entries of a clock are chained one after the other
+ */
+CREATE OR REPLACE FUNCTION nodes.chain_oplog() RETURNS TRIGGER AS $$
+   BEGIN
+     INSERT INTO nodes.oplog_heads( clockid ) VALUES ( NEW.clockid ) ON CONFLICT DO NOTHING;
+
+     SELECT hash INTO NEW.prev FROM nodes.oplog_heads WHERE clockid = NEW.clockid FOR UPDATE;
+     NEW.hash = nodes.oplog_hash( NEW.prev, NEW.clockid, NEW.tsn, NEW.table_name, NEW.op );
+
+     UPDATE nodes.oplog_heads SET tsn = NEW.tsn, hash = NEW.hash WHERE clockid = NEW.clockid;
+     RETURN NEW;
+   END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS chain_oplog ON nodes.oplog;
+CREATE TRIGGER chain_oplog BEFORE INSERT ON nodes.oplog
+   FOR EACH ROW EXECUTE PROCEDURE nodes.chain_oplog();
+
+/*
+ * the chain of a clock: every entry with its links and whether its hash
+ * matches its content
+ */
+CREATE OR REPLACE FUNCTION nodes.getOplogChain( _clockid bigint ) RETURNS TABLE(
+       _tsn bigint, _table_name text, _op text, _prev bytea, _hash bytea, _valid boolean ) AS $$
+   BEGIN
+     RETURN QUERY
+        SELECT tsn, table_name, op, prev, hash,
+               hash IS NOT DISTINCT FROM nodes.oplog_hash( prev, clockid, tsn, table_name, op )
+          FROM nodes.oplog
+         WHERE clockid = _clockid
+         ORDER BY tsn;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * the chain heads of all clocks
+ */
+CREATE OR REPLACE FUNCTION nodes.getChainHeads() RETURNS TABLE( _clockid bigint, _tsn bigint, _hash bytea ) AS $$
+   BEGIN
+     RETURN QUERY
+        SELECT clockid, tsn, hash FROM nodes.oplog_heads WHERE hash IS NOT NULL ORDER BY clockid;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * the hash of the entry (clockid, tsn), NULL if there is none
+ */
+CREATE OR REPLACE FUNCTION nodes.getChainHash( _clockid bigint, _tsn bigint ) RETURNS bytea AS $$
+   BEGIN
+     RETURN ( SELECT hash FROM nodes.oplog WHERE clockid = _clockid AND tsn = _tsn );
+   END;
+$$ LANGUAGE plpgsql STABLE;
+
+/*
+ * remember a chain head of a peer
+ */
+CREATE OR REPLACE FUNCTION nodes.putPeerChainHead( _peer bigint, _clockid bigint, _tsn bigint, _hash bytea ) RETURNS VOID AS $$
+   BEGIN
+     INSERT INTO nodes.peer_chain_heads( peer, clockid, tsn, hash ) VALUES ( _peer, _clockid, _tsn, _hash )
+       ON CONFLICT ( peer, clockid ) DO UPDATE
+         SET tsn = EXCLUDED.tsn, hash = EXCLUDED.hash, updated = now();
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * the chain heads of a peer, as seen at the last sync
+ */
+CREATE OR REPLACE FUNCTION nodes.getPeerChainHeads( _peer bigint ) RETURNS TABLE( _clockid bigint, _tsn bigint, _hash bytea ) AS $$
+   BEGIN
+     RETURN QUERY
+        SELECT clockid, tsn, hash FROM nodes.peer_chain_heads WHERE peer = _peer ORDER BY clockid;
+   END;
+$$ LANGUAGE plpgsql;
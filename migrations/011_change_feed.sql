@@ -0,0 +1,85 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 11: change feed
+ *
+ * Every oplog entry is announced with NOTIFY on the channel
+ * engine3_changes; the payload is a JSON object with table, clockid, tsn
+ * and op. Notifications are delivered at commit, a rolled back change is
+ * never announced.
+ */
+
+/*
+ * announce an oplog entry
+ */
+CREATE OR REPLACE FUNCTION nodes.notify_change( _table text, _clockid bigint, _tsn bigint, _op text ) RETURNS VOID AS $$
+   BEGIN
+     PERFORM pg_notify( 'engine3_changes',
+                        json_build_object( 'table', _table, 'clockid', _clockid, 'tsn', _tsn, 'op', _op )::text );
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * log a delete, version 2: the delete is announced
+ */
+CREATE OR REPLACE FUNCTION nodes.log_delete( _table text, _url text, _ckey bytea, _clockid bigint, _tsn bigint,
+       _deleted_clockid bigint, _deleted_tsn bigint ) RETURNS VOID AS $$
+   BEGIN
+     INSERT INTO nodes.oplog( clockid, tsn, table_name, op )
+          VALUES ( _clockid, _tsn, _table, 'D' );
+
+     INSERT INTO nodes.tombstones( clockid, tsn, table_name, url, ckey, deleted_clockid, deleted_tsn )
+          VALUES ( _clockid, _tsn, _table, _url, _ckey, _deleted_clockid, _deleted_tsn );
+
+     PERFORM nodes.putRemoteHigh( _clockid, _tsn );
+     PERFORM nodes.notify_change( _table, _clockid, _tsn, 'D' );
+   END;
+$$ LANGUAGE plpgsql;
+
+/* Trigger function, version 6
+ *
+ * inserts and updates are announced (deletes by nodes.log_delete)
+ */
+CREATE OR REPLACE FUNCTION onChange() RETURNS TRIGGER AS $$
+     DECLARE
+          _opcode text;
+          _clockid bigint;
+          _tsn     bigint;
+     BEGIN
+          /* I, U or D: Insert, Update, Delete */
+          _opcode = left( TG_OP , 1 ); /* first letter is enough */
+
+          IF _opcode = 'D' THEN
+           _clockid = nullif( current_setting( 'engine3.delete_clockid', true ), '' )::bigint;
+           IF _clockid IS NULL THEN
+             _clockid = nodes.myclockid();
+             _tsn     = nodes.new_tsn();
+           ELSE
+             _tsn     = current_setting( 'engine3.delete_tsn' )::bigint;
+           END IF;
+
+           PERFORM nodes.log_delete( TG_TABLE_NAME, OLD.url, OLD.ckey, _clockid, _tsn, OLD.clockid, OLD.tsn );
+           RETURN OLD;
+          END IF;
+
+          IF _opcode = 'U' THEN
+            IF NEW.clockid = OLD.clockid AND NEW.tsn = OLD.tsn THEN
+              RETURN NEW;
+            END IF;
+            IF NEW.sig IS NOT DISTINCT FROM OLD.sig THEN
+              NEW.sig = NULL;
+            END IF;
+          END IF;
+
+          /* an UPDATE, which does not set vv, keeps the vector of the old row */
+          IF coalesce( ( NEW.vv ->> NEW.clockid::text )::bigint, 0 ) < NEW.tsn THEN
+            NEW.vv = coalesce( NEW.vv, '{}'::jsonb ) || jsonb_build_object( NEW.clockid::text, NEW.tsn );
+          END IF;
+
+          INSERT INTO nodes.oplog( clockid, tsn, table_name, op, sig )
+               VALUES (NEW.clockid, NEW.tsn, TG_TABLE_NAME, _opcode, NEW.sig );
+
+          PERFORM nodes.putRemoteHigh( NEW.clockid, NEW.tsn );
+          PERFORM nodes.notify_change( TG_TABLE_NAME, NEW.clockid, NEW.tsn, _opcode );
+          RETURN NEW;
+     END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,33 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 12: oplog pages
+ *
+ * The oplog tail can be read in pages, oldest first. A page starts after
+ * the position (tsn, clockid) of the last entry read; the tail of all
+ * clocks (in_clockid 0) is ordered by tsn and clockid, so that entries of
+ * different clocks with the same tsn are not lost between two pages.
+ */
+
+CREATE INDEX IF NOT EXISTS oplog_tsn ON nodes.oplog( tsn, clockid );
+
+/*
+ * a page of the oplog tail after (in_tsn, in_after_clockid), oldest first
+ */
+CREATE OR REPLACE FUNCTION nodes.getOplogTail( in_clockid bigint, in_tsn bigint, in_after_clockid bigint, in_limit bigint )
+       RETURNS TABLE(  _table_name text, _clockid bigint, _tsn bigint, _op text ) AS $$
+   BEGIN
+     IF in_clockid = 0 THEN
+       RETURN QUERY
+          SELECT table_name, clockid, tsn, op from nodes.oplog
+           WHERE ( tsn, clockid ) > ( in_tsn, in_after_clockid )
+           ORDER BY tsn, clockid
+           LIMIT in_limit;
+     ELSE
+       RETURN QUERY
+          SELECT table_name, clockid, tsn, op from nodes.oplog
+           WHERE clockid = in_clockid and tsn > in_tsn
+           ORDER BY tsn
+           LIMIT in_limit;
+     END IF;
+   END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,185 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 13: oplog compaction and retention
+ *
+ * Compaction removes the oplog entries, which are no longer the latest
+ * operation on their url, once every peer has passed them: an insert or
+ * update, whose version was replaced, and a delete, whose tombstone was
+ * collected or whose url was written again. Peers are the registered
+ * nodes and the nodes we synced from (nodes.peer_highwatermarks), like
+ * for collecting tombstones.
+ *
+ * The retention limits the age and number of the entries regardless of
+ * the peers. A peer behind the last tsn removed that way (resync_tsn) can
+ * no longer catch up from the oplog and needs a full resync.
+ *
+ * The head of a chain is never removed. The chain of a compacted clock is
+ * verified from link, the prev of the first entry of its intact tail; the
+ * entries before are checked one by one. The entries existing before this
+ * migration are taken as created now.
+ */
+
+ALTER TABLE nodes.oplog ADD COLUMN IF NOT EXISTS created timestamp with time zone DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS oplog_created ON nodes.oplog( created );
+
+/*
+ * the compacted part of the chain of every clock
+ */
+CREATE TABLE IF NOT EXISTS nodes.oplog_checkpoints (
+     clockid    bigint,
+     tsn        bigint,            /* the last tsn removed */
+     link       bytea,             /* prev of the intact tail, NULL: from the start */
+     resync_tsn bigint DEFAULT 0,  /* the last tsn removed by the retention */
+     updated    timestamp with time zone DEFAULT now(),
+     PRIMARY KEY( clockid )
+);
+
+/*
+ * record removed entries of a clock up to tsn
+ */
+CREATE OR REPLACE FUNCTION nodes.oplog_compacted( _clockid bigint, _tsn bigint, _resync boolean ) RETURNS VOID AS $$
+   BEGIN
+     INSERT INTO nodes.oplog_checkpoints( clockid, tsn, resync_tsn )
+          VALUES ( _clockid, _tsn, CASE WHEN _resync THEN _tsn ELSE 0 END )
+       ON CONFLICT ( clockid ) DO UPDATE
+         SET tsn        = greatest( nodes.oplog_checkpoints.tsn, EXCLUDED.tsn ),
+             resync_tsn = greatest( nodes.oplog_checkpoints.resync_tsn, EXCLUDED.resync_tsn ),
+             updated    = now();
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * the prev of the first entry of the intact tail of a chain: the chain is
+ * followed back from its head as long as the entries exist
+ */
+CREATE OR REPLACE FUNCTION nodes.oplog_tail_link( _clockid bigint ) RETURNS bytea AS $$
+   BEGIN
+     RETURN (
+       WITH RECURSIVE tail AS (
+            SELECT o.prev FROM nodes.oplog o
+              JOIN nodes.oplog_heads h ON h.clockid = o.clockid AND h.tsn = o.tsn
+             WHERE o.clockid = _clockid
+         UNION ALL
+            SELECT o.prev FROM tail
+              JOIN nodes.oplog o ON o.clockid = _clockid AND o.hash = tail.prev )
+       SELECT tail.prev FROM tail
+        WHERE NOT EXISTS ( SELECT 1 FROM nodes.oplog o WHERE o.clockid = _clockid AND o.hash = tail.prev )
+        LIMIT 1 );
+   END;
+$$ LANGUAGE plpgsql STABLE;
+
+/*
+ * compact the oplog and apply the retention (NULL: no limit)
+ *
+ * returns the number of entries removed as superseded, as older than
+ * _max_age and above _max_rows
+ */
+CREATE OR REPLACE FUNCTION nodes.compact_oplog( _max_age interval, _max_rows bigint )
+       RETURNS TABLE( _superseded bigint, _expired bigint, _trimmed bigint ) AS $$
+   DECLARE
+      _table   text;
+      _live    text;
+      _row     record;
+      _excess  bigint;
+      _clockid bigint;
+      _clocks  bigint[] = '{}';
+   BEGIN
+     _superseded = 0;
+     _expired    = 0;
+     _trimmed    = 0;
+
+     /* superseded entries, which every peer has passed */
+     FOR _table IN SELECT DISTINCT table_name FROM nodes.oplog LOOP
+       IF to_regclass( format( 'nodes.%I', _table ) ) IS NULL THEN
+         _live = 'false';
+       ELSE
+         _live = format( $l$
+            CASE WHEN o.op = 'D'
+                 THEN EXISTS ( SELECT 1 FROM nodes.tombstones t
+                                WHERE t.clockid = o.clockid AND t.tsn = o.tsn
+                                  AND NOT EXISTS ( SELECT 1 FROM nodes.%1$I r WHERE r.url = t.url ) )
+                 ELSE EXISTS ( SELECT 1 FROM nodes.%1$I r WHERE r.clockid = o.clockid AND r.tsn = o.tsn )
+            END $l$, _table );
+       END IF;
+
+       FOR _row IN EXECUTE format( $q$
+            WITH removed AS (
+              DELETE FROM nodes.oplog o
+               WHERE o.table_name = $1
+                 AND NOT ( %s )
+                 AND NOT EXISTS ( SELECT 1 FROM nodes.oplog_heads h WHERE h.clockid = o.clockid AND h.tsn = o.tsn )
+                 AND NOT EXISTS (
+                       SELECT 1 FROM ( SELECT clockid AS peer FROM nodes.systems WHERE clockid <> nodes.myclockid()
+                                        UNION
+                                       SELECT peer FROM nodes.peer_highwatermarks ) p
+                        WHERE coalesce( ( SELECT h.tsn FROM nodes.peer_highwatermarks h
+                                           WHERE h.peer = p.peer AND h.clockid = o.clockid ), 0 ) < o.tsn )
+               RETURNING o.clockid, o.tsn )
+            SELECT clockid, max( tsn ) AS tsn, count(*) AS n FROM removed GROUP BY clockid $q$, _live )
+          USING _table
+       LOOP
+         PERFORM nodes.oplog_compacted( _row.clockid, _row.tsn, false );
+         _clocks = _clocks || _row.clockid;
+         _superseded = _superseded + _row.n;
+       END LOOP;
+     END LOOP;
+
+     /* entries older than the retention */
+     IF _max_age IS NOT NULL THEN
+       FOR _row IN
+            WITH removed AS (
+              DELETE FROM nodes.oplog o
+               WHERE o.created < now() - _max_age
+                 AND NOT EXISTS ( SELECT 1 FROM nodes.oplog_heads h WHERE h.clockid = o.clockid AND h.tsn = o.tsn )
+               RETURNING o.clockid, o.tsn )
+            SELECT clockid, max( tsn ) AS tsn, count(*) AS n FROM removed GROUP BY clockid
+       LOOP
+         PERFORM nodes.oplog_compacted( _row.clockid, _row.tsn, true );
+         _clocks = _clocks || _row.clockid;
+         _expired = _expired + _row.n;
+       END LOOP;
+     END IF;
+
+     /* the oldest entries above the size limit */
+     IF _max_rows IS NOT NULL THEN
+       SELECT count(*) - _max_rows INTO _excess FROM nodes.oplog;
+
+       IF _excess > 0 THEN
+         FOR _row IN
+              WITH removed AS (
+                DELETE FROM nodes.oplog o
+                 WHERE ( o.clockid, o.tsn ) IN (
+                         SELECT x.clockid, x.tsn FROM nodes.oplog x
+                          WHERE NOT EXISTS ( SELECT 1 FROM nodes.oplog_heads h WHERE h.clockid = x.clockid AND h.tsn = x.tsn )
+                          ORDER BY x.created, x.tsn
+                          LIMIT _excess )
+                 RETURNING o.clockid, o.tsn )
+              SELECT clockid, max( tsn ) AS tsn, count(*) AS n FROM removed GROUP BY clockid
+         LOOP
+           PERFORM nodes.oplog_compacted( _row.clockid, _row.tsn, true );
+           _clocks = _clocks || _row.clockid;
+           _trimmed = _trimmed + _row.n;
+         END LOOP;
+       END IF;
+     END IF;
+
+     /* the chains of the compacted clocks continue from their intact tail */
+     FOR _clockid IN SELECT DISTINCT unnest( _clocks ) LOOP
+       UPDATE nodes.oplog_checkpoints SET link = nodes.oplog_tail_link( _clockid ) WHERE clockid = _clockid;
+     END LOOP;
+
+     RETURN NEXT;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * the compacted part of the chain of every clock
+ */
+CREATE OR REPLACE FUNCTION nodes.getOplogCheckpoints() RETURNS TABLE(
+       _clockid bigint, _tsn bigint, _link bytea, _resync_tsn bigint ) AS $$
+   BEGIN
+     RETURN QUERY
+        SELECT clockid, tsn, link, resync_tsn FROM nodes.oplog_checkpoints ORDER BY clockid;
+   END;
+$$ LANGUAGE plpgsql;
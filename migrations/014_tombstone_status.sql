@@ -0,0 +1,44 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 14: status of applied tombstones
+ *
+ * A tombstone of a url, which is not there, is recorded for the other
+ * nodes but removes nothing: ae_tombstone tells it apart as 'recorded'.
+ */
+
+/*
+ * apply the tombstone of another node, version 3: 'applied' only, if a
+ * row was removed
+ */
+CREATE OR REPLACE FUNCTION nodes.ae_tombstone( _table text, _url text, _ckey bytea, _clockid bigint, _tsn bigint,
+       _deleted_clockid bigint, _deleted_tsn bigint, _sig bytea ) RETURNS text AS $$
+   DECLARE
+      _count bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     IF EXISTS ( SELECT 1 FROM nodes.tombstones WHERE clockid = _clockid AND tsn = _tsn ) THEN
+       RETURN 'skipped';
+     END IF;
+
+     PERFORM set_config( 'engine3.delete_clockid', _clockid::text, true );
+     PERFORM set_config( 'engine3.delete_tsn', _tsn::text, true );
+
+     EXECUTE format( 'DELETE FROM nodes.%I WHERE url = $1', _table ) USING _url;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     PERFORM set_config( 'engine3.delete_clockid', '', true );
+     PERFORM set_config( 'engine3.delete_tsn', '', true );
+
+     IF _count = 0 THEN
+       PERFORM nodes.log_delete( _table, _url, _ckey, _clockid, _tsn, _deleted_clockid, _deleted_tsn );
+     END IF;
+
+     PERFORM nodes.sign( _table, _clockid, _tsn, _sig );
+
+     IF _count = 0 THEN
+       RETURN 'recorded';
+     END IF;
+     RETURN 'applied';
+   END;
+$$ LANGUAGE plpgsql;
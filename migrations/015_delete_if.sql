@@ -0,0 +1,36 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 15: conditional DELETE
+ *
+ * The counterpart of thing_put_if: the current version is checked and the
+ * row locked in the transaction of the delete, so that no write comes in
+ * between.
+ */
+
+/*
+ * lock the current version of a thing, if it is (_clockid, _tsn)
+ */
+CREATE OR REPLACE FUNCTION nodes.thing_lock_if( _table text, _url text, _clockid bigint, _tsn bigint ) RETURNS VOID AS $$
+   DECLARE
+      old_clockid bigint;
+      old_tsn     bigint;
+      _count      bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     EXECUTE format( 'SELECT clockid, tsn FROM nodes.%I WHERE url = $1 FOR UPDATE', _table )
+        INTO old_clockid, old_tsn USING _url;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     IF _count = 0 THEN
+        old_clockid := 0;
+        old_tsn     := 0;
+     END IF;
+
+     IF old_clockid <> _clockid OR old_tsn <> _tsn THEN
+        RAISE EXCEPTION 'stale version of %: expected %/%, found %/%',
+           _url, _clockid, _tsn, old_clockid, old_tsn
+          USING ERRCODE = 'EN003';
+     END IF;
+   END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,29 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 16: registrations certified by the master
+ *
+ * A registration, which brings the key of a new node, is signed by the
+ * master with its own key, not by the new node. Every node keeps the
+ * public key of its master ('registry_key'), pinned when it registers,
+ * to check the registrations it receives with. Nodes registered before
+ * have none until they register again.
+ */
+
+/*
+ * the public key of the master, NULL if it is not known
+ */
+CREATE OR REPLACE FUNCTION nodes.registry_key() RETURNS bytea AS $$
+   BEGIN
+     RETURN decode( ( SELECT value FROM nodes.settings WHERE key = 'registry_key' ), 'hex' );
+   END;
+$$ LANGUAGE plpgsql STABLE;
+
+/*
+ * pin the public key of the master
+ */
+CREATE OR REPLACE FUNCTION nodes.set_registry_key( _key bytea ) RETURNS VOID AS $$
+   BEGIN
+     INSERT INTO nodes.settings( key, value ) VALUES ( 'registry_key', encode( _key, 'hex' ) )
+       ON CONFLICT ( key ) DO UPDATE SET value = EXCLUDED.value;
+   END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,26 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 17: private keys outside the database
+ *
+ * The private key of a node is kept in a key file of the engine, the
+ * database holds only the public keys in nodes.systems. A key stored in
+ * the settings before ('signing_key') is taken over by the engine, which
+ * writes it to the key file and removes the setting, when it first needs
+ * the key.
+ */
+
+DROP FUNCTION IF EXISTS nodes.set_signing_key( bytea );
+DROP FUNCTION IF EXISTS nodes.signing_key();
+
+/*
+ * remove the private key kept in the settings and return it, NULL if
+ * there is none
+ */
+CREATE OR REPLACE FUNCTION nodes.take_signing_key() RETURNS bytea AS $$
+   DECLARE
+      _seed text;
+   BEGIN
+     DELETE FROM nodes.settings WHERE key = 'signing_key' RETURNING value INTO _seed;
+     RETURN decode( _seed, 'hex' );
+   END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,62 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 18: rehash signed rows
+ *
+ * A signature covers cval, so a rehashed row has to be signed again. The
+ * rows of the local clock are rehashed with their signature removed and
+ * returned, the engine signs them again in the same transaction. Signed
+ * rows of other nodes keep their digests: only their node can sign them.
+ */
+
+/*
+ * rehash, version 3: the rows rehashed, _resign for the signed rows of the
+ * local clock, which lost their signature
+ */
+DROP FUNCTION IF EXISTS nodes.rehash( text, text, int );
+CREATE OR REPLACE FUNCTION nodes.rehash( _table text, _alg text, _limit int ) RETURNS TABLE(
+       _url text, _cval bytea, _clockid bigint, _tsn bigint, _resign boolean ) AS $$
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     IF _alg NOT IN ( 'md5', 'sha256' ) THEN
+       RAISE EXCEPTION 'unknown digest algorithm %', _alg
+         USING ERRCODE = 'invalid_parameter_value';
+     END IF;
+
+     RETURN QUERY EXECUTE format(
+       'WITH picked AS (
+             SELECT url, sig IS NOT NULL AS signed FROM nodes.%1$I
+              WHERE coalesce( alg, ''md5'' ) <> $1
+                AND ( sig IS NULL OR clockid = nodes.myclockid() )
+                AND ckey = digest( url, coalesce( alg, ''md5'' ) )
+                AND cval = digest( data::text, coalesce( alg, ''md5'' ) )
+              LIMIT $2
+              FOR UPDATE SKIP LOCKED )
+        UPDATE nodes.%1$I t
+           SET ckey = digest( t.url, $1 ), cval = digest( t.data::text, $1 ), alg = $1, sig = NULL
+          FROM picked
+         WHERE t.url = picked.url
+        RETURNING t.url, t.cval, t.clockid, t.tsn, picked.signed', _table )
+       USING _alg, _limit;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * the number of signed rows of other nodes, which keep a digest other
+ * than _alg
+ */
+CREATE OR REPLACE FUNCTION nodes.rehash_kept( _table text, _alg text ) RETURNS bigint AS $$
+   DECLARE
+      _count bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     EXECUTE format(
+       'SELECT count(*) FROM nodes.%I
+         WHERE coalesce( alg, ''md5'' ) <> $1 AND sig IS NOT NULL AND clockid <> nodes.myclockid()', _table )
+        INTO _count
+       USING _alg;
+
+     RETURN _count;
+   END;
+$$ LANGUAGE plpgsql STABLE;
@@ -0,0 +1,19 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 19: one replay of a clock at a time
+ *
+ * Syncs with different peers run concurrently; the versions of a clock
+ * are replayed under a transaction lock of the clock, so that two of them
+ * do not replay the same oplog entries. The lock is advisory: it keeps
+ * out other syncs and bootstraps, not local writes.
+ */
+
+/*
+ * lock a clock for a replay until the end of the transaction
+ */
+CREATE OR REPLACE FUNCTION nodes.lock_clock( _clockid bigint ) RETURNS VOID AS $$
+   BEGIN
+     -- 'sync' as the class, clocks hashing alike only wait for each other
+     PERFORM pg_advisory_xact_lock( x'73796e63'::int, hashint8( _clockid ) );
+   END;
+$$ LANGUAGE plpgsql;
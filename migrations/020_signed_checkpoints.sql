@@ -0,0 +1,49 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 20: signed oplog checkpoints
+ *
+ * A peer takes a chain head it saw, which is no longer in the oplog, as
+ * compacted, if a checkpoint covers it. The node signs its checkpoints, so
+ * that a row inserted into nodes.oplog_checkpoints cannot hide a rewritten
+ * history. A checkpoint changed by a compaction loses its signature until
+ * the node signs it again.
+ */
+
+ALTER TABLE nodes.oplog_checkpoints ADD COLUMN IF NOT EXISTS signature bytea;
+
+/*
+ * record removed entries of a clock up to tsn, version 2: unsigned again
+ */
+CREATE OR REPLACE FUNCTION nodes.oplog_compacted( _clockid bigint, _tsn bigint, _resync boolean ) RETURNS VOID AS $$
+   BEGIN
+     INSERT INTO nodes.oplog_checkpoints( clockid, tsn, resync_tsn )
+          VALUES ( _clockid, _tsn, CASE WHEN _resync THEN _tsn ELSE 0 END )
+       ON CONFLICT ( clockid ) DO UPDATE
+         SET tsn        = greatest( nodes.oplog_checkpoints.tsn, EXCLUDED.tsn ),
+             resync_tsn = greatest( nodes.oplog_checkpoints.resync_tsn, EXCLUDED.resync_tsn ),
+             signature  = NULL,
+             updated    = now();
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * add the signature of the checkpoint of a clock
+ */
+CREATE OR REPLACE FUNCTION nodes.sign_oplog_checkpoint( _clockid bigint, _signature bytea ) RETURNS VOID AS $$
+   BEGIN
+     UPDATE nodes.oplog_checkpoints SET signature = _signature WHERE clockid = _clockid;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * the compacted part of the chain of every clock, version 2: with the
+ * signature; the return type changed, drop the old version first
+ */
+DROP FUNCTION IF EXISTS nodes.getOplogCheckpoints();
+CREATE FUNCTION nodes.getOplogCheckpoints() RETURNS TABLE(
+       _clockid bigint, _tsn bigint, _link bytea, _resync_tsn bigint, _signature bytea ) AS $$
+   BEGIN
+     RETURN QUERY
+        SELECT clockid, tsn, link, resync_tsn, signature FROM nodes.oplog_checkpoints ORDER BY clockid;
+   END;
+$$ LANGUAGE plpgsql;
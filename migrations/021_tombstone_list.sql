@@ -0,0 +1,20 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 21: the tombstones of a table
+ *
+ * A bootstrap copies the tombstones of the snapshot with the versions, so
+ * that the deletes of the master reach a node, which resyncs.
+ */
+
+/*
+ * the tombstones of a table, oldest first
+ */
+CREATE OR REPLACE FUNCTION nodes.list_tombstones( _table text ) RETURNS TABLE(
+       _url text, _ckey bytea, _clockid bigint, _tsn bigint, _deleted_clockid bigint, _deleted_tsn bigint, _sig bytea ) AS $$
+   BEGIN
+     RETURN QUERY
+        SELECT url, ckey, clockid, tsn, deleted_clockid, deleted_tsn, sig FROM nodes.tombstones
+         WHERE table_name = _table
+         ORDER BY tsn, clockid;
+   END;
+$$ LANGUAGE plpgsql;
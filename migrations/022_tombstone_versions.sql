@@ -0,0 +1,162 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 22: tombstones delete only what they cover
+ *
+ * A tombstone keeps the version vector of the version it deleted
+ * (deleted_vv). A replayed tombstone removes the local version of its url
+ * only, if the delete covers it: it is the deleted version or an older one
+ * of its clock, or it is in the vector of the deleted version, so that the
+ * deleting node had seen it. A version written after the delete is kept
+ * and the tombstone is 'skipped'. Tombstones from before this migration
+ * have no vector and cover the deleted version only.
+ */
+
+ALTER TABLE nodes.tombstones ADD COLUMN IF NOT EXISTS deleted_vv jsonb;
+
+/*
+ * log a delete, version 3: with the vector of the deleted version
+ */
+DROP FUNCTION IF EXISTS nodes.log_delete( text, text, bytea, bigint, bigint, bigint, bigint );
+CREATE OR REPLACE FUNCTION nodes.log_delete( _table text, _url text, _ckey bytea, _clockid bigint, _tsn bigint,
+       _deleted_clockid bigint, _deleted_tsn bigint, _deleted_vv jsonb ) RETURNS VOID AS $$
+   BEGIN
+     INSERT INTO nodes.oplog( clockid, tsn, table_name, op )
+          VALUES ( _clockid, _tsn, _table, 'D' );
+
+     INSERT INTO nodes.tombstones( clockid, tsn, table_name, url, ckey, deleted_clockid, deleted_tsn, deleted_vv )
+          VALUES ( _clockid, _tsn, _table, _url, _ckey, _deleted_clockid, _deleted_tsn, _deleted_vv );
+
+     PERFORM nodes.putRemoteHigh( _clockid, _tsn );
+     PERFORM nodes.notify_change( _table, _clockid, _tsn, 'D' );
+   END;
+$$ LANGUAGE plpgsql;
+
+/* Trigger function, version 7
+ *
+ * a delete records the vector of the deleted row with its tombstone
+ */
+CREATE OR REPLACE FUNCTION onChange() RETURNS TRIGGER AS $$
+     DECLARE
+          _opcode text;
+          _clockid bigint;
+          _tsn     bigint;
+     BEGIN
+          /* I, U or D: Insert, Update, Delete */
+          _opcode = left( TG_OP , 1 ); /* first letter is enough */
+
+          IF _opcode = 'D' THEN
+           _clockid = nullif( current_setting( 'engine3.delete_clockid', true ), '' )::bigint;
+           IF _clockid IS NULL THEN
+             _clockid = nodes.myclockid();
+             _tsn     = nodes.new_tsn();
+           ELSE
+             _tsn     = current_setting( 'engine3.delete_tsn' )::bigint;
+           END IF;
+
+           PERFORM nodes.log_delete( TG_TABLE_NAME, OLD.url, OLD.ckey, _clockid, _tsn, OLD.clockid, OLD.tsn, OLD.vv );
+           RETURN OLD;
+          END IF;
+
+          IF _opcode = 'U' THEN
+            IF NEW.clockid = OLD.clockid AND NEW.tsn = OLD.tsn THEN
+              RETURN NEW;
+            END IF;
+            IF NEW.sig IS NOT DISTINCT FROM OLD.sig THEN
+              NEW.sig = NULL;
+            END IF;
+          END IF;
+
+          /* an UPDATE, which does not set vv, keeps the vector of the old row */
+          IF coalesce( ( NEW.vv ->> NEW.clockid::text )::bigint, 0 ) < NEW.tsn THEN
+            NEW.vv = coalesce( NEW.vv, '{}'::jsonb ) || jsonb_build_object( NEW.clockid::text, NEW.tsn );
+          END IF;
+
+          INSERT INTO nodes.oplog( clockid, tsn, table_name, op, sig )
+               VALUES (NEW.clockid, NEW.tsn, TG_TABLE_NAME, _opcode, NEW.sig );
+
+          PERFORM nodes.putRemoteHigh( NEW.clockid, NEW.tsn );
+          PERFORM nodes.notify_change( TG_TABLE_NAME, NEW.clockid, NEW.tsn, _opcode );
+          RETURN NEW;
+     END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * read the tombstone of a delete, version 3: with the vector of the
+ * deleted version; the return type changed, drop the old version first
+ */
+DROP FUNCTION IF EXISTS nodes.getTombstone( text, bigint, bigint );
+CREATE FUNCTION nodes.getTombstone( _table text, _clockid bigint, _tsn bigint ) RETURNS TABLE(
+       _url text, _ckey bytea, _deleted_clockid bigint, _deleted_tsn bigint, _sig bytea, _deleted_vv jsonb ) AS $$
+   BEGIN
+     RETURN QUERY
+        SELECT url, ckey, deleted_clockid, deleted_tsn, sig, deleted_vv FROM nodes.tombstones
+         WHERE table_name = _table AND clockid = _clockid AND tsn = _tsn;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * the tombstones of a table, oldest first, version 2: with the vector of
+ * the deleted version
+ */
+DROP FUNCTION IF EXISTS nodes.list_tombstones( text );
+CREATE FUNCTION nodes.list_tombstones( _table text ) RETURNS TABLE(
+       _url text, _ckey bytea, _clockid bigint, _tsn bigint, _deleted_clockid bigint, _deleted_tsn bigint, _sig bytea,
+       _deleted_vv jsonb ) AS $$
+   BEGIN
+     RETURN QUERY
+        SELECT url, ckey, clockid, tsn, deleted_clockid, deleted_tsn, sig, deleted_vv FROM nodes.tombstones
+         WHERE table_name = _table
+         ORDER BY tsn, clockid;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * apply the tombstone of another node, version 4: only a local version the
+ * delete covers is removed, 'skipped' if the url holds a later one
+ */
+DROP FUNCTION IF EXISTS nodes.ae_tombstone( text, text, bytea, bigint, bigint, bigint, bigint, bytea );
+CREATE OR REPLACE FUNCTION nodes.ae_tombstone( _table text, _url text, _ckey bytea, _clockid bigint, _tsn bigint,
+       _deleted_clockid bigint, _deleted_tsn bigint, _deleted_vv jsonb, _sig bytea ) RETURNS text AS $$
+   DECLARE
+      _count bigint;
+   BEGIN
+     PERFORM nodes.check_managed( _table );
+
+     IF EXISTS ( SELECT 1 FROM nodes.tombstones WHERE clockid = _clockid AND tsn = _tsn ) THEN
+       RETURN 'skipped';
+     END IF;
+
+     PERFORM set_config( 'engine3.delete_clockid', _clockid::text, true );
+     PERFORM set_config( 'engine3.delete_tsn', _tsn::text, true );
+
+     EXECUTE format( 'DELETE FROM nodes.%I
+                       WHERE url = $1
+                         AND ( ( clockid = $2 AND tsn <= $3 )
+                               OR coalesce( ( $4 ->> clockid::text )::bigint, 0 ) >= tsn )', _table )
+        USING _url, _deleted_clockid, _deleted_tsn, _deleted_vv;
+     GET DIAGNOSTICS _count = ROW_COUNT;
+
+     PERFORM set_config( 'engine3.delete_clockid', '', true );
+     PERFORM set_config( 'engine3.delete_tsn', '', true );
+
+     IF _count = 0 THEN
+       EXECUTE format( 'SELECT count(*) FROM nodes.%I WHERE url = $1', _table ) INTO _count USING _url;
+       IF _count > 0 THEN
+         /* written after the delete */
+         RETURN 'skipped';
+       END IF;
+
+       PERFORM nodes.log_delete( _table, _url, _ckey, _clockid, _tsn, _deleted_clockid, _deleted_tsn, _deleted_vv );
+       PERFORM nodes.sign( _table, _clockid, _tsn, _sig );
+       RETURN 'recorded';
+     END IF;
+
+     /* the tombstone carries on what the deleting node deleted, not the local version */
+     UPDATE nodes.tombstones
+        SET deleted_clockid = _deleted_clockid, deleted_tsn = _deleted_tsn, deleted_vv = _deleted_vv
+      WHERE clockid = _clockid AND tsn = _tsn;
+
+     PERFORM nodes.sign( _table, _clockid, _tsn, _sig );
+     RETURN 'applied';
+   END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,20 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 23: high water marks only move forward
+ *
+ * Concurrent writers of a clock commit in any order: the one with tsn 10
+ * may commit after the one with tsn 11. The mark keeps the highest tsn,
+ * so that a read at the token of a write is never behind its own write.
+ */
+
+/*
+ * write a new high-water mark record for a remote node, version 2: a lower
+ * tsn leaves the mark as it is
+ */
+CREATE OR REPLACE FUNCTION nodes.putRemoteHigh( _clockid bigint, _tsn bigint ) RETURNS VOID AS $$
+   BEGIN
+     INSERT INTO nodes.highwatermarks( clockid, tsn ) VALUES ( _clockid, _tsn )
+       ON CONFLICT ( clockid ) DO UPDATE
+         SET tsn = greatest( nodes.highwatermarks.tsn, EXCLUDED.tsn );
+   END;
+$$ LANGUAGE plpgsql;
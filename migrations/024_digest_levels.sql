@@ -0,0 +1,55 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 24: digest tree levels
+ *
+ * A digest sync walks down the tree from the root and asks each side only
+ * for the nodes below the ones, which differ. An inner node hashes the hex
+ * digit and the hash of each of its children in digit order, like
+ * Digest.build on the Go side; the leaves are the bucket digests.
+ */
+
+/*
+ * the nodes of the digest tree of a table at _level (hex digits) below
+ * _prefix, for leaves of _depth digits
+ */
+CREATE OR REPLACE FUNCTION nodes.digest_level( _table text, _depth int, _prefix text, _level int ) RETURNS TABLE(
+       _node text, _count bigint, _digest bytea ) AS $$
+   DECLARE
+      _nodes  text[];
+      _counts bigint[];
+      _hashes bytea[];
+      _l      int;
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+
+      IF _level < length( _prefix ) OR _level > _depth THEN
+        RAISE EXCEPTION 'digest level % out of range %..%', _level, length( _prefix ), _depth
+          USING ERRCODE = 'invalid_parameter_value';
+      END IF;
+
+      /* the leaves below the prefix */
+      EXECUTE format(
+        'SELECT array_agg( bucket ORDER BY bucket COLLATE "C" ), array_agg( n ORDER BY bucket COLLATE "C" ),
+                array_agg( hash ORDER BY bucket COLLATE "C" )
+           FROM ( SELECT left( encode( ckey, ''hex'' ), $1 ) AS bucket, count(*) AS n,
+                         digest( string_agg( encode( ckey, ''hex'' ) || encode( cval, ''hex'' ), '''' ORDER BY ckey ), ''md5'' ) AS hash
+                    FROM nodes.%I
+                   WHERE left( encode( ckey, ''hex'' ), length( $2 ) ) = $2
+                   GROUP BY bucket ) b', _table )
+        INTO _nodes, _counts, _hashes
+        USING _depth, _prefix;
+
+      /* up to the level */
+      FOR _l IN REVERSE _depth - 1 .. _level LOOP
+        SELECT array_agg( p ORDER BY p COLLATE "C" ), array_agg( n ORDER BY p COLLATE "C" ), array_agg( hash ORDER BY p COLLATE "C" )
+          INTO _nodes, _counts, _hashes
+          FROM ( SELECT left( u.node, _l ) AS p, sum( u.n )::bigint AS n,
+                        digest( string_agg( convert_to( substr( u.node, _l + 1, 1 ), 'UTF8' ) || u.hash, ''::bytea
+                                            ORDER BY u.node COLLATE "C" ), 'md5' ) AS hash
+                   FROM unnest( _nodes, _counts, _hashes ) AS u( node, n, hash )
+                  GROUP BY left( u.node, _l ) ) x;
+      END LOOP;
+
+      RETURN QUERY SELECT * FROM unnest( _nodes, _counts, _hashes );
+   END;
+$$ LANGUAGE plpgsql STABLE;
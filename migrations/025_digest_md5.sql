@@ -0,0 +1,95 @@
+/* Database Schema for Energy Management Cloud
+ *
+ * Migration 25: table digests across digest algorithms
+ *
+ * The digest tree is always built over md5: a row with digests of another
+ * algorithm is bucketed by the md5 of its url and hashed with the md5 of
+ * its document, like the same row written with md5. So two nodes holding
+ * the same documents have the same tree, while one of them rehashes or
+ * they use different algorithms. Rows with md5 digests (alg NULL or md5)
+ * use their stored ckey and cval.
+ */
+
+/*
+ * the md5 digest of a text, _digest already, if _alg is md5
+ */
+CREATE OR REPLACE FUNCTION nodes.md5_digest( _digest bytea, _text text, _alg text ) RETURNS bytea AS $$
+   SELECT CASE WHEN coalesce( _alg, 'md5' ) = 'md5' THEN _digest ELSE digest( _text, 'md5' ) END;
+$$ LANGUAGE sql IMMUTABLE;
+
+/*
+ * the digests of all non-empty buckets of a table, version 2: over md5
+ */
+CREATE OR REPLACE FUNCTION nodes.bucket_digests( _table text, _depth int ) RETURNS TABLE(
+       _bucket text, _count bigint, _digest bytea ) AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT left( encode( k, ''hex'' ), $1 ) AS bucket, count(*),
+                digest( string_agg( encode( k, ''hex'' ) || encode( v, ''hex'' ), '''' ORDER BY k ), ''md5'' )
+           FROM ( SELECT nodes.md5_digest( ckey, url, alg ) AS k, nodes.md5_digest( cval, data::text, alg ) AS v
+                    FROM nodes.%I ) r
+          GROUP BY bucket
+          ORDER BY bucket', _table )
+        USING _depth;
+   END;
+$$ LANGUAGE plpgsql;
+
+/* BUCKET, version 4: the rows of a bucket over md5 */
+CREATE OR REPLACE FUNCTION nodes.bucket_things( _table text, _bucket text ) RETURNS SETOF nodes.base AS $$
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+      RETURN QUERY EXECUTE format(
+        'SELECT ckey, cval, url, data, clockid, tsn, vv, alg, sig FROM nodes.%I
+          WHERE left( encode( nodes.md5_digest( ckey, url, alg ), ''hex'' ), length( $1 ) ) = $1
+          ORDER BY nodes.md5_digest( ckey, url, alg )', _table )
+        USING _bucket;
+   END;
+$$ LANGUAGE plpgsql;
+
+/*
+ * the nodes of the digest tree of a table at _level below _prefix,
+ * version 2: over md5
+ */
+CREATE OR REPLACE FUNCTION nodes.digest_level( _table text, _depth int, _prefix text, _level int ) RETURNS TABLE(
+       _node text, _count bigint, _digest bytea ) AS $$
+   DECLARE
+      _nodes  text[];
+      _counts bigint[];
+      _hashes bytea[];
+      _l      int;
+   BEGIN
+      PERFORM nodes.check_managed( _table );
+
+      IF _level < length( _prefix ) OR _level > _depth THEN
+        RAISE EXCEPTION 'digest level % out of range %..%', _level, length( _prefix ), _depth
+          USING ERRCODE = 'invalid_parameter_value';
+      END IF;
+
+      /* the leaves below the prefix */
+      EXECUTE format(
+        'SELECT array_agg( bucket ORDER BY bucket COLLATE "C" ), array_agg( n ORDER BY bucket COLLATE "C" ),
+                array_agg( hash ORDER BY bucket COLLATE "C" )
+           FROM ( SELECT left( encode( k, ''hex'' ), $1 ) AS bucket, count(*) AS n,
+                         digest( string_agg( encode( k, ''hex'' ) || encode( v, ''hex'' ), '''' ORDER BY k ), ''md5'' ) AS hash
+                    FROM ( SELECT nodes.md5_digest( ckey, url, alg ) AS k, nodes.md5_digest( cval, data::text, alg ) AS v
+                             FROM nodes.%I ) r
+                   WHERE left( encode( k, ''hex'' ), length( $2 ) ) = $2
+                   GROUP BY bucket ) b', _table )
+        INTO _nodes, _counts, _hashes
+        USING _depth, _prefix;
+
+      /* up to the level */
+      FOR _l IN REVERSE _depth - 1 .. _level LOOP
+        SELECT array_agg( p ORDER BY p COLLATE "C" ), array_agg( n ORDER BY p COLLATE "C" ), array_agg( hash ORDER BY p COLLATE "C" )
+          INTO _nodes, _counts, _hashes
+          FROM ( SELECT left( u.node, _l ) AS p, sum( u.n )::bigint AS n,
+                        digest( string_agg( convert_to( substr( u.node, _l + 1, 1 ), 'UTF8' ) || u.hash, ''::bytea
+                                            ORDER BY u.node COLLATE "C" ), 'md5' ) AS hash
+                   FROM unnest( _nodes, _counts, _hashes ) AS u( node, n, hash )
+                  GROUP BY left( u.node, _l ) ) x;
+      END LOOP;
+
+      RETURN QUERY SELECT * FROM unnest( _nodes, _counts, _hashes );
+   END;
+$$ LANGUAGE plpgsql STABLE;